@@ -0,0 +1,397 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go_pull/pkgs/archive"
+	"go_pull/pkgs/batch"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/reference"
+	"go_pull/pkgs/util/check_path"
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/shutdown"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// stdinPath as --file reads the list from stdin.
+const stdinPath = "-"
+
+var (
+	batchfile string
+	jobs      int
+	bundle    string
+	locked    bool
+)
+
+// batchonly are the flags of the batch itself, not given to the download of
+// every image.
+var batchonly = map[string]bool{"file": true, "jobs": true, "bundle": true, "locked": true,
+	"output": true, "log-format": true}
+
+// result is how the download of a job went.
+type result struct {
+	job  batch.Job
+	code int
+	err  string // last error logged, when it failed
+	out  []byte // stdout of the run
+	log  []byte // stderr of the run
+	took time.Duration
+}
+
+func init() {
+	downloadCmd.PersistentFlags().StringVarP(&batchfile, "file", "f", "",
+		"download the images listed in this file: yaml, or text with one image per line, - reads text from stdin; "+
+			"layers shared by its images are pulled once only with --cache")
+	downloadCmd.PersistentFlags().IntVar(&jobs, "jobs", 2, "images of --file downloaded at once")
+	downloadCmd.PersistentFlags().StringVar(&bundle, "bundle", "",
+		"pack the images of --file into this one archive instead of one archive each")
+	downloadCmd.PersistentFlags().BoolVar(&locked, "locked", false,
+		"download the digests of the lockfile gopull lock wrote for --file, fail when one no longer resolves")
+}
+
+// download_args takes images, or none with --file.
+func download_args(cmd *cobra.Command, args []string) error {
+	if batchfile != "" {
+		return cobra.NoArgs(cmd, args)
+	}
+	if bundle != "" || locked {
+		return fmt.Errorf("--bundle and --locked need --file")
+	}
+	return cobra.MinimumNArgs(1)(cmd, args)
+}
+
+// start_batch downloads the images of --file, each by a download of its own
+// run --jobs at a time, then prints how each went. With --cache the downloads
+// share it and a layer of several images is pulled once, without it every
+// image pulls all its layers.
+func start_batch(cmd *cobra.Command) {
+	list := read_list(batchfile)
+	if output == stdoutPath {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "--file writes archives, not stdout"))
+	}
+	if bundle != "" && output != "" {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "--bundle and --output both set where archives go"))
+	}
+
+	dir := output
+	if dir == "" {
+		dir = "."
+	}
+	if bundle != "" {
+		if check_path.Check_path(written(bundle)).Exists() && !force {
+			logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "%v already exists, use --force to overwrite it", written(bundle)))
+		}
+		dir, err = os.MkdirTemp(stage_dir(bundle), ".gopull_bundle_*")
+		logtool.Fatalerror(err)
+		shutdown.Remove(dir)
+	} else if !dryrun {
+		logtool.Fatalerror(os.MkdirAll(dir, 0755))
+	}
+
+	forward := forward_flags(cmd)
+	if bundle != "" {
+		// the bundle is split, not the archives merged into it
+		forward = slices.DeleteFunc(forward, func(f string) bool { return strings.HasPrefix(f, "--split=") })
+	}
+	list_jobs := list.Jobs()
+	if bundle == "" {
+		unique_names(list_jobs)
+	}
+	images := make([]string, len(list_jobs))
+	for i, job := range list_jobs {
+		images[i] = job.Image
+	}
+	if locked {
+		images = locked_images(list_jobs)
+	}
+	results := run_jobs(list_jobs, func(i int, job batch.Job) []string {
+		args := []string{"download", images[i]}
+		if bundle != "" {
+			args = append(args, "--output="+filepath.Join(dir, strconv.Itoa(i)+".tar"))
+		} else {
+			args = append(args, "--output="+dir)
+		}
+		args = append(args, forward...)
+		for flag, value := range map[string]string{"platform": job.Platform, "name": job.Name, "tag": job.Tag} {
+			if value != "" {
+				args = append(args, "--"+flag+"="+value)
+			}
+		}
+		return args
+	})
+
+	failed := summary(results, "downloaded")
+	if len(failed) == 0 && bundle != "" && !dryrun && !plist {
+		pack_bundle(dir, len(results))
+	}
+	batch_failed(failed, len(results))
+}
+
+// read_list reads the image list of file, - for stdin.
+func read_list(file string) *batch.List {
+	var data []byte
+	if file == stdinPath {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	list, err := batch.Parse(file, data)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	return list
+}
+
+// locked_images returns the images of the jobs pinned to the digests of the
+// lockfile of --file.
+func locked_images(list []batch.Job) []string {
+	if batchfile == stdinPath {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "--locked needs a list file, not stdin"))
+	}
+	path := batch.LockPath(batchfile)
+	data, err := os.ReadFile(path)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	lock, err := batch.ParseLock(path, data)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	var images, missing []string
+	for _, job := range list {
+		e, ok := lock.Find(job.Image, job_platform(job))
+		if !ok {
+			missing = append(missing, job.Image+" "+job_platform(job))
+		}
+		images = append(images, e.Ref)
+	}
+	if len(missing) > 0 {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "%v does not lock %v, run gopull lock %v again",
+			path, strings.Join(missing, ", "), batchfile))
+	}
+	return images
+}
+
+// job_platform is the platform job is pulled for.
+func job_platform(job batch.Job) string {
+	if job.Platform != "" {
+		return job.Platform
+	}
+	return platform
+}
+
+// forward_flags are the flags given to cmd to give to the gopull run for
+// every image.
+func forward_flags(cmd *cobra.Command) []string {
+	var forward []string
+	cmd.Flags().Visit(func(f *pflag.Flag) {
+		if !batchonly[f.Name] {
+			forward = append(forward, "--"+f.Name+"="+f.Value.String())
+		}
+	})
+	return forward
+}
+
+// run_jobs runs gopull with args(i, job) for every job, --jobs at a time, and
+// prints how each went as they finish.
+func run_jobs(list []batch.Job, args func(i int, job batch.Job) []string) []result {
+	exe, err := os.Executable()
+	logtool.Fatalerror(err)
+	results := make([]result, len(list))
+	var wg sync.WaitGroup
+	// the runs get SIGTERM when this one stops, and clean up after
+	// themselves before it exits
+	done := shutdown.Undo("stop downloads", func() error {
+		wg.Wait()
+		return nil
+	})
+	sem := make(chan struct{}, max(jobs, 1))
+	var mu sync.Mutex
+	finished := 0
+	for i, job := range list {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, job batch.Job) {
+			defer func() { <-sem; wg.Done() }()
+			r := run_job(exe, append(args(i, job), "--log-format=json"))
+			r.job = job
+
+			mu.Lock()
+			defer mu.Unlock()
+			results[i] = r
+			finished++
+			print_result(finished, len(list), r)
+		}(i, job)
+	}
+	wg.Wait()
+	done()
+	return results
+}
+
+// batch_failed exits when images failed, with the code of their error
+// class when they all failed the same way.
+func batch_failed(failed []errdefs.Kind, total int) {
+	if len(failed) == 0 {
+		return
+	}
+	kind := failed[0]
+	for _, k := range failed {
+		if k != kind {
+			kind = errdefs.Unknown
+		}
+	}
+	logtool.Fatalerror(errdefs.Errorf(kind, "%v of %v images failed", len(failed), total))
+}
+
+// unique_names names the archives of the images of a repository pulled
+// with several tags or for several platforms {{.Name}}_{{.Tag}}.tar,
+// {{.Name}}_{{.Platform}}.tar or both, when they would all get the default
+// name.
+func unique_names(list []batch.Job) {
+	if nameTemplate != defaultNameTemplate {
+		return
+	}
+	tags := map[string]map[string]bool{}
+	platforms := map[string]map[string]bool{}
+	for _, j := range list {
+		ref, err := reference.Parse(j.Image)
+		if err != nil || j.Name != "" {
+			continue
+		}
+		if tags[ref.Name()] == nil {
+			tags[ref.Name()], platforms[ref.Name()] = map[string]bool{}, map[string]bool{}
+		}
+		tags[ref.Name()][ref.Tag] = true
+		platforms[ref.Name()][job_platform(j)] = true
+	}
+	for i, j := range list {
+		ref, err := reference.Parse(j.Image)
+		if err != nil || j.Name != "" {
+			continue
+		}
+		name := "{{.Name}}"
+		if len(tags[ref.Name()]) > 1 {
+			name += "_{{.Tag}}"
+		}
+		if len(platforms[ref.Name()]) > 1 {
+			name += "_{{.Platform}}"
+		}
+		list[i].Name = name + ".tar"
+	}
+}
+
+// gopull_command runs gopull with args in a process group of its own, so
+// that Ctrl-C only reaches it through this run: it gets SIGTERM when the run
+// stops, and cleans up after itself.
+func gopull_command(exe string, args []string) *exec.Cmd {
+	c := exec.CommandContext(shutdown.Context, exe, args...)
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	c.Cancel = func() error {
+		return c.Process.Signal(syscall.SIGTERM)
+	}
+	return c
+}
+
+// run_job runs gopull for a job.
+func run_job(exe string, args []string) result {
+	var out, log bytes.Buffer
+	c := gopull_command(exe, args)
+	c.Stdout = &out
+	c.Stderr = &log
+	start := time.Now()
+	err := c.Run()
+	r := result{out: out.Bytes(), log: log.Bytes(), took: time.Since(start)}
+	var exit *exec.ExitError
+	switch {
+	case errors.As(err, &exit):
+		r.code = exit.ExitCode()
+		r.err = fatal_message(append(log.Bytes(), out.Bytes()...))
+	case err != nil:
+		r.code = shutdown.ExitError
+		r.err = err.Error()
+	}
+	return r
+}
+
+// fatal_message finds the error a run failed with in its json log, or takes
+// the last line it printed when it failed before logging, on invalid flags.
+func fatal_message(out []byte) string {
+	msg := "no error logged"
+	if last := bytes.TrimSpace(out); len(last) > 0 {
+		msg = string(last[bytes.LastIndexByte(last, '\n')+1:])
+	}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var entry struct {
+			Level string `json:"level"`
+			Msg   string `json:"msg"`
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(s.Bytes(), &entry) != nil || entry.Level != "FATAL" {
+			continue
+		}
+		msg = entry.Error
+		if msg == "" {
+			msg = entry.Msg
+		}
+	}
+	return msg
+}
+
+func print_result(n int, total int, r result) {
+	took := r.took.Round(100 * time.Millisecond)
+	if r.code != 0 {
+		fmt.Fprintf(logtool.Console, "[%v/%v] failed %v (%v): %v\n", n, total, r.job, errdefs.FromExitCode(r.code), r.err)
+		return
+	}
+	fmt.Fprintf(logtool.Console, "[%v/%v] ok %v in %v\n", n, total, r.job, took)
+	if dryrun || plist {
+		logtool.Console.Write(r.out)
+	}
+}
+
+// summary prints how many images were done, as verb tells, and which ones
+// failed, and returns the kinds of their errors.
+func summary(results []result, verb string) []errdefs.Kind {
+	var failed []errdefs.Kind
+	for _, r := range results {
+		if r.code != 0 {
+			failed = append(failed, errdefs.FromExitCode(r.code))
+		}
+	}
+	fmt.Fprintf(logtool.Console, "\n%v images: %v %v, %v failed\n",
+		len(results), len(results)-len(failed), verb, len(failed))
+	for _, r := range results {
+		if r.code != 0 {
+			fmt.Fprintf(logtool.Console, "  %v: %v (exit %v)\n", r.job, r.err, r.code)
+		}
+	}
+	return failed
+}
+
+// pack_bundle merges the n archives downloaded into dir into --bundle.
+func pack_bundle(dir string, n int) {
+	var paths []string
+	for i := 0; i < n; i++ {
+		paths = append(paths, filepath.Join(dir, strconv.Itoa(i)+".tar"))
+	}
+	af, err := create_archive(bundle)
+	logtool.Fatalerror(err)
+	logtool.Fatalerror(archive.Merge(af, paths))
+	done, err := af.finish()
+	logtool.Fatalerror(err)
+	logtool.Fatalerror(os.RemoveAll(dir))
+	shutdown.Forget(dir)
+	fmt.Fprintf(logtool.Console, "打包完成，生成文件 %v\n", done)
+}
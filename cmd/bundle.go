@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	delta "go_pull/pkgs/bundle"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/store"
+	"go_pull/pkgs/util/check_path"
+	"go_pull/pkgs/util/conversion"
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/makestr"
+	"go_pull/pkgs/util/shutdown"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	bundleout string
+	since     string
+	storedir  string
+)
+
+var bundleCmd = &cobra.Command{
+	Use:   "bundle ARCHIVE... -o BUNDLE",
+	Short: "pack archives into a bundle holding only the files the other side of an air gap lacks",
+	Long: `bundle packs image archives, docker save or OCI, into BUNDLE with the
+recipe to rebuild them. With --since, files listed in the index of an earlier
+bundle are left out: the other side has them in its store. Every bundle
+writes its index next to it, BUNDLE with the extension .index, for the next
+one. bundle apply rebuilds the archives on the other side.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		startbundle(args)
+	},
+}
+
+var bundleApplyCmd = &cobra.Command{
+	Use:   "apply BUNDLE... --store DIR",
+	Short: "store the files of bundles and rebuild their archives, checking every digest",
+	Long: `apply adds the files of the bundles to the store, then rebuilds their
+archives into --output from the store. Bundles made --since an earlier one
+need the files of that one in the store: apply them in the order they were
+made.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		applybundles(args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(bundleCmd)
+	bundleCmd.AddCommand(bundleApplyCmd)
+	bundleCmd.Flags().StringVarP(&bundleout, "output", "o", "", "bundle to write")
+	bundleCmd.Flags().StringVar(&since, "since", "", "index of the last bundle, whose files are left out")
+	bundleCmd.Flags().BoolVar(&force, "force", false, "overwrite an existing bundle")
+	bundleCmd.MarkFlagRequired("output")
+	bundleApplyCmd.Flags().StringVar(&storedir, "store", "", "blob store of this side (default: cache of the config)")
+	bundleApplyCmd.Flags().StringVarP(&output, "output", "o", ".", "directory to rebuild the archives in")
+	bundleApplyCmd.Flags().BoolVar(&force, "force", false, "overwrite existing archives")
+}
+
+// index_path is the index of bundle file name.
+func index_path(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".index"
+}
+
+func startbundle(archives []string) {
+	have := delta.Index{}
+	if since != "" {
+		f, err := os.Open(since)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		have, err = delta.ReadIndex(f)
+		f.Close()
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	}
+	if check_path.Check_path(bundleout).Exists() && !force {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "%v already exists, use --force to overwrite it", bundleout))
+	}
+	tf, err := os.CreateTemp(filepath.Dir(bundleout), makestr.Joinstring(".", filepath.Base(bundleout), ".*.partial"))
+	logtool.Fatalerror(err)
+	shutdown.Remove(tf.Name())
+	next, err := delta.Build(tf, archives, have)
+	logtool.Fatalerror(err)
+	logtool.Fatalerror(tf.Close())
+	logtool.Fatalerror(os.Chmod(tf.Name(), 0644))
+	logtool.Fatalerror(place(tf.Name(), bundleout))
+	shutdown.Forget(tf.Name())
+
+	var b bytes.Buffer
+	logtool.Fatalerror(next.Write(&b))
+	write_file(index_path(bundleout), b.Bytes())
+	info, err := os.Stat(bundleout)
+	logtool.Fatalerror(err)
+	fmt.Fprintf(logtool.Console, "打包完成，生成文件 %v (%v), %v files known on the other side once applied, index %v\n",
+		bundleout, conversion.Humanize_uintbytes(uint64(info.Size())), len(next), index_path(bundleout))
+}
+
+func applybundles(bundles []string) {
+	if storedir == "" {
+		storedir = conf.Cache
+	}
+	if storedir == "" {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "no store, set --store or cache in the config"))
+	}
+	s, err := store.Open(storedir)
+	logtool.Fatalerror(err)
+	logtool.Fatalerror(os.MkdirAll(output, 0755))
+	for _, name := range bundles {
+		f, err := os.Open(name)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		recipe, err := delta.Apply(f, s)
+		f.Close()
+		if err != nil {
+			logtool.Fatalerror(fmt.Errorf("%v: %w", name, err))
+		}
+		for _, a := range recipe.Archives {
+			out := filepath.Join(output, filepath.Base(a.Name))
+			if check_path.Check_path(out).Exists() && !force {
+				logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "%v already exists, use --force to overwrite it", out))
+			}
+			tf, err := os.CreateTemp(output, makestr.Joinstring(".", filepath.Base(out), ".*.partial"))
+			logtool.Fatalerror(err)
+			shutdown.Remove(tf.Name())
+			if err := delta.Rebuild(tf, a, s); err != nil {
+				logtool.Fatalerror(fmt.Errorf("%v: %w", out, err))
+			}
+			logtool.Fatalerror(tf.Close())
+			logtool.Fatalerror(os.Chmod(tf.Name(), 0644))
+			logtool.Fatalerror(place(tf.Name(), out))
+			shutdown.Forget(tf.Name())
+			fmt.Fprintf(logtool.Console, "rebuilt %v from %v\n", out, name)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"go_pull/pkgs/config"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/makestr"
+	"go_pull/pkgs/util/request"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// conf is the config of the run, from the config files and GOPULL_*
+// variables.
+var conf = &config.Config{}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "show the configuration of gopull",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+var configShowCmd = &cobra.Command{
+	Use:   "show",
+	Short: "print the effective config: files, GOPULL_* variables and the defaults of download",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		show_config()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(configCmd)
+	configCmd.AddCommand(configShowCmd)
+}
+
+// load_config reads the config and gives its settings to the flags of cmd
+// not set on the command line.
+func load_config(cmd *cobra.Command) error {
+	c, err := config.Load(config.Paths(), os.Environ())
+	if err != nil {
+		return err
+	}
+	conf = c
+	for name, value := range conf.Flags() {
+		f := cmd.Flags().Lookup(name)
+		if f == nil || f.Changed {
+			continue
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("config %v: invalid value %q: %v", name, value, err)
+		}
+	}
+	return nil
+}
+
+// registry_conf returns the settings of the registry pulled from.
+func registry_conf() config.Registry {
+	return conf.Registry(registry)
+}
+
+// registry_url returns the url of path in the v2 API of the registry.
+// Insecure registries are talked https without verifying them, or plain
+// http when they do not answer https.
+func registry_url(path ...string) string {
+	scheme := "https"
+	if registry_conf().Insecure {
+		scheme = request.InsecureScheme(registry)
+	}
+	return makestr.Joinstring(append([]string{scheme, "://", registry, "/v2/"}, path...)...)
+}
+
+// setup_registry applies the settings of the registry of the image: its CA
+// or insecure, and the first of its mirrors that answers.
+func setup_registry() {
+	r := registry_conf()
+	for _, host := range append(append([]string{}, r.Mirrors...), registry) {
+		if conf.Registry(host).Insecure {
+			request.SetInsecure(host)
+		}
+		if ca := conf.Registry(host).CA; ca != "" {
+			logtool.Fatalerror(errdefs.New(errdefs.Usage, request.SetCA(host, ca)))
+		}
+	}
+	for _, mirror := range r.Mirrors {
+		origin := registry
+		registry = mirror
+		resp, err := request.Requests(registry_url()).Settls().Get()
+		if err == nil && (resp.StatusCode() == 200 || resp.StatusCode() == 401) {
+			logtool.SugLog.Infof("pulling from mirror %v of %v", mirror, origin)
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("HTTP %v", resp.Status())
+		}
+		logtool.SugLog.Warnf("mirror %v of %v: %v", mirror, origin, err)
+		registry = origin
+	}
+}
+
+// basic_auth returns the Authorization header of the credentials of the
+// registry, "" when there are none.
+func basic_auth() string {
+	user, pass, err := registry_conf().Credentials()
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	if user == "" && pass == "" {
+		return ""
+	}
+	return makestr.Joinstring("Basic ", base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+}
+
+// show_config prints the config in effect: what the files and GOPULL_*
+// variables set, and the defaults of download for the rest.
+func show_config() {
+	if len(conf.Files) == 0 {
+		fmt.Println("# no config file")
+	}
+	for _, f := range conf.Files {
+		fmt.Printf("# %v\n", f)
+	}
+	effective := *conf
+	set := conf.Flags()
+	for _, flags := range []*pflag.FlagSet{rootCmd.PersistentFlags(), downloadCmd.PersistentFlags()} {
+		flags.VisitAll(func(f *pflag.Flag) {
+			if _, ok := set[f.Name]; !ok && config.Known(f.Name) && f.DefValue != "" {
+				logtool.Fatalerror(effective.Set(f.Name, f.DefValue))
+			}
+		})
+	}
+	b, err := effective.Show()
+	logtool.Fatalerror(err)
+	fmt.Print(string(b))
+}
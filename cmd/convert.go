@@ -4,7 +4,6 @@ import (
 	"go_pull/pkgs/util/logtool"
 	"go_pull/pkgs/vmconfig"
 	"go_pull/pkgs/vmbetter"
-	"fmt"
 	"github.com/spf13/cobra"
 )
 
@@ -14,6 +13,7 @@ var (
 		Short: "convert image",
 		Long:  `convert image!`,
 		TraverseChildren: true,
+		Args: cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
 			convert(args)
 		},
@@ -26,23 +26,17 @@ func init() {
 }
 
 
+// convert builds a disk from an archive. A failure or Ctrl-C unmounts and
+// detaches the disk and removes it, see shutdown.
 func convert(args []string) {
-    conf := vmconfig.Config{Path: "tmp"}
-    mount, err := vmbetter.BuildDisk("./", conf)
-    fmt.Println(err)	
-	if err != nil {
-		return
-	}
-	err = vmbetter.ExtractDocker(mount, args[0])
-    fmt.Println(err)
-	if err != nil {
-		return
-	}
+	conf := vmconfig.Config{Path: "tmp"}
+	mount, err := vmbetter.BuildDisk("./", conf)
+	logtool.Fatalerror(err)
+	logtool.Fatalerror(vmbetter.ExtractDocker(mount, args[0]))
 /*	err = vmbetter.PostBuild(mount)
     fmt.Println(err)
 	if err != nil {
 		return
 	}*/
-	err = vmbetter.FinishDisk(mount,conf)
-    fmt.Println(err)
+	logtool.Fatalerror(vmbetter.FinishDisk(mount, conf))
 }
@@ -1,31 +1,35 @@
 package cmd
 
 import (
-	"compress/gzip"
+	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"go_pull/pkgs/errdefs"
 	"go_pull/pkgs/vmconfig"
+	"go_pull/pkgs/archive"
+	"go_pull/pkgs/layer"
 	"go_pull/pkgs/model"
+	"go_pull/pkgs/reference"
+	"go_pull/pkgs/store"
 	"go_pull/pkgs/util/aes"
-	"go_pull/pkgs/util/check_path"
-	"go_pull/pkgs/util/filetool"
 	"go_pull/pkgs/util/logtool"
 	"go_pull/pkgs/util/makestr"
 	"go_pull/pkgs/util/progress"
 	"go_pull/pkgs/util/request"
-	"go_pull/pkgs/util/tartool"
+	"go_pull/pkgs/util/shutdown"
 	"go_pull/pkgs/util/timetool"
 
 	"io"
 	"net/http"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/opencontainers/go-digest"
 	"github.com/spf13/cobra"
 )
 
@@ -39,19 +43,40 @@ var (
 	registry    string
 	platform    string
 	plist       bool
+	parallel    int
+	parallelset bool // --parallel given, it wins over the config of the registry
+	cachedir    string
+	dryrun      bool
+	verifysig   bool
+	skipforeign bool
+	recompress  string
+	savetag     string
+	resolve     bool
+	basicauth   bool
+	blobs       *store.Store
+	authMu      sync.Mutex
 )
 
 type download_parameter struct {
-	layer    interface{}
-	layerdir string
+	layer    model.Descriptor
 	ublob    string
+	size     int
 	startbyt int
-	endbyt   int
 	n        int
-	w        *sync.WaitGroup
-	progress string
-	tfile    *os.File
-	err      error
+	diffid   string // expected digest of the tar, "" when not known yet
+	// out receives the layer recompressed with to, nil keeps it as pulled
+	out io.Writer
+	to  layer.Compression
+}
+
+// spool is a layer prefetched into a temporary file, or the cache, while the
+// layers before it are still streamed into the archive.
+type spool struct {
+	file *os.File
+	keep   bool // file is a cached blob, not a temporary file
+	done   chan struct{}
+	diffid string // digest of the tar, when it was downloaded
+	err    error
 }
 
 func init() {
@@ -60,117 +85,152 @@ func init() {
 		"Select platform system architecture, such as arm64v8, among which v8 is the field variant if it exists")
 	downloadCmd.PersistentFlags().BoolVarP(&plist, "show", "s", false, "list platform system architecture")
 	downloadCmd.PersistentFlags().IntVarP(&vmconfig.Ptimeout, "timeout", "t", 3, "timeout/s of the request")
-	downloadCmd.PersistentFlags().IntVarP(&vmconfig.Piotimeout, "iotimeout", "o", 20, "iotimeout/s of the request")
+	downloadCmd.PersistentFlags().IntVar(&vmconfig.Piotimeout, "iotimeout", 20, "seconds without any data before a request fails")
 	downloadCmd.PersistentFlags().IntVarP(&vmconfig.Retry, "retry", "r", 5, "Connection failure is the maximum number of retries")
 	downloadCmd.PersistentFlags().StringVarP(&vmconfig.Loglevel, "level", "l", "debug", "log level: debug、info、warn、error")
+	downloadCmd.PersistentFlags().StringVarP(&output, "output", "o", "",
+		"archive path, a directory to put it in, or - to write it to stdout")
+	downloadCmd.PersistentFlags().StringVar(&tmpdir, "tmpdir", "", "directory for temporary files (default: next to the archive)")
+	downloadCmd.PersistentFlags().StringVar(&nameTemplate, "name", defaultNameTemplate,
+		"archive file name template, fields: {{.Registry}} {{.Repo}} {{.Name}} {{.Tag}} {{.Digest}} {{.Platform}}")
+	downloadCmd.PersistentFlags().BoolVar(&force, "force", false, "overwrite an existing archive")
+	downloadCmd.PersistentFlags().IntVar(&parallel, "parallel", 3,
+		"layers downloaded at once, all but the one being written to the archive are kept in --tmpdir")
+	downloadCmd.PersistentFlags().StringVar(&cachedir, "cache", "",
+		"keep downloaded layers in this directory and reuse them (default: no cache)")
+	downloadCmd.PersistentFlags().BoolVar(&dryrun, "dry-run", false,
+		"print the layers, sizes and output path of the download without writing anything")
+	downloadCmd.PersistentFlags().BoolVar(&verifysig, "verify-signature", false,
+		"check the signature of legacy schema1 manifests, unsigned ones are refused")
+	downloadCmd.PersistentFlags().BoolVar(&skipforeign, "skip-foreign-layers", false,
+		"do not download foreign layers, such as Windows base layers, only record where they come from in manifest.json")
+	downloadCmd.PersistentFlags().StringVar(&recompress, "recompress", "",
+		"write layers into the archive compressed with gzip, zstd or none (default: as pulled)")
+	downloadCmd.PersistentFlags().StringVar(&savetag, "tag", "",
+		"name:tag to save the image as, such as mirror.example.com/redis:7 (default: the pulled one)")
+	downloadCmd.PersistentFlags().BoolVar(&resolve, "resolve", false,
+		"print the digest of the platform manifest and stop, for gopull lock")
+	downloadCmd.PersistentFlags().MarkHidden("resolve")
+	downloadCmd.PersistentFlags().StringVar(&split, "split", "",
+		"write the archive as numbered volumes of this size, such as 4G, with a sha256sum index, see gopull join")
 
 }
 
 var downloadCmd = &cobra.Command{
 	Use:   "download",
 	Short: "download image only",
-	Args:  cobra.MinimumNArgs(1),
+	Args:  download_args,
 	Long:  `All software has versions. This is pull's`,
 	Run: func(cmd *cobra.Command, args []string) {
 		logtool.Setloglevel(vmconfig.Loglevel)
+		if output == stdoutPath || resolve {
+			logtool.UseStderr()
+		}
+		parallelset = cmd.Flags().Changed("parallel")
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, parse_split()))
+		if batchfile != "" {
+			start_batch(cmd)
+			return
+		}
 		startdownload(args)
 	},
 }
 
-func get_platform_digest(resp_json map[string]interface{}) (platform_digest string) {
-	var platformv_list []string
-	manifests, isOk := resp_json["manifests"]
-	if !isOk {
-		if !plist {
-
-			platform_digest_any, Ok := resp_json["tag"]
-			if !Ok {
-				logtool.SugLog.Fatal("manifests have no tag key")
-			}
-			platform_digest = platform_digest_any.(string)
-			return
-		} else {
-			manifests = resp_json
-		}
-	}
-
+// select_platform picks the manifest for --platform from an index, or lists
+// the platforms of the index with --show.
+func select_platform(index *model.Index) string {
 	if plist {
-		data, _ := json.MarshalIndent(manifests, "", " ")
+		data, _ := json.MarshalIndent(index.Manifests, "", " ")
 		fmt.Println(string(data))
 		os.Exit(0)
 	}
+	m, platforms, ok := index.Find(platform)
+	if !ok {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.NotFound, "%v has no image for platform %v, use -p with one of %v",
+			repository, platform, platforms))
+	}
+	return m.Digest
+}
 
-	for _, v := range manifests.([]interface{}) {
-
-		platformv := v.(map[string]interface{})["platform"]
-		platformvStr := platformv.(map[string]interface{})["architecture"].(string)
-		if variant, ok := platformv.(map[string]interface{})["variant"]; ok {
-			platformvStr = platformvStr + variant.(string)
-		}
-
-		if platformvStr == platform {
-			platform_digest = v.(map[string]interface{})["digest"].(string)
-			break
-		}
-		platformv_list = append(platformv_list, platformv.(string))
-
+// get_manifest fetches the manifest of ref, an image manifest or an index.
+func get_manifest(ref string) (*resty.Response, string) {
+	resp, err := request.Requests(
+		registry_url(repository, "/manifests/", ref)).
+		Setheads(auth_head).
+		Settls().
+		Get()
+	if err != nil {
+		logtool.Fatalerror(fmt.Errorf("cannot fetch manifest %v of %v: %w", ref, repository, err))
 	}
-	if platform_digest == "" {
-		logtool.SugLog.Fatalf("please use -p %v\n", platformv_list)
+	if resp.StatusCode() != 200 {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.HTTPStatus(resp.StatusCode()),
+			"cannot fetch manifest %v of %v: HTTP %v", ref, repository, resp.Status()))
 	}
-	return
+	kind, err := model.Kind(resp.Header().Get("Content-Type"), resp.Body())
+	logtool.Fatalerror(err)
+	if strings.Contains(ref, ":") && kind != model.MediaTypeSchema1 {
+		logtool.Fatalerror(check_digest("manifest", ref, resp.Body()))
+	}
+	return resp, kind
 }
 
-func startdownload(args []string) {
-
-	// Look for the Docker image to download
-	inargv := args
-	var img string
-	var repo string = "library"
-	var tag string = "latest"
-	var imlist string
-	var digest string
-	var imgpartstr string
-	registry = "registry-1.docker.io"
-
-	if strings.Contains(inargv[0], "@") {
-		s := strings.Split(inargv[0], "@")
-		imlist, digest = s[0], s[1]
-	} else {
-		imlist, digest = inargv[0], ""
+// check_digest fails when body is not the content of dgst.
+func check_digest(what string, dgst string, body []byte) error {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return err
 	}
-
-	if strings.Contains(inargv[0], ":") {
-		s := strings.Split(imlist, ":")
-		imgpartstr, tag = s[0], s[1]
-	} else {
-		imgpartstr, tag = imlist, "latest"
+	if got := d.Algorithm().FromBytes(body); got != d {
+		return errdefs.Errorf(errdefs.DigestMismatch, "%v digest mismatch, expected %v got %v", what, d, got)
 	}
+	return nil
+}
 
-	imgpartlist := strings.Split(imgpartstr, "/")
-	img = imgpartlist[len(imgpartlist)-1]
+// parse_image parses an image argument and sets the registry and repository
+// the image is pulled from.
+func parse_image(arg string) reference.Reference {
+	ref, err := reference.Parse(arg)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	registry = ref.Registry
+	repository = ref.Repository
+	setup_registry()
+	return ref
+}
 
-	// Docker client doesn't seem to consider the first element as a potential registry unless there is a '.' or ':'
-	if len(imgpartlist) > 1 && (strings.Contains(imgpartlist[0], ".") || strings.Contains(imgpartlist[0], ":")) {
-		registry = imgpartlist[0]
-		repo = strings.Join(imgpartlist[1:len(imgpartlist)-1], "/")
-	} else {
-		if len(imgpartlist[:len(imgpartlist)-1]) != 0 {
-			repo = strings.Join(imgpartlist[:len(imgpartlist)-1], "/")
-		}
+// saved_ref is the name and tag the image is saved as: --tag, or ref.
+func saved_ref(ref reference.Reference) reference.Reference {
+	if savetag == "" {
+		return ref
+	}
+	saved, err := reference.Parse(savetag)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	if saved.Digest != "" {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "--tag %v: images are saved with a tag, not a digest", savetag))
 	}
-	repository = makestr.Joinstring(repo, "/", img)
+	return saved
+}
 
-	//Get Docker authentication endpoint when it is required
+// get_auth_url asks the registry where to fetch tokens from. Registries that
+// do not answer 401 keep the Docker Hub defaults, those asking for Basic
+// authentication get the credentials of the config with every request.
+func get_auth_url() {
 	auth_url = "https://auth.docker.io/token"
 	reg_service = "registry.docker.io"
+	basicauth = false
 	logtool.SugLog.Debug("get docker auth_url...")
 	resp, err = request.Requests(
-		makestr.Joinstring("https://", registry, "/v2/")).
+		registry_url()).
 		Settls().
 		Get()
-	logtool.Fatalerror(err)
-	if resp.StatusCode() == 401 {
+	if err != nil {
+		logtool.Fatalerror(fmt.Errorf("cannot reach %v: %w", registry, err))
+	}
+	if resp.StatusCode() == 200 {
+		// an open registry, gopull serve or a plain registry:2
+		auth_url = ""
+	} else if resp.StatusCode() == 401 && strings.HasPrefix(strings.ToLower(resp.Header().Get("Www-Authenticate")), "basic") {
+		basicauth = true
+	} else if resp.StatusCode() == 401 {
 		auth_url = resp.Header().Get("Www-Authenticate")
 		reg_Header_list := strings.Split(auth_url, "\"")
 		auth_url = reg_Header_list[1]
@@ -180,180 +240,305 @@ func startdownload(args []string) {
 			reg_service = ""
 		}
 	}
-	//Fetch manifest v2 and get image layer digests
-	var platform_digest string
+}
 
-	if digest == "" {
-		logtool.SugLog.Debug("get docker auth header...")
-		auth_head = get_auth_head("application/vnd.docker.distribution.manifest.list.v2+json")
-		queryManifestsListUrl := makestr.Joinstring("https://", registry, "/v2/", repository, "/manifests/", tag)
-		resp, err := request.Requests(queryManifestsListUrl).
-			Setheads(auth_head).
-			Settls().
-			Get()
-		logtool.Errorerror(err)
-		if resp.StatusCode() != 200 {
-			logtool.SugLog.Fatal("[-] Cannot fetch manifest for %v [HTTP %v]", repository, resp.Status())
-		}
-		respJson := request.Parsebody_to_json(resp)
+func startdownload(args []string) {
 
-		platform_digest = get_platform_digest(respJson)
-	} else {
-		platform_digest = digest
+	// Look for the Docker image to download
+	ref := parse_image(args[0])
+	saved := saved_ref(ref)
+	if n := conf.Registry(ref.Registry).Parallel; n > 0 && !parallelset {
+		parallel = n
+	}
+	if recompress != "" {
+		_, err = layer.ParseCompression(recompress)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	}
+	if cachedir != "" {
+		if dryrun {
+			blobs = &store.Store{Root: cachedir}
+		} else {
+			blobs, err = store.Open(cachedir)
+			logtool.Fatalerror(err)
+		}
 	}
 
-	logtool.SugLog.Debug("request again docker auth header if Expired...")
-	auth_head = get_auth_head("application/vnd.docker.distribution.manifest.v2+json")
-	queryManifestsUrl := makestr.Joinstring("https://", registry, "/v2/", repository, "/manifests/", platform_digest)
-
+	//Get Docker authentication endpoint when it is required
+	get_auth_url()
+	//Fetch the manifest, through the index for multi-platform images
+	var platform_digest string
 	logtool.SugLog.Debug("get docker manifests...")
-	resp, err = request.Requests(queryManifestsUrl).
-		Setheads(auth_head).
-		Settls().
-		Get()
-	logtool.Fatalerror(err)
-	
+	auth_head = get_auth_head(manifestAccept)
+	resp, kind := get_manifest(ref.Ref())
+	// what the tag points to, recorded for outdated to compare with a HEAD
+	repo_digest := resp.Header().Get("Docker-Content-Digest")
+	var legacy *model.Schema1
+	var indexbody []byte
+	if kind == model.MediaTypeManifestList {
+		indexbody = resp.Body()
+		index, err := model.ParseIndex(indexbody)
+		logtool.Fatalerror(err)
+		platform_digest = select_platform(index)
+
+		logtool.SugLog.Debug("request again docker auth header if Expired...")
+		auth_head = get_auth_head(manifestAccept, auth_head)
+		resp, kind = get_manifest(platform_digest)
+		if kind != model.MediaTypeManifest {
+			logtool.Fatalerror(fmt.Errorf("%v of the index is not an image manifest", platform_digest))
+		}
+	} else {
+		if plist {
+			fmt.Printf("%v is a single platform image\n", ref)
+			os.Exit(0)
+		}
+		platform_digest = resp.Header().Get("Docker-Content-Digest")
+	}
+	var manifest *model.Manifest
+	body := resp.Body()
+	if kind == model.MediaTypeSchema1 {
+		legacy, manifest = schema1_manifest(body)
+		// the digest of a signed manifest leaves the signatures out
+		body = legacy.Payload
+	} else {
+		manifest, err = model.ParseManifest(body)
+		logtool.Fatalerror(err)
+	}
+	if platform_digest == "" {
+		platform_digest = makestr.Joinstring("sha256:", aes.Sha256t(string(body)))
+	}
+	if repo_digest == "" && indexbody != nil {
+		repo_digest = makestr.Joinstring("sha256:", aes.Sha256t(string(indexbody)))
+	} else if repo_digest == "" {
+		repo_digest = platform_digest
+	}
+	if resolve {
+		fmt.Println(platform_digest)
+		return
+	}
+	layers := manifest.Layers
+	config := manifest.Config.Digest
 
-	rresp := request.Parsebody_to_json(resp)
-	layers := rresp["layers"].([]interface{})
+	if dryrun {
+		print_plan(ref, platform_digest, manifest)
+		return
+	}
 
-	//Create tmp folder that will hold the image
-	imgdir := makestr.Joinstring("tmp_", img, "_", strings.ReplaceAll(tag, "@", ""))
-	if check_path.Check_path(imgdir).Exists() {
-		os.RemoveAll(imgdir)
+	out, err := output_path(ref, platform_digest)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	if parallel < 1 {
+		parallel = 1
+	}
+	stage := stage_dir(out)
+	var compressed, spooled uint64
+	var sizes []int
+	for _, l := range layers {
+		if skip_layer(l) {
+			continue
+		}
+		parameter := layer_parameter(l)
+		compressed += uint64(parameter.size)
+		if blobs == nil {
+			sizes = append(sizes, parameter.size)
+		} else if _, ok := blobs.Has(parameter.ublob); !ok {
+			spooled += uint64(parameter.size)
+		}
 	}
-	os.Mkdir(imgdir, os.ModePerm)
-	logtool.SugLog.Infof("Creating image structure in: %v", imgdir)
+	if recompress == "none" {
+		compressed *= unpackRatio
+	}
+	spooldir := stage
+	if blobs != nil {
+		// every missing layer is kept in the cache
+		spooldir = blobs.Root
+	} else if legacy != nil {
+		// schema1 layers are all downloaded before the archive is written
+		spooled = compressed
+	} else {
+		// at most parallel-1 layers wait in the staging directory at once,
+		// all of them when they are recompressed
+		waiting := parallel - 1
+		if recompress != "" {
+			waiting = parallel
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(sizes)))
+		for i := 0; i < waiting && i < len(sizes); i++ {
+			spooled += uint64(sizes[i])
+		}
+	}
+	logtool.Fatalerror(errdefs.New(errdefs.DiskFull, check_space(out, spooldir, compressed, spooled)))
 
-	config := rresp["config"].(map[string]interface{})["digest"].(string)
+	var confbody []byte
+	spools := map[int]*spool{}
+	if legacy != nil {
+		logtool.SugLog.Debug("build image config from the schema1 manifest...")
+		confbody = schema1_config(legacy, stage, layers, spools)
+	} else {
+		logtool.SugLog.Debug("get docker blobs config...")
+		confresp, err := request.Requests(
+			registry_url(repository, "/blobs/", config)).
+			Setheads(auth_head).
+			Settls().
+			Get()
+		if err != nil {
+			logtool.Fatalerror(fmt.Errorf("cannot fetch the image config: %w", err))
+		}
+		confbody = confresp.Body()
+		logtool.Fatalerror(check_digest("image config", config, confbody))
+	}
+	_, err = model.ParseImageConfig(confbody)
+	logtool.Fatalerror(err)
 
-	logtool.SugLog.Debug("get docker blobs config...")
-	confresp, err := request.Requests(
-		makestr.Joinstring("https://", registry, "/v2/", repository, "/blobs/", config)).
-		Setheads(auth_head).
-		Settls().
-		Get()
+	//Layer names and metadata follow docker save
+	save, err := model.NewSave(confbody)
 	logtool.Fatalerror(err)
-	f := filetool.GetfileOjb(makestr.Joinstring(imgdir, "/", config[7:], ".json"))
-	f.WriteString(confresp.String())
-	f.Close()
-
-	content := model.Contentvar()
-	content[0].Config = makestr.Joinstring(config[7:], ".json")
-
-	if len(imgpartlist[:len(imgpartlist)-1]) != 0 {
-		content[0].RepoTags = append(
-			content[0].RepoTags,
-			makestr.Joinstring(strings.Join(imgpartlist[:len(imgpartlist)-1], "/"), "/", img, ":", tag),
-		)
+	if len(save.Layers) != len(layers) {
+		logtool.Fatalerror(fmt.Errorf("image config has %v diff_ids for %v layers", len(save.Layers), len(layers)))
+	}
+
+	//Open the archive, layers are streamed into it as they arrive
+	var aw *archive.Writer
+	var af *archive_file
+	if out == stdoutPath {
+		aw = archive.NewWriter(os.Stdout)
 	} else {
-		content[0].RepoTags = append(
-			content[0].RepoTags,
-			makestr.Joinstring(img, ":", tag),
-		)
+		af, err = create_archive(out)
+		logtool.Fatalerror(err)
+		aw = archive.NewWriter(af)
+	}
+	//Layers are checked against their diff_id while they download
+	parameter_at := func(x int) download_parameter {
+		parameter := layer_parameter(layers[x])
+		parameter.diffid = save.Layers[x].DiffID
+		return parameter
 	}
+	//A layer saved earlier is linked, not fetched again
+	fetched := func(x int) bool {
+		return save.Layers[x].Link == "" && layer_parameter(layers[x]).ublob != model.EmptyLayerDigest &&
+			!skip_layer(layers[x])
+	}
+
+	logtool.SugLog.Infof("Writing image archive: %v", out)
+	aw.ModTime = save.Created
+	logtool.Fatalerror(aw.AddFile(save.Config, confbody))
 
 	//Build layer folders
-	var wg sync.WaitGroup
-	wg = sync.WaitGroup{}
-	wg.Add(len(layers))
-
-	var parentid string
-	var last_fake_layerid string
-	logtool.SugLog.Debug("Start concurrent downloads...")
-	for x, layer := range layers {
-		ublob := layer.(map[string]interface{})["digest"].(string)
-		logtool.SugLog.Info(ublob)
-		fake_layerid := aes.Sha256t(makestr.Joinstring(parentid, "\n", ublob, "\n"))
-		layerdir := makestr.Joinstring(imgdir, "/", fake_layerid)
-		os.Mkdir(layerdir, os.ModePerm)
-		//Creating VERSION file
-		vf := filetool.GetfileOjb(makestr.Joinstring(layerdir, "/VERSION"))
-		vf.WriteString("1.0")
-		vf.Close()
-
-		//layer interface{}, layerdir string, ublob string, length string, w *sync.WaitGroup
-
-		go Download_img(download_parameter{
-			layer:    layer,
-			layerdir: layerdir,
-			ublob:    ublob,
-			startbyt: 0,
-			n:        0,
-			w:        &wg,
-		})
-
-		content[0].Layers = append(content[0].Layers, makestr.Joinstring(fake_layerid, "/layer.tar"))
-		//Creating json file
-		f2 := filetool.GetfileOjb(makestr.Joinstring(layerdir, "/json"))
-		//last layer = config manifest - history - rootfs
-		var json_obj map[string]interface{}
-		if layers[len(layers)-1].(map[string]interface{})["digest"].(string) ==
-			layer.(map[string]interface{})["digest"].(string) {
-			json_obj = request.Parsebody_to_json(confresp)
-			delete(json_obj, "history")
-			if _, ok := json_obj["rootfs"]; ok {
-				//存在
-				delete(json_obj, "rootfs")
-			} else if _, ok := json_obj["rootfS"]; ok {
-				delete(json_obj, "rootfS")
+	var sources map[string]model.Descriptor
+	logtool.SugLog.Debug("Start streaming layers...")
+	for x, desc := range layers {
+		if _, ok := spools[x]; !ok && fetched(x) {
+			spools[x] = open_layer(stage, parameter_at(x), true)
+		}
+		for p := x + 1; p < len(layers) && p < x+parallel; p++ {
+			if _, ok := spools[p]; !ok && fetched(p) {
+				spools[p] = open_layer(stage, parameter_at(p), false)
 			}
-		} else {
-			json_obj = model.Empty_config()
 		}
-		json_obj["id"] = fake_layerid
 
-		if parentid != "" {
-			json_obj["parent"] = parentid
+		parameter := parameter_at(x)
+		ublob := parameter.ublob
+		logtool.SugLog.Info(ublob)
+		l := save.Layers[x]
+		if src, ok := layer_source(desc); ok {
+			if sources == nil {
+				sources = map[string]model.Descriptor{}
+			}
+			sources[l.DiffID] = src
 		}
-		parentid = fake_layerid
-		data, _ := json.Marshal(json_obj)
-		f2.Write(data)
-		f2.Close()
 
-		if x+1 == len(layers) {
-			last_fake_layerid = fake_layerid
+		//Creating VERSION and json files
+		logtool.Fatalerror(aw.AddFile(makestr.Joinstring(l.ID, "/VERSION"), []byte(model.VERSION)))
+		logtool.Fatalerror(aw.AddFile(makestr.Joinstring(l.ID, "/json"), l.JSON))
+
+		if skip_layer(desc) {
+			// docker load fetches it from the urls in LayerSources
+			fmt.Fprintf(logtool.Console, "%v: Foreign layer skipped \n", ublob[7:19])
+		} else if l.Link != "" {
+			logtool.SugLog.Debugf("%v: same as %v", ublob[7:19], l.Link)
+			logtool.Fatalerror(aw.Symlink(l.Path(), l.Link))
+		} else if ublob == model.EmptyLayerDigest && parameter.size == len(model.EmptyLayer) {
+			data := model.EmptyLayer
+			if to, ok := recompression(parameter); ok {
+				var b bytes.Buffer
+				_, err = layer.Convert(&b, bytes.NewReader(data), layer.Gzip, to, int64(len(data)))
+				logtool.Fatalerror(err)
+				data = b.Bytes()
+			}
+			logtool.Fatalerror(aw.AddFile(l.Path(), data))
+		} else {
+			// a recompressed layer only has a size once it is converted
+			size := int64(parameter.size)
+			s := spools[x]
+			if s != nil {
+				size, err = s.size()
+				logtool.Fatalerror(err)
+			}
+			lw, err := aw.Create(l.Path(), size)
+			logtool.Fatalerror(err)
+			if s != nil {
+				err = s.emit(lw)
+			} else {
+				err = stream_layer(lw, parameter)
+			}
+			logtool.Fatalerror(err)
 		}
-
+		delete(spools, x)
 	}
-	wg.Wait()
 
-	f3 := filetool.GetfileOjb(makestr.Joinstring(imgdir, "/manifest.json"))
-	data, _ := json.Marshal(content)
-	f3.Write(data)
-	f3.Close()
+	//docker save leaves these two at the epoch
+	aw.ModTime = time.Unix(0, 0)
+	//an image pulled by digest alone is untagged, as docker save leaves it
+	var repotags []string
+	if saved.Tag != "" {
+		repotags = []string{saved.RepoTag()}
+	}
+	data, err := save.Manifest(repotags, []string{makestr.Joinstring(ref.Familiar(), "@", repo_digest)}, sources)
+	logtool.Fatalerror(err)
+	logtool.Fatalerror(aw.AddFile("manifest.json", data))
+	if saved.Tag != "" {
+		data, err = save.Repositories(saved.Familiar(), saved.Tag)
+		logtool.Fatalerror(err)
+		logtool.Fatalerror(aw.AddFile("repositories", data))
+	}
+	logtool.Fatalerror(aw.Close())
+	if blobs != nil && legacy == nil {
+		logtool.Fatalerror(cache_manifests(ref, indexbody, body, confbody, layers))
+	}
 
-	var content1 map[string](map[string]string)
-	if len(imgpartlist[:len(imgpartlist)-1]) != 0 {
+	if out == stdoutPath {
+		fmt.Fprintf(logtool.Console, "打包完成，已写入标准输出\n")
+		return
+	}
+	done, err := af.finish()
+	logtool.Fatalerror(err)
+	fmt.Fprintf(logtool.Console, "打包完成，生成文件 %v\n", done)
+}
 
-		content1 = map[string](map[string]string){
-			makestr.Joinstring(strings.Join(imgpartlist[:len(imgpartlist)-1], "/"), img): map[string]string{tag: last_fake_layerid},
+// cache_manifests keeps the index, manifest and config of the image in the
+// cache next to its layers, and tags it, so gopull serve can serve it.
+func cache_manifests(ref reference.Reference, index []byte, manifest []byte, config []byte, layers []model.Descriptor) error {
+	for _, l := range layers {
+		// the empty layer is written from memory, never fetched
+		if l.Digest == model.EmptyLayerDigest {
+			if err := blobs.Put(model.EmptyLayerDigest, model.EmptyLayer); err != nil {
+				return err
+			}
+			break
 		}
-	} else {
-		content1 = map[string](map[string]string){
-			img: map[string]string{tag: last_fake_layerid},
+	}
+	top := manifest
+	for _, b := range [][]byte{config, manifest, index} {
+		if b == nil {
+			continue
 		}
-
+		if err := blobs.Put(digest.FromBytes(b).String(), b); err != nil {
+			return err
+		}
+		top = b
 	}
-
-	f5 := filetool.GetfileOjb(makestr.Joinstring(imgdir, "/repositories"))
-	data1, _ := json.Marshal(content1)
-	f5.Write(data1)
-	f5.Close()
-
-	//Create image tar and clean tmp folder
-	//docker_tar:= makestr.Joinstring(
-	//strings.ReplaceAll(repo,"/", "_"),
-	//"_",img,".tar")
-	fmt.Print("Creating archive...")
-	os.Stdout.Sync()
-
-	if check_path.Check_path(img + ".tar").Exists() {
-		os.Remove(img + ".tar")
+	if ref.Digest != "" {
+		return nil
 	}
-	tartool.Tar(img+".tar", imgdir)
-	os.RemoveAll(imgdir)
-	fmt.Printf("打包完成，生成文件 %v\n", img+".tar")
+	return blobs.Tag(repository, ref.Tag, digest.FromBytes(top).String())
 }
 
 func check_head(Header http.Header) bool {
@@ -363,113 +548,339 @@ func check_head(Header http.Header) bool {
 	return false
 }
 
-// func Download_img(layer interface{}, layerdir string, ublob string, length string, w *sync.WaitGroup) {
-func Download_img(parameter download_parameter) {
-	if parameter.n == 0 {
-		parameter.tfile = filetool.GetfileOjb(makestr.Joinstring(parameter.layerdir, "/layer.tar.gz"))
-		logtool.SugLog.Infof("%v%v", parameter.ublob[7:19], ": Downloading...")
-	} else if parameter.n < 5 {
-		logtool.SugLog.Infof("%v%v", parameter.ublob[7:19], ": try to download again...")
+// layer_parameter reads the digest and size of a manifest layer.
+func layer_parameter(layer model.Descriptor) download_parameter {
+	return download_parameter{
+		layer: layer,
+		ublob: layer.Digest,
+		size:  int(layer.Size),
 	}
+}
 
-	parameter.n += 1
-	// Creating layer.tar file
-	os.Stdout.Sync()
-	auth_head := get_auth_head("application/vnd.docker.distribution.manifest.v2+json", auth_head)
-	bresp, err := request.Requests(
-		makestr.Joinstring("https://", registry, "/v2/", repository, "/blobs/", parameter.ublob)).
-		Notparse().
-		Setheads(auth_head).
-		Setheads(map[string]string{"Range": "bytes=" + strconv.Itoa(parameter.startbyt) + "-"}).
-		Settls().
-		Get()
+// layer_source describes a layer that is not stored in the registry, for
+// LayerSources of manifest.json.
+func layer_source(layer model.Descriptor) (model.Descriptor, bool) {
+	if len(layer.URLs) == 0 {
+		return model.Descriptor{}, false
+	}
+	return model.Descriptor{
+		MediaType: layer.MediaType,
+		Size:      layer.Size,
+		Digest:    layer.Digest,
+		URLs:      layer.URLs,
+	}, true
+}
 
-	defer func() {
-		if parameter.progress == "" {
+// skip_layer reports whether a layer is left out of the archive with
+// --skip-foreign-layers.
+func skip_layer(layer model.Descriptor) bool {
+	return skipforeign && layer.Foreign() && len(layer.URLs) > 0
+}
+
+// layer_urls lists where a layer can be fetched from. Like docker, a layer
+// with urls is fetched from them in order, and the registry is only the last
+// resort.
+func layer_urls(layer model.Descriptor) []string {
+	urls := append([]string{}, layer.URLs...)
+	return append(urls, registry_url(repository, "/blobs/", layer.Digest))
+}
+
+// recompression returns the compression --recompress converts a layer to,
+// and false when the layer is written as pulled. Layers are always unpacked
+// for none, and those of a generic media type always converted: only their
+// first bytes tell their compression.
+func recompression(parameter download_parameter) (layer.Compression, bool) {
+	if recompress == "" {
+		return layer.Uncompressed, false
+	}
+	to, err := layer.ParseCompression(recompress)
+	if err != nil {
+		return layer.Uncompressed, false
+	}
+	return to, to == layer.Uncompressed || to != layer.ByMediaType(parameter.layer.MediaType)
+}
+
+// open_layer finds a layer in the cache or starts downloading it into dir.
+// The layer next in the archive, head, is streamed instead and gets nil,
+// unless it is recompressed: its size is only known once it is converted.
+func open_layer(dir string, parameter download_parameter, head bool) *spool {
+	to, convert := recompression(parameter)
+	if s := cached_layer(parameter); s != nil {
+		if convert {
+			return convert_layer(dir, parameter, s, to)
+		}
+		return s
+	}
+	if head && !convert {
+		return nil
+	}
+	return prefetch_layer(dir, parameter)
+}
+
+// cached_layer returns the layer from the cache, or nil when it has to be
+// downloaded.
+func cached_layer(parameter download_parameter) *spool {
+	if _, ok := blobs_has(parameter); !ok {
+		return nil
+	}
+	f, err := blobs.Open(parameter.ublob)
+	if err != nil {
+		return nil
+	}
+	fmt.Fprintf(logtool.Console, "%v: Already exists \n", parameter.ublob[7:19])
+	s := &spool{file: f, keep: true, done: make(chan struct{})}
+	close(s.done)
+	return s
+}
+
+// prefetch_layer downloads a layer in the background, into the cache when
+// there is one and into a temporary file in dir otherwise.
+func prefetch_layer(dir string, parameter download_parameter) *spool {
+	s := &spool{done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		if to, ok := recompression(parameter); ok {
+			s.file, s.diffid, s.err = convert_download(dir, parameter, to)
 			return
 		}
-		parameter.tfile.Close()
-		os.Remove(parameter.tfile.Name())
-		if parameter.progress == "done" {
-			fmt.Printf("%v: Extracting...%v", parameter.ublob[7:19], strings.Repeat(" ", 50))
-			os.Stdout.Sync()
+		if blobs != nil {
+			var b *store.Blob
+			b, s.err = blobs.Create(parameter.ublob)
+			if s.err != nil {
+				return
+			}
+			if s.diffid, s.err = Download_img(b, parameter); s.err != nil {
+				b.Abort()
+				return
+			}
+			s.err = b.Commit()
+			b.Close()
+			if s.err == nil {
+				s.file, s.err = blobs.Open(parameter.ublob)
+				s.keep = true
+			}
+			return
+		}
+		s.file, s.err = temp_file(dir, parameter.ublob)
+		if s.err != nil {
+			return
+		}
+		s.diffid, s.err = Download_img(s.file, parameter)
+	}()
+	return s
+}
 
-			fmt.Printf("%v: Pull complete \n",
-				parameter.ublob[7:19])
-			(*parameter.w).Done()
+// convert_download downloads a layer recompressed with to into a temporary
+// file in dir, while the blob as pulled goes to the cache when there is one.
+func convert_download(dir string, parameter download_parameter, to layer.Compression) (*os.File, string, error) {
+	f, err := temp_file(dir, parameter.ublob)
+	if err != nil {
+		return nil, "", err
+	}
+	parameter.out, parameter.to = f, to
+	var b *store.Blob
+	var w io.Writer = io.Discard
+	if blobs != nil {
+		if b, err = blobs.Create(parameter.ublob); err != nil {
+			return f, "", err
 		}
-		if parameter.err != nil {
-			logtool.SugLog.Fatal(parameter.err)
+		w = b
+	}
+	diffid, err := Download_img(w, parameter)
+	if b != nil {
+		if err != nil {
+			b.Abort()
+		} else {
+			err = b.Commit()
+			b.Close()
 		}
+	}
+	return f, diffid, err
+}
+
+// convert_layer recompresses a cached layer with to into a temporary file in
+// dir.
+func convert_layer(dir string, parameter download_parameter, src *spool, to layer.Compression) *spool {
+	s := &spool{done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer src.file.Close()
+		s.file, s.err = temp_file(dir, parameter.ublob)
+		if s.err != nil {
+			return
+		}
+		s.diffid, s.err = layer.Convert(s.file, src.file, layer.ByMediaType(parameter.layer.MediaType), to, int64(parameter.size))
 	}()
+	return s
+}
 
+// stream_layer downloads a layer straight into w, keeping a copy in the
+// cache when there is one.
+func stream_layer(w io.Writer, parameter download_parameter) error {
+	if blobs == nil {
+		_, err := Download_img(w, parameter)
+		return err
+	}
+	b, err := blobs.Create(parameter.ublob)
 	if err != nil {
-		parameter.progress = "err"
-		parameter.err = err
-		return
+		return err
 	}
+	if _, err := Download_img(io.MultiWriter(w, b), parameter); err != nil {
+		b.Abort()
+		return err
+	}
+	defer b.Close()
+	return b.Commit()
+}
 
-	if bresp.StatusCode() != 206 && bresp.StatusCode() != 200 {
-		logtool.SugLog.Warn(parameter.layer.(map[string]interface{}))
-		urls, ok := parameter.layer.(map[string]interface{})["urls"]
-		if ok {
-			bresp, _ := request.Requests(urls.([]string)[0]).
-				Setheads(auth_head).
-				Settls().
-				Get()
-			if bresp.StatusCode() != 206 && bresp.StatusCode() != 200 {
-				fmt.Printf("\rERROR: Cannot download layer %v [HTTP %v %v]", parameter.ublob[7:19], bresp.StatusCode(), bresp.Header()["Content-Length"])
-				logtool.SugLog.Fatal(bresp)
-			}
-		} else {
-			logtool.SugLog.Fatalf("no url to download layer %v", parameter.ublob[7:19])
+// size waits for the prefetch and returns the size of the layer.
+func (s *spool) size() (int64, error) {
+	<-s.done
+	if s.err != nil {
+		return 0, s.err
+	}
+	fi, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+// emit waits for the prefetch, copies the layer to w and removes the
+// temporary file.
+func (s *spool) emit(w io.Writer) error {
+	<-s.done
+	if s.file != nil {
+		if !s.keep {
+			defer remove_temp(s.file.Name())
 		}
+		defer s.file.Close()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
 	}
+	_, err := io.Copy(w, s.file)
+	return err
+}
 
-	//Stream download and follow the progress
-	totalLength, _ := strconv.Atoi(bresp.Header().Get("Content-Length"))
-	buf := make([]byte, 65536)
-
-	teeReader := io.TeeReader(bresp.RawBody(),
-		&progress.Progress{
-			Ublob:             parameter.ublob[7:19],
-			Total:             totalLength,
-			ProgressBarLength: 50,
-		},
-	)
+// blob_auth_head returns the token header for blob requests, renewing it
+// when it is about to expire. Layers are fetched concurrently, so the shared
+// header is only touched under authMu and callers get their own copy.
+func blob_auth_head() map[string]string {
+	authMu.Lock()
+	defer authMu.Unlock()
+	auth_head = get_auth_head("application/vnd.docker.distribution.manifest.v2+json", auth_head)
+	head := make(map[string]string, len(auth_head))
+	for k, v := range auth_head {
+		head[k] = v
+	}
+	return head
+}
+
+// Download_img streams a layer blob to w and returns its diff_id. A broken
+// connection is resumed with a Range request from the last byte written, up
+// to 5 times. The blob is decompressed as it arrives to check its digest and
+// diff_id, so nothing is read again once it is downloaded.
+func Download_img(w io.Writer, parameter download_parameter) (string, error) {
+	logtool.SugLog.Infof("%v%v", parameter.ublob[7:19], ": Downloading...")
+	bar := &progress.Progress{
+		Ublob:             parameter.ublob[7:19],
+		Total:             parameter.size,
+		ProgressBarLength: 50,
+	}
+	tee, err := layer.NewConvertTee(w, parameter.ublob, layer.ByMediaType(parameter.layer.MediaType), int64(parameter.size),
+		parameter.out, parameter.to)
 	if err != nil {
-		logtool.SugLog.Fatal(err)
+		return "", err
 	}
 	for {
-		n, err := teeReader.Read(buf)
-
-		parameter.startbyt = parameter.startbyt + n
-		parameter.tfile.Write(buf[:n])
-		if err != nil {
-			if err == io.EOF {
-				fmt.Println("")
-				parameter.progress = "done"
-				fmt.Printf("%v: wait write to file...%v\n", parameter.ublob[7:19], strings.Repeat(" ", 50))
-				_, err = parameter.tfile.Seek(0, 0)
-				logtool.Fatalerror(err)
-				tarFile := filetool.GetfileOjb(makestr.Joinstring(parameter.layerdir, "/layer.tar"))
-				greader, err := gzip.NewReader(parameter.tfile)
-				defer greader.Close()
-				_, err = io.Copy(tarFile, greader)
-				logtool.Fatalerror(err)
-			} else {
-				logtool.SugLog.Warn(err, " ioerr")
-
-				if parameter.n < 5 {
-					Download_img(parameter)
-				} else {
-					parameter.progress = "err"
-					parameter.err = errors.New("ioerr: reconnecting more than 5 times")
-				}
+		parameter.n += 1
+		err := fetch_layer(io.MultiWriter(tee, bar), &parameter)
+		if err == nil {
+			break
+		}
+		if shutdown.Context.Err() != nil {
+			tee.Close()
+			return "", err
+		}
+		logtool.SugLog.Warn(err, " ioerr")
+		if parameter.n >= 5 {
+			tee.Close()
+			if errdefs.KindOf(err) == errdefs.Unknown {
+				err = errdefs.New(errdefs.Network, err)
 			}
+			return "", fmt.Errorf("layer %v: giving up after %v attempts: %w", parameter.ublob[7:19], parameter.n, err)
+		}
+		logtool.SugLog.Infof("%v%v", parameter.ublob[7:19], ": try to download again...")
+	}
+	if err := tee.Close(); err != nil {
+		return "", fmt.Errorf("layer %v: %w", parameter.ublob[7:19], err)
+	}
+	if parameter.diffid != "" && tee.DiffID() != parameter.diffid {
+		return "", errdefs.Errorf(errdefs.DigestMismatch, "layer %v: diff_id %v does not match the image config %v",
+			parameter.ublob[7:19], tee.DiffID(), parameter.diffid)
+	}
+	fmt.Fprintf(logtool.Console, "%v: Pull complete \n", parameter.ublob[7:19])
+	return tee.DiffID(), nil
+}
+
+// fetch_layer requests the rest of a blob from parameter.startbyt and copies
+// it to w, advancing startbyt by what was written. The urls of the layer are
+// tried in order; the registry token is only sent to the registry, never to
+// the hosts of foreign layers.
+func fetch_layer(w io.Writer, parameter *download_parameter) error {
+	rangehead := map[string]string{"Range": "bytes=" + strconv.Itoa(parameter.startbyt) + "-"}
+	urls := layer_urls(parameter.layer)
+	var bresp *resty.Response
+	var lasterr error
+	for i, u := range urls {
+		req := request.Requests(u).
+			Notparse().
+			Setheads(rangehead).
+			Settls()
+		if i == len(urls)-1 {
+			req.Setheads(blob_auth_head())
+		}
+		r, err := req.Get()
+		if err == nil && (r.StatusCode() == 206 || r.StatusCode() == 200) {
+			bresp = r
 			break
 		}
+		if r != nil && r.RawBody() != nil {
+			r.RawBody().Close()
+		}
+		if err == nil {
+			err = errdefs.Errorf(errdefs.HTTPStatus(r.StatusCode()), "HTTP %v", r.Status())
+		}
+		logtool.SugLog.Warnf("%v: %v: %v", parameter.ublob[7:19], u, err)
+		lasterr = err
 	}
+	if bresp == nil {
+		return fmt.Errorf("cannot download layer %v from %v source(s): %w", parameter.ublob[7:19], len(urls), lasterr)
+	}
+	body := bresp.RawBody()
+	defer body.Close()
+
+	// a server ignoring Range sends the blob from the start again
+	if bresp.StatusCode() == 200 && parameter.startbyt > 0 {
+		if _, err := io.CopyN(io.Discard, body, int64(parameter.startbyt)); err != nil {
+			return err
+		}
+	}
+
+	//Stream download and follow the progress
+	n, err := io.Copy(w, body)
+	parameter.startbyt += int(n)
+	if err != nil {
+		return err
+	}
+	if parameter.startbyt != parameter.size {
+		return errdefs.Errorf(errdefs.Network, "layer %v: got %v of %v bytes", parameter.ublob[7:19], parameter.startbyt, parameter.size)
+	}
+	return nil
 }
 
 // Get Docker token (this function is useless for unauthenticated registries like Microsoft)
@@ -484,20 +895,38 @@ func get_auth_head(qtype string, a ...any) map[string]string {
 		}
 
 	}
-	resp, err := request.Requests(
+	login := basic_auth()
+	if basicauth {
+		if login == "" {
+			logtool.Fatalerror(errdefs.Errorf(errdefs.Unauthorized,
+				"%v asks for a login, set username and password for it in the config", registry))
+		}
+		return map[string]string{"Authorization": login, "Accept": qtype,
+			"expires_in": time.Now().UTC().AddDate(1, 0, 0).Format("2006-01-02 15:04:05")}
+	}
+	if auth_url == "" {
+		return map[string]string{"Accept": qtype,
+			"expires_in": time.Now().UTC().AddDate(1, 0, 0).Format("2006-01-02 15:04:05")}
+	}
+	req := request.Requests(
 		makestr.Joinstring(auth_url, "?service=", reg_service, "&scope=repository:", repository, ":pull")).
-		Settls().
-		Get()
+		Settls()
+	if login != "" {
+		req.Setheads(map[string]string{"Authorization": login})
+	}
+	resp, err := req.Get()
+	if err == nil && resp.StatusCode() != 200 {
+		err = errdefs.Errorf(errdefs.HTTPStatus(resp.StatusCode()), "HTTP %v", resp.Status())
+	}
+	if err != nil {
+		logtool.Fatalerror(fmt.Errorf("cannot get a token for %v: %w", repository, err))
+	}
+	token, err := model.ParseToken(resp.Body(), time.Now())
 	logtool.Fatalerror(err)
-	resp_json := request.Parsebody_to_json(resp)
-	expires_in := int(resp_json["expires_in"].(float64))
-	issued_at := resp_json["issued_at"].(string)
 
-	expires_time := timetool.Strtorime(issued_at, "UTC").
-		Add(time.Duration(expires_in) * (time.Hour)).
-		Format("2006-01-02 15:04:05")
+	expires_time := token.Expires().UTC().Format("2006-01-02 15:04:05")
 
-	auth_head := map[string]string{"Authorization": makestr.Joinstring("Bearer ", resp_json["token"].(string)),
+	auth_head := map[string]string{"Authorization": makestr.Joinstring("Bearer ", token.Token),
 		"Accept":     qtype,
 		"expires_in": expires_time,
 	}
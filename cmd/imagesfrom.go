@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/reference"
+	"go_pull/pkgs/scan"
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/shutdown"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var downloadlist bool
+
+var imagesFromCmd = &cobra.Command{
+	Use:   "images-from FILE|DIR|- ... [-- DOWNLOAD FLAGS]",
+	Short: "list the images used by Kubernetes manifests, helm template output, compose files and Dockerfiles",
+	Long: `images-from prints the images the files use, once each: the containers,
+init containers and ephemeral containers of Kubernetes objects, the services
+of compose files and the FROM and COPY --from images of Dockerfiles. A
+directory is searched for *.yaml, *.yml and Dockerfiles, - reads yaml from
+stdin, such as the output of helm template. --download downloads them, with
+the download flags given after --.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		files, extra := args, []string(nil)
+		if n := cmd.ArgsLenAtDash(); n >= 0 {
+			files, extra = args[:n], args[n:]
+		}
+		if len(files) == 0 {
+			logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "no file to read images from"))
+		}
+		if len(extra) > 0 && !downloadlist {
+			logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "the flags after -- are for --download"))
+		}
+		refs := images_from(files)
+		if !downloadlist {
+			for _, r := range refs {
+				fmt.Println(r)
+			}
+			return
+		}
+		download_list(refs, extra)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(imagesFromCmd)
+	imagesFromCmd.Flags().BoolVar(&downloadlist, "download", false,
+		"download the images as download -f does, instead of printing them")
+}
+
+// images_from returns the images of files, normalized, in the order they are
+// found. References that do not parse, such as templates left unrendered,
+// are reported and skipped.
+func images_from(files []string) []string {
+	var refs []string
+	seen := map[string]bool{}
+	for _, name := range scan_files(files) {
+		var data []byte
+		if name == stdinPath {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(name)
+		}
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		found, err := scan.File(name, data)
+		if err != nil {
+			logtool.SugLog.Warnf("skipping %v", err)
+			continue
+		}
+		for _, s := range found {
+			ref, err := reference.Parse(s)
+			if err != nil {
+				logtool.SugLog.Warnf("%v: %v", name, err)
+				continue
+			}
+			if seen[ref.String()] {
+				continue
+			}
+			seen[ref.String()] = true
+			r := ref.Familiar()
+			if ref.Tag != "" {
+				r += ":" + ref.Tag
+			}
+			if ref.Digest != "" {
+				r += "@" + ref.Digest
+			}
+			refs = append(refs, r)
+		}
+	}
+	if len(refs) == 0 {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.NotFound, "no images found in %v", strings.Join(files, " ")))
+	}
+	return refs
+}
+
+// scan_files lists the files to read: the files given, and those of the
+// directories given that may hold images.
+func scan_files(args []string) []string {
+	var files []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if arg == stdinPath || err == nil && !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path != arg && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			switch filepath.Ext(path) {
+			case ".yaml", ".yml":
+				files = append(files, path)
+			default:
+				if scan.Dockerfile(path) {
+					files = append(files, path)
+				}
+			}
+			return nil
+		})
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	}
+	return files
+}
+
+// download_list runs download -f - on refs, with the download flags extra.
+// It exits as the download does.
+func download_list(refs []string, extra []string) {
+	exe, err := os.Executable()
+	logtool.Fatalerror(err)
+	c := gopull_command(exe, append([]string{"download", "--file", stdinPath}, extra...))
+	c.Stdin = strings.NewReader(strings.Join(refs, "\n") + "\n")
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	exited := make(chan struct{})
+	done := shutdown.Undo("stop download", func() error {
+		<-exited
+		return nil
+	})
+	err = c.Run()
+	close(exited)
+	done()
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		shutdown.Exit(exit.ExitCode())
+	}
+	logtool.Fatalerror(err)
+}
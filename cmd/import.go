@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"fmt"
+	"go_pull/pkgs/archive"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/reference"
+	"go_pull/pkgs/store"
+	"go_pull/pkgs/util/logtool"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var importtag string
+
+var importCmd = &cobra.Command{
+	Use:   "import ARCHIVE|DIR... [--root STORE]",
+	Short: "load docker save archives and OCI layouts into the blob store, for gopull serve",
+	Long: `import reads archives, gopull's or from docker save, and OCI layouts, tars
+or directories as skopeo oci: and buildah push oci: write them, into the blob
+store gopull serve serves, checking them as verify-archive does. OCI layouts
+keep their manifests. Images of docker save get a manifest made from
+their config and layers as docker push lays it out, so their config and
+layers keep their digests. The manifest keeps the digest it had in the
+registry where the archive kept the original blobs, as gopull does: docker
+save writes the layers uncompressed. Images are tagged with the names of the
+archive, --tag names those without one.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		startimport(args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(importCmd)
+	importCmd.Flags().StringVar(&storedir, "root", "", "blob store to import into (default: cache of the config)")
+	importCmd.Flags().StringVar(&importtag, "tag", "", "name for the images the archive has no name for, REPOSITORY[:TAG]")
+}
+
+// import_ref is the reference image is tagged with: its name, its bare tag
+// in the repository of --tag, or --tag itself.
+func import_ref(image archive.Image) (reference.Reference, bool) {
+	name := image.Name
+	if name == "" && importtag != "" {
+		name = importtag
+		if image.Tag != "" {
+			fallback, err := reference.Parse(importtag)
+			logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+			name = fallback.Registry + "/" + fallback.Repository + ":" + image.Tag
+		}
+	}
+	if name == "" {
+		return reference.Reference{}, false
+	}
+	ref, err := reference.Parse(name)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	// a name pinned by digest alone has no tag to put the image under
+	return ref, ref.Tag != ""
+}
+
+func startimport(files []string) {
+	if importtag != "" {
+		ref, err := reference.Parse(importtag)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		if ref.Digest != "" {
+			logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "--tag %v: images are tagged with a tag, not a digest", importtag))
+		}
+	}
+	if storedir == "" {
+		storedir = conf.Cache
+	}
+	if storedir == "" {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "no store, set --root or cache in the config"))
+	}
+	s, err := store.Open(storedir)
+	logtool.Fatalerror(err)
+	for _, file := range files {
+		images, err := import_file(file, s)
+		if err != nil {
+			logtool.Fatalerror(fmt.Errorf("%v: %w", file, err))
+		}
+		for _, image := range images {
+			how := "kept"
+			if image.Converted {
+				how = "converted"
+			}
+			ref, ok := import_ref(image)
+			if !ok {
+				fmt.Fprintf(logtool.Console, "%v: %v, %v, untagged, set --tag to name it\n", file, image.Digest, how)
+				continue
+			}
+			logtool.Fatalerror(s.Tag(ref.Repository, ref.Tag, image.Digest))
+			fmt.Fprintf(logtool.Console, "%v: %v/%v:%v %v, %v\n", file, ref.Registry, ref.Repository, ref.Tag, image.Digest, how)
+		}
+	}
+}
+
+// import_file imports the archive file, or the OCI layout it is the
+// directory of.
+func import_file(file string, s *store.Store) ([]archive.Image, error) {
+	info, err := os.Stat(file)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	if info.IsDir() {
+		return archive.ImportDir(file, s)
+	}
+	f, err := os.Open(file)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	defer f.Close()
+	return archive.Import(f, s)
+}
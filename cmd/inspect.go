@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go_pull/pkgs/model"
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/request"
+	"go_pull/pkgs/vmconfig"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// manifest media types inspect and download accept, so lists and single
+// manifests in both the Docker and OCI flavours come as the registry stores
+// them.
+var manifestAccept = strings.Join([]string{
+	model.MediaTypeManifestList,
+	model.MediaTypeManifest,
+	model.MediaTypeOCIIndex,
+	model.MediaTypeOCIManifest,
+	model.MediaTypeSchema1Signed,
+	model.MediaTypeSchema1,
+}, ", ")
+
+func init() {
+	rootCmd.AddCommand(inspectCmd)
+	inspectCmd.PersistentFlags().IntVarP(&vmconfig.Ptimeout, "timeout", "t", 3, "timeout/s of the request")
+	inspectCmd.PersistentFlags().IntVar(&vmconfig.Piotimeout, "iotimeout", 20, "seconds without any data before a request fails")
+	inspectCmd.PersistentFlags().IntVarP(&vmconfig.Retry, "retry", "r", 5, "Connection failure is the maximum number of retries")
+	inspectCmd.PersistentFlags().StringVarP(&vmconfig.Loglevel, "level", "l", "info", "log level: debug、info、warn、error")
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect [image]",
+	Short: "show the manifest of an image and the registry rate limit",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logtool.Setloglevel(vmconfig.Loglevel)
+		startinspect(args[0])
+	},
+}
+
+func startinspect(arg string) {
+	ref := parse_image(arg)
+	get_auth_url()
+
+	auth_head = get_auth_head(manifestAccept)
+	resp, err := request.Requests(
+		registry_url(repository, "/manifests/", ref.Ref())).
+		Setheads(auth_head).
+		Settls().
+		Get()
+	if err != nil {
+		logtool.Fatalerror(fmt.Errorf("cannot fetch manifest %v of %v: %w", ref.Ref(), repository, err))
+	}
+
+	fmt.Printf("Name:       %v/%v\n", registry, repository)
+	fmt.Printf("Reference:  %v\n", ref.Ref())
+	fmt.Printf("Digest:     %v\n", resp.Header().Get("Docker-Content-Digest"))
+	fmt.Printf("MediaType:  %v\n", resp.Header().Get("Content-Type"))
+	if r, ok := request.Ratelimits(registry); ok {
+		fmt.Printf("RateLimit:  %v\n", r)
+	} else {
+		fmt.Printf("RateLimit:  not reported\n")
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, resp.Body(), "", "  "); err != nil {
+		out.Reset()
+		out.Write(resp.Body())
+	}
+	fmt.Println(out.String())
+}
@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/util/check_path"
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/shutdown"
+	"go_pull/pkgs/volume"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/client"
+	"github.com/spf13/cobra"
+)
+
+var (
+	checkonly bool
+	load      bool
+)
+
+var joinCmd = &cobra.Command{
+	Use:   "join INDEX [-o ARCHIVE | --load]",
+	Short: "check the volumes download --split wrote and join them into the archive",
+	Long: `join reads the index of the volumes of an archive, ARCHIVE.sha256 next to
+them, checks every volume and reports those missing or corrupt, then joins
+them into the archive, to --output, - for stdout, or straight into docker load
+with --load. The archive is checked against its digest while it is joined.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if (output != "" && load) || (checkonly && (output != "" || load)) {
+			logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "--output, --load and --check exclude each other"))
+		}
+		if output == stdoutPath {
+			logtool.UseStderr()
+		}
+		startjoin(args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(joinCmd)
+	joinCmd.Flags().StringVarP(&output, "output", "o", "", "archive to write, - for stdout (default: next to the volumes)")
+	joinCmd.Flags().BoolVar(&load, "load", false, "give the archive to docker load instead of writing it")
+	joinCmd.Flags().BoolVar(&checkonly, "check", false, "only check the volumes")
+	joinCmd.Flags().BoolVar(&force, "force", false, "overwrite an existing archive")
+}
+
+func startjoin(index string) {
+	f, err := os.Open(index)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	idx, err := volume.ReadIndex(f)
+	f.Close()
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	dir := filepath.Dir(index)
+
+	problems := volume.Check(dir, idx)
+	for _, p := range problems {
+		fmt.Fprintf(logtool.Console, "%v: %v\n", p.Name, p.Err)
+	}
+	if len(problems) > 0 {
+		kind := errdefs.KindOf(problems[0].Err)
+		for _, p := range problems {
+			if errdefs.KindOf(p.Err) != kind {
+				kind = errdefs.DigestMismatch
+			}
+		}
+		logtool.Fatalerror(errdefs.Errorf(kind, "%v of %v volumes of %v missing or corrupt",
+			len(problems), len(idx.Parts), idx.Name))
+	}
+	fmt.Fprintf(logtool.Console, "%v volumes of %v checked\n", len(idx.Parts), idx.Name)
+	switch {
+	case checkonly:
+	case load:
+		load_volumes(dir, idx)
+	case output == stdoutPath:
+		logtool.Fatalerror(volume.Join(os.Stdout, dir, idx))
+	default:
+		out := output
+		if out == "" || check_path.Check_path(out).Adir() {
+			out = filepath.Join(dir, idx.Name)
+			if output != "" {
+				out = filepath.Join(output, idx.Name)
+			}
+		}
+		if check_path.Check_path(out).Exists() && !force {
+			logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "%v already exists, use --force to overwrite it", out))
+		}
+		af, err := create_archive(out)
+		logtool.Fatalerror(err)
+		logtool.Fatalerror(volume.Join(af, dir, idx))
+		done, err := af.finish()
+		logtool.Fatalerror(err)
+		fmt.Fprintf(logtool.Console, "合并完成，生成文件 %v\n", done)
+	}
+}
+
+// load_volumes streams the joined archive into docker load. A volume that
+// changed since it was checked stops the stream, docker load then fails.
+func load_volumes(dir string, idx *volume.Index) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	logtool.Fatalerror(err)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(volume.Join(pw, dir, idx))
+	}()
+	resp, err := cli.ImageLoad(shutdown.Context, pr, true)
+	if err != nil {
+		pr.CloseWithError(err)
+		logtool.Fatalerror(fmt.Errorf("docker load: %w", err))
+	}
+	defer resp.Body.Close()
+	d := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Stream string `json:"stream"`
+			Error  string `json:"error"`
+		}
+		if err := d.Decode(&msg); err == io.EOF {
+			break
+		} else if err != nil {
+			logtool.Fatalerror(fmt.Errorf("docker load: %w", err))
+		}
+		if msg.Error != "" {
+			logtool.Fatalerror(fmt.Errorf("docker load: %v", msg.Error))
+		}
+		fmt.Fprint(logtool.Console, msg.Stream)
+	}
+}
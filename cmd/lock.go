@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"go_pull/pkgs/batch"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/reference"
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/makestr"
+	"go_pull/pkgs/util/shutdown"
+	"go_pull/pkgs/vmconfig"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/spf13/cobra"
+)
+
+var lockout string
+
+var lockCmd = &cobra.Command{
+	Use:   "lock FILE",
+	Short: "pin the images of a list to the digests their tags resolve to now",
+	Long: `lock resolves every image of a list, as download -f reads it, to the
+digest of its manifest for each platform and writes them to a lockfile, FILE
+with the extension .lock. download -f FILE --locked then downloads exactly
+these images, however the tags moved since.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logtool.Setloglevel(vmconfig.Loglevel)
+		startlock(cmd, args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lockCmd)
+	lockCmd.Flags().StringVarP(&lockout, "output", "o", "", "lockfile to write (default: FILE with the extension .lock)")
+	lockCmd.Flags().StringVarP(&platform, "platform", "p", "amd64", "platform of the images that set none")
+	lockCmd.Flags().IntVar(&jobs, "jobs", 4, "images resolved at once")
+	lockCmd.Flags().IntVarP(&vmconfig.Ptimeout, "timeout", "t", 3, "timeout/s of the request")
+	lockCmd.Flags().IntVar(&vmconfig.Piotimeout, "iotimeout", 20, "seconds without any data before a request fails")
+	lockCmd.Flags().IntVarP(&vmconfig.Retry, "retry", "r", 5, "Connection failure is the maximum number of retries")
+	lockCmd.Flags().StringVarP(&vmconfig.Loglevel, "level", "l", "info", "log level: debug、info、warn、error")
+}
+
+// startlock resolves the images of file and writes their lockfile. Nothing
+// is written unless every image resolved.
+func startlock(cmd *cobra.Command, file string) {
+	if file == stdinPath && lockout == "" {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "a list read from stdin needs -o"))
+	}
+	out := lockout
+	if out == "" {
+		out = batch.LockPath(file)
+	}
+	list_jobs := read_list(file).Jobs()
+	forward := forward_flags(cmd)
+	results := run_jobs(list_jobs, func(i int, job batch.Job) []string {
+		// the platform of the entry comes last, it wins over a forwarded one
+		args := append([]string{"download", job.Image, "--resolve"}, forward...)
+		return append(args, "--platform="+job_platform(job))
+	})
+
+	lock := &batch.Lock{}
+	for i, r := range results {
+		if r.code != 0 {
+			continue
+		}
+		dgst := digest.Digest(strings.TrimSpace(string(r.out)))
+		if err := dgst.Validate(); err != nil {
+			results[i].code = shutdown.ExitError
+			results[i].err = fmt.Sprintf("unexpected digest %q: %v", r.out, err)
+			continue
+		}
+		ref, err := reference.Parse(r.job.Image)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		ref.Digest = dgst.String()
+		lock.Images = append(lock.Images, batch.Locked{
+			Image:    r.job.Image,
+			Platform: job_platform(r.job),
+			Ref:      ref.String(),
+			Digest:   ref.Digest,
+		})
+	}
+	failed := summary(results, "resolved")
+	batch_failed(failed, len(results))
+
+	data, err := lock.Encode(fmt.Sprintf("written by gopull lock %v on %v\ndownload -f %v --locked pulls these digests",
+		file, time.Now().UTC().Format(time.RFC3339), file))
+	logtool.Fatalerror(err)
+	write_file(out, data)
+	fmt.Fprintf(logtool.Console, "locked %v images in %v\n", len(lock.Images), out)
+}
+
+// write_file replaces path with data, never leaving it half written.
+func write_file(path string, data []byte) {
+	tf, err := os.CreateTemp(filepath.Dir(path), makestr.Joinstring(".", filepath.Base(path), ".*.partial"))
+	logtool.Fatalerror(err)
+	shutdown.Remove(tf.Name())
+	_, err = bytes.NewReader(data).WriteTo(tf)
+	logtool.Fatalerror(err)
+	logtool.Fatalerror(tf.Close())
+	logtool.Fatalerror(os.Chmod(tf.Name(), 0644))
+	logtool.Fatalerror(os.Rename(tf.Name(), path))
+	shutdown.Forget(tf.Name())
+}
@@ -0,0 +1,257 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"go_pull/pkgs/archive"
+	"go_pull/pkgs/batch"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/model"
+	"go_pull/pkgs/reference"
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/request"
+	"go_pull/pkgs/vmconfig"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	checkref    bool
+	checkconfig string
+	checkdigest string
+)
+
+// outdated_report is what a tag resolves to now, written by outdated
+// --check for the outdated run that started it. Manifest is only set when
+// the tag moved from the recorded digest, Created and DiffIDs when the
+// config is not the one of the archive.
+type outdated_report struct {
+	Digest   string     `json:"digest"`
+	Manifest string     `json:"manifest,omitempty"`
+	Config   string     `json:"config"`
+	Created  *time.Time `json:"created,omitempty"`
+	DiffIDs  []string   `json:"diff_ids,omitempty"`
+}
+
+// archived is an image of the archive, for a tag.
+type archived struct {
+	digest  string // the tag pointed to when pulled, "" when not recorded
+	config  string
+	created *time.Time
+	diffids []string
+}
+
+var outdatedCmd = &cobra.Command{
+	Use:   "outdated ARCHIVE",
+	Short: "tell which images of a docker save archive have moved in their registry",
+	Long: `outdated resolves every tag of the images of an archive in its registry
+and compares what it points to now with the image config of the archive.
+Tags are resolved with a HEAD request; the manifests and image config are
+only fetched when the tag moved away from the digest the archive recorded,
+or when the archive recorded none, as docker save archives do. No layer is
+downloaded. Images that moved are reported with their new
+creation date and how many layers they kept, added and removed.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		logtool.Setloglevel(vmconfig.Loglevel)
+		if checkref {
+			logtool.UseStderr()
+			check_tag(args[0])
+			return
+		}
+		startoutdated(cmd, args[0])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(outdatedCmd)
+	outdatedCmd.Flags().IntVar(&jobs, "jobs", 4, "tags resolved at once")
+	outdatedCmd.Flags().IntVarP(&vmconfig.Ptimeout, "timeout", "t", 3, "timeout/s of the request")
+	outdatedCmd.Flags().IntVar(&vmconfig.Piotimeout, "iotimeout", 20, "seconds without any data before a request fails")
+	outdatedCmd.Flags().IntVarP(&vmconfig.Retry, "retry", "r", 5, "Connection failure is the maximum number of retries")
+	outdatedCmd.Flags().StringVarP(&vmconfig.Loglevel, "level", "l", "info", "log level: debug、info、warn、error")
+	outdatedCmd.Flags().BoolVar(&checkref, "check", false, "resolve the image given instead of reading an archive")
+	outdatedCmd.Flags().StringVar(&checkconfig, "config", "", "config digest of the archived image, for --check")
+	outdatedCmd.Flags().StringVar(&checkdigest, "digest", "", "digest the tag of the archived image pointed to, for --check")
+	outdatedCmd.Flags().StringVarP(&platform, "platform", "p", "amd64", "platform to resolve, for --check")
+	for _, name := range []string{"check", "config", "digest", "platform"} {
+		outdatedCmd.Flags().MarkHidden(name)
+	}
+}
+
+// startoutdated resolves the tags of the archive, each by an outdated --check
+// of its own, and reports the images that moved.
+func startoutdated(cmd *cobra.Command, file string) {
+	f, err := os.Open(file)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	meta, err := archive.ReadMeta(f)
+	f.Close()
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+
+	var list []batch.Job
+	var images []archived
+	for _, item := range meta.Manifest {
+		c, dgst, err := meta.Config(item)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		if len(item.RepoTags) == 0 {
+			fmt.Fprintf(logtool.Console, "untagged image %v skipped\n", short_digest(dgst))
+		}
+		p := c.OS + "/" + c.Architecture
+		if c.Variant != "" {
+			p += "/" + c.Variant
+		}
+		for _, tag := range item.RepoTags {
+			list = append(list, batch.Job{Entry: batch.Entry{Image: tag}, Platform: p})
+			images = append(images, archived{digest: repo_digest(item, tag), config: dgst, created: c.Created, diffids: c.RootFS.DiffIDs})
+		}
+	}
+	if len(list) == 0 {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.NotFound, "%v has no tagged image", file))
+	}
+	forward := forward_flags(cmd)
+	results := run_jobs(list, func(i int, job batch.Job) []string {
+		return append([]string{"outdated", "--check", job.Image, "--platform=" + job.Platform,
+			"--config=" + images[i].config, "--digest=" + images[i].digest}, forward...)
+	})
+
+	fmt.Fprintln(logtool.Console)
+	moved := 0
+	for i, r := range results {
+		if r.code != 0 {
+			continue
+		}
+		var now outdated_report
+		if err := json.Unmarshal(r.out, &now); err != nil {
+			results[i].code = errdefs.Unknown.ExitCode()
+			results[i].err = fmt.Sprintf("unexpected report %q", r.out)
+			continue
+		}
+		if now.Config == images[i].config {
+			fmt.Fprintf(logtool.Console, "%v: up to date\n", r.job)
+			continue
+		}
+		moved++
+		fmt.Fprintf(logtool.Console, "%v: outdated, config %v -> %v, tag now %v\n", r.job,
+			short_digest(images[i].config), short_digest(now.Config), now.Digest)
+		fmt.Fprintf(logtool.Console, "    created %v -> %v, layers: %v\n",
+			format_created(images[i].created), format_created(now.Created), layer_changes(images[i].diffids, now.DiffIDs))
+	}
+	fmt.Fprintf(logtool.Console, "%v of %v tags outdated\n", moved, len(results))
+	batch_failed(summary(results, "checked"), len(results))
+}
+
+// check_tag resolves the image arg for --platform and prints the report of
+// it as json.
+func check_tag(arg string) {
+	ref := parse_image(arg)
+	get_auth_url()
+	auth_head = get_auth_head(manifestAccept)
+	// the tag is resolved with a HEAD, which registries do not count
+	// against the pull rate limit; the manifests are only fetched, by
+	// digest, when it is not the one the archive recorded
+	resp, err := request.Requests(registry_url(repository, "/manifests/", ref.Ref())).
+		Setheads(auth_head).
+		Settls().
+		Head()
+	if err != nil {
+		logtool.Fatalerror(fmt.Errorf("cannot resolve %v: %w", ref.Ref(), err))
+	}
+	if resp.StatusCode() != 200 {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.HTTPStatus(resp.StatusCode()),
+			"cannot resolve %v of %v: HTTP %v", ref.Ref(), repository, resp.Status()))
+	}
+	report := outdated_report{Digest: resp.Header().Get("Docker-Content-Digest")}
+	if report.Digest == "" {
+		report.Digest = ref.Ref()
+	}
+	if report.Digest == checkdigest {
+		report.Config = checkconfig
+		print_report(report)
+		return
+	}
+	resp, kind := get_manifest(report.Digest)
+	report.Manifest = report.Digest
+	if kind == model.MediaTypeManifestList {
+		index, err := model.ParseIndex(resp.Body())
+		logtool.Fatalerror(err)
+		report.Manifest = select_platform(index)
+		resp, kind = get_manifest(report.Manifest)
+	}
+	if kind != model.MediaTypeManifest {
+		logtool.Fatalerror(fmt.Errorf("%v is a %v, it has no image config to compare", report.Manifest, kind))
+	}
+	manifest, err := model.ParseManifest(resp.Body())
+	logtool.Fatalerror(err)
+	report.Config = manifest.Config.Digest
+	if report.Config != checkconfig {
+		confresp, err := request.Requests(registry_url(repository, "/blobs/", report.Config)).
+			Setheads(auth_head).
+			Settls().
+			Get()
+		if err != nil {
+			logtool.Fatalerror(fmt.Errorf("cannot fetch the image config: %w", err))
+		}
+		logtool.Fatalerror(check_digest("image config", report.Config, confresp.Body()))
+		c, err := model.ParseImageConfig(confresp.Body())
+		logtool.Fatalerror(err)
+		report.Created, report.DiffIDs = c.Created, c.RootFS.DiffIDs
+	}
+	print_report(report)
+}
+
+func print_report(report outdated_report) {
+	data, err := json.Marshal(report)
+	logtool.Fatalerror(err)
+	fmt.Println(string(data))
+}
+
+// repo_digest returns the digest RepoDigests of item records for the name of
+// tag, "" when there is none: docker save records no digest, and an image
+// saved under another name was pulled as that other name.
+func repo_digest(item model.ManifestItem, tag string) string {
+	ref, err := reference.Parse(tag)
+	if err != nil {
+		return ""
+	}
+	for _, rd := range item.RepoDigests {
+		if name, dgst, ok := strings.Cut(rd, "@"); ok && name == ref.Familiar() {
+			return dgst
+		}
+	}
+	return ""
+}
+
+// layer_changes counts the layers of the new image that the old one has,
+// and those added and removed.
+func layer_changes(old []string, now []string) string {
+	had := map[string]bool{}
+	for _, id := range old {
+		had[id] = true
+	}
+	kept := 0
+	for _, id := range now {
+		if had[id] {
+			kept++
+			delete(had, id)
+		}
+	}
+	return fmt.Sprintf("%v kept, %v added, %v removed", kept, len(now)-kept, len(had))
+}
+
+func short_digest(dgst string) string {
+	hex := dgst[strings.Index(dgst, ":")+1:]
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
+
+func format_created(t *time.Time) string {
+	if t == nil {
+		return "unknown"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,297 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/reference"
+	"go_pull/pkgs/util/check_path"
+	"go_pull/pkgs/util/conversion"
+	"go_pull/pkgs/util/filetool"
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/makestr"
+	"go_pull/pkgs/util/shutdown"
+	"go_pull/pkgs/volume"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	// stdoutPath as --output streams the archive to stdout.
+	stdoutPath = "-"
+	// defaultNameTemplate keeps the historical <image>.tar file name.
+	defaultNameTemplate = "{{.Name}}.tar"
+	// unpackRatio is a rough size of a layer tar for a byte of its blob,
+	// for the space check of --recompress none.
+	unpackRatio = 3
+)
+
+var (
+	output       string
+	tmpdir       string
+	nameTemplate string
+	force        bool
+	split        string
+	splitsize    int64 // bytes of --split, 0 when not split
+)
+
+// outputname holds the fields available to --name. Every field is safe to
+// use in a file name: '/' and ':' are replaced by '_'.
+type outputname struct {
+	Registry string // registry host, registry-1.docker.io for Docker Hub
+	Repo     string // repository path, library_redis
+	Name     string // last repository element, redis
+	Tag      string
+	Digest   string // hex of the platform manifest digest
+	Platform string
+}
+
+func filesafe(s string) string {
+	return strings.NewReplacer("/", "_", ":", "_").Replace(s)
+}
+
+// render_name expands the --name template for an image.
+func render_name(tmpl string, ref reference.Reference, manifest_digest string) (string, error) {
+	t, err := template.New("name").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid --name template: %v", err)
+	}
+	digest := manifest_digest
+	if i := strings.Index(digest, ":"); i >= 0 {
+		digest = digest[i+1:]
+	}
+	var b bytes.Buffer
+	err = t.Execute(&b, outputname{
+		Registry: filesafe(ref.Registry),
+		Repo:     filesafe(ref.Repository),
+		Name:     filesafe(ref.Name()),
+		Tag:      filesafe(ref.Tag),
+		Digest:   digest,
+		Platform: filesafe(platform),
+	})
+	if err != nil {
+		return "", fmt.Errorf("invalid --name template: %v", err)
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("--name template %q renders an empty file name", tmpl)
+	}
+	return b.String(), nil
+}
+
+// output_path decides where the archive goes: stdout for "-", the rendered
+// name inside --output when it is a directory, --output itself otherwise,
+// and the rendered name in the working directory without --output.
+func output_path(ref reference.Reference, manifest_digest string) (string, error) {
+	if output == stdoutPath {
+		return stdoutPath, nil
+	}
+	out := output
+	if out == "" || check_path.Check_path(out).Adir() {
+		name, err := render_name(nameTemplate, ref, manifest_digest)
+		if err != nil {
+			return "", err
+		}
+		out = filepath.Join(out, name)
+	}
+	if check_path.Check_path(written(out)).Exists() && !force {
+		return "", fmt.Errorf("%v already exists, use --force to overwrite it", written(out))
+	}
+	return out, nil
+}
+
+// written is the file that shows the archive out was written: out, or with
+// --split the index of its volumes.
+func written(out string) string {
+	if splitsize > 0 {
+		return out + volume.IndexSuffix
+	}
+	return out
+}
+
+// parse_split reads --split.
+func parse_split() error {
+	if split == "" {
+		return nil
+	}
+	n, err := conversion.Parse_bytes(split)
+	if err != nil || n == 0 || n > math.MaxInt64 {
+		return fmt.Errorf("--split %q is not a size, such as 4G or 700MiB", split)
+	}
+	if output == stdoutPath {
+		return fmt.Errorf("--split writes volume files, not stdout")
+	}
+	splitsize = int64(n)
+	return nil
+}
+
+// archive_file is an archive written next to where it goes, so that out
+// never holds a partial one: a partial file, or with --split, volumes in a
+// staging directory.
+type archive_file struct {
+	io.Writer
+	out string
+	tf  *os.File
+	dir string
+	vw  *volume.Writer
+}
+
+// create_archive starts writing the archive out. What it wrote is removed if
+// the run stops before finish.
+func create_archive(out string) (*archive_file, error) {
+	a := &archive_file{out: out}
+	pattern := makestr.Joinstring(".", filepath.Base(out), ".*.partial")
+	if splitsize == 0 {
+		tf, err := os.CreateTemp(filepath.Dir(out), pattern)
+		if err != nil {
+			return nil, err
+		}
+		shutdown.Remove(tf.Name())
+		a.tf, a.Writer = tf, tf
+		return a, nil
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(out), pattern)
+	if err != nil {
+		return nil, err
+	}
+	shutdown.Remove(dir)
+	if a.vw, err = volume.NewWriter(dir, filepath.Base(out), splitsize); err != nil {
+		return nil, err
+	}
+	a.dir, a.Writer = dir, a.vw
+	return a, nil
+}
+
+// finish moves the archive, or its volumes then their index, into place and
+// tells what it wrote.
+func (a *archive_file) finish() (string, error) {
+	if a.tf != nil {
+		if err := a.tf.Close(); err != nil {
+			return "", err
+		}
+		if err := os.Chmod(a.tf.Name(), 0644); err != nil {
+			return "", err
+		}
+		if err := place(a.tf.Name(), a.out); err != nil {
+			return "", err
+		}
+		shutdown.Forget(a.tf.Name())
+		return a.out, nil
+	}
+	idx, err := a.vw.Close()
+	if err != nil {
+		return "", err
+	}
+	indexname := filepath.Base(a.out) + volume.IndexSuffix
+	f, err := os.Create(filepath.Join(a.dir, indexname))
+	if err != nil {
+		return "", err
+	}
+	err = idx.Write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	// the index goes last: volumes without one are left from a failed run
+	for _, name := range append(part_names(idx), indexname) {
+		if err := place(filepath.Join(a.dir, name), filepath.Join(filepath.Dir(a.out), name)); err != nil {
+			return "", err
+		}
+	}
+	os.Remove(a.dir)
+	shutdown.Forget(a.dir)
+	return fmt.Sprintf("%v (%v volumes of %v, index %v)", a.out, len(idx.Parts),
+		conversion.Humanize_uintbytes(uint64(idx.Split)), a.out+volume.IndexSuffix), nil
+}
+
+func part_names(idx *volume.Index) []string {
+	var names []string
+	for _, p := range idx.Parts {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// place moves the finished archive tmp to out. Without --force an archive
+// another run put at out meanwhile is kept and the run fails.
+func place(tmp string, out string) error {
+	if force {
+		return os.Rename(tmp, out)
+	}
+	err := os.Link(tmp, out)
+	if errors.Is(err, fs.ErrExist) {
+		return errdefs.Errorf(errdefs.Usage, "%v already exists, use --force to overwrite it", out)
+	}
+	if err != nil {
+		// no hard links, as on FAT
+		return os.Rename(tmp, out)
+	}
+	return os.Remove(tmp)
+}
+
+// stage_dir is where temporary files are kept: --tmpdir when set, else next
+// to the archive so it can be renamed into place, or the system temporary
+// directory when streaming to stdout.
+func stage_dir(out string) string {
+	if tmpdir != "" {
+		return tmpdir
+	}
+	if out == stdoutPath {
+		return os.TempDir()
+	}
+	return filepath.Dir(out)
+}
+
+// temp_file creates a staging file for blob in dir, removed if the run stops
+// before remove_temp.
+func temp_file(dir string, blob string) (*os.File, error) {
+	f, err := os.CreateTemp(dir, makestr.Joinstring("gopull_", blob[7:19], "_*"))
+	if err != nil {
+		return nil, err
+	}
+	shutdown.Remove(f.Name())
+	return f, nil
+}
+
+func remove_temp(path string) {
+	os.Remove(path)
+	shutdown.Forget(path)
+}
+
+// check_space fails when the output filesystem cannot hold the archive of
+// compressed bytes, or the staging filesystem the spooled bytes of layers
+// prefetched while others are written.
+func check_space(out string, stage string, compressed uint64, spooled uint64) error {
+	need := map[string]uint64{}
+	if spooled > 0 {
+		need[stage] = spooled
+	}
+	if out != stdoutPath {
+		dir := filepath.Dir(out)
+		if filetool.Samedevice(dir, stage) {
+			dir = stage
+		}
+		need[dir] += compressed
+	}
+	for dir, n := range need {
+		free, err := filetool.Freespace(dir)
+		if err != nil {
+			logtool.SugLog.Debugf("skip free space check of %v: %v", dir, err)
+			continue
+		}
+		logtool.SugLog.Debugf("%v: need about %v, %v free", dir,
+			conversion.Humanize_uintbytes(n), conversion.Humanize_uintbytes(free))
+		if free < n {
+			return fmt.Errorf("not enough space in %v: need about %v, %v free",
+				dir, conversion.Humanize_uintbytes(n), conversion.Humanize_uintbytes(free))
+		}
+	}
+	return nil
+}
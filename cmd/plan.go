@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go_pull/pkgs/model"
+	"go_pull/pkgs/reference"
+	"go_pull/pkgs/util/conversion"
+	"go_pull/pkgs/util/request"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// tarBlock is the record size of tar headers and content padding.
+const tarBlock = 512
+
+// print_plan shows what download would fetch and write for a platform
+// manifest, without writing anything.
+func print_plan(ref reference.Reference, manifest_digest string, manifest *model.Manifest) {
+	configsize := manifest.Config.Size
+
+	out, err := output_path(ref, manifest_digest)
+	if err != nil {
+		out = err.Error()
+	}
+	fmt.Printf("Image:     %v\n", ref)
+	fmt.Printf("Platform:  %v\n", platform)
+	fmt.Printf("Manifest:  %v\n", manifest_digest)
+	fmt.Printf("Output:    %v\n", out)
+	if recompress != "" {
+		fmt.Printf("Layers as: %v, sizes below are as pulled\n", recompress)
+	}
+	fmt.Println()
+
+	// metadata entries: config, then VERSION, json and directory per layer,
+	// manifest.json and repositories; layer json files are about 500 bytes
+	archive := tar_entry_size(uint64(configsize)) + 2*tar_entry_size(1024) + 2*tarBlock
+	unpacked := archive
+	var download, cachedn uint64
+	var unknown bool
+	seen := map[string]bool{}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tSIZE\tUNPACKED\tCACHED")
+	for _, layer := range manifest.Layers {
+		parameter := layer_parameter(layer)
+		mediatype := layer.MediaType
+		size := uint64(parameter.size)
+		meta := tarBlock + tar_entry_size(tarBlock) + tar_entry_size(3)
+		if seen[parameter.ublob] {
+			// a repeated layer is a link to its first copy
+			archive += meta + tarBlock
+			unpacked += meta + tarBlock
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", parameter.ublob, "-", "-", "repeated")
+			continue
+		}
+		seen[parameter.ublob] = true
+		if skip_layer(layer) {
+			archive += meta
+			unpacked += meta
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", parameter.ublob, conversion.Humanize_uintbytes(size), "-", "foreign")
+			continue
+		}
+		archive += meta + tar_entry_size(size)
+
+		cached := "no"
+		if parameter.ublob == model.EmptyLayerDigest {
+			cached = "empty"
+		} else if _, ok := blobs_has(parameter); ok {
+			cached = "yes"
+			cachedn++
+		} else {
+			download += size
+		}
+		usize, ok := unpacked_size(parameter, mediatype)
+		ushow := "?"
+		if ok {
+			ushow = conversion.Humanize_uintbytes(usize)
+			unpacked += meta + tar_entry_size(usize)
+		} else {
+			unknown = true
+			unpacked += meta + tar_entry_size(size)
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", parameter.ublob, conversion.Humanize_uintbytes(size), ushow, cached)
+	}
+	tw.Flush()
+	fmt.Println()
+
+	approx := ""
+	if unknown {
+		approx = " at least"
+	}
+	fmt.Printf("Layers:    %v, %v cached\n", len(manifest.Layers), cachedn)
+	fmt.Printf("Download:  %v\n", conversion.Humanize_uintbytes(download+uint64(configsize)))
+	fmt.Printf("Archive:   about %v compressed,%v %v uncompressed\n",
+		conversion.Humanize_uintbytes(archive), approx, conversion.Humanize_uintbytes(unpacked))
+}
+
+// tar_entry_size is the space a file of size bytes takes in a tar stream.
+func tar_entry_size(size uint64) uint64 {
+	return tarBlock + (size+tarBlock-1)/tarBlock*tarBlock
+}
+
+// blobs_has reports whether a layer of the expected size is in the cache.
+func blobs_has(parameter download_parameter) (int64, bool) {
+	if blobs == nil {
+		return 0, false
+	}
+	size, ok := blobs.Has(parameter.ublob)
+	return size, ok && size == int64(parameter.size)
+}
+
+// unpacked_size finds the uncompressed size of a layer. Plain tar layers are
+// their own size; for gzip layers it is the ISIZE trailer, the last four
+// bytes of the blob, read from the cache or with a suffix range request. The
+// trailer holds the size modulo 4GiB, so larger layers are not reported
+// right.
+func unpacked_size(parameter download_parameter, mediatype string) (uint64, bool) {
+	switch {
+	case parameter.ublob == model.EmptyLayerDigest:
+		return 2 * tarBlock, true
+	case strings.HasSuffix(mediatype, ".tar"), strings.HasSuffix(mediatype, "tar.diff"):
+		return uint64(parameter.size), true
+	case !strings.Contains(mediatype, "gzip"), parameter.size < 18:
+		return 0, false
+	}
+
+	var trailer []byte
+	if _, ok := blobs_has(parameter); ok {
+		f, err := blobs.Open(parameter.ublob)
+		if err != nil {
+			return 0, false
+		}
+		defer f.Close()
+		trailer = make([]byte, 4)
+		if _, err := f.ReadAt(trailer, int64(parameter.size-4)); err != nil {
+			return 0, false
+		}
+	} else {
+		bresp, err := request.Requests(
+			registry_url(repository, "/blobs/", parameter.ublob)).
+			Notparse().
+			Setheads(blob_auth_head()).
+			Setheads(map[string]string{"Range": "bytes=-4"}).
+			Settls().
+			Get()
+		if err != nil {
+			return 0, false
+		}
+		defer bresp.RawBody().Close()
+		// a server ignoring the range would send the whole layer
+		if bresp.StatusCode() != 206 {
+			return 0, false
+		}
+		trailer, err = io.ReadAll(io.LimitReader(bresp.RawBody(), 8))
+		if err != nil || len(trailer) != 4 {
+			return 0, false
+		}
+	}
+	return uint64(binary.LittleEndian.Uint32(trailer)), true
+}
@@ -1,7 +1,8 @@
 package cmd
 
 import (
-	"context"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/util/shutdown"
 	"encoding/base64"
 	"encoding/json"
 	"go_pull/pkgs/util/logtool"
@@ -46,14 +47,14 @@ var pullcmd = &cobra.Command{
 
 func startpull(img []string) {
 	if len(img) > 1{
-		logtool.SugLog.Fatal("Parameter parsing exception , plase use \"gohttp help\"")
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "pull takes one image, see gopull help pull"))
 	}
 	imageName := regexp.MustCompile(`^[^@]+`).FindString(img[0])
 	if imageName=="" {
-		logtool.SugLog.Fatal("image 名称不合法")
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "invalid image name %q", img[0]))
 	}
 
-	ctx := context.Background()
+	ctx := shutdown.Context
 	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	logtool.Fatalerror(err)
 
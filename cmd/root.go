@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"go_pull/pkgs/errdefs"
 	"go_pull/pkgs/vmconfig"
 	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/shutdown"
 
 	"github.com/spf13/cobra"
 )
@@ -13,19 +15,34 @@ var (
 		Short: "get a image",
 		Long:  `get a image!`,
 		TraverseChildren: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := load_config(cmd); err != nil {
+				return err
+			}
+			return logtool.SetFormat(logformat)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			cmd.Help()
 		},
 	}
+	logformat string
 )
 
 func init() {
 	logtool.InitEvent(vmconfig.DefaultLoglevel)
+	rootCmd.PersistentFlags().BoolVar(&shutdown.KeepTemp, "keep-temp", false,
+		"leave temporary and partial files in place when a run fails or is interrupted")
+	rootCmd.PersistentFlags().StringVar(&logformat, "log-format", "text",
+		"log and error format, text or json; a failure is logged with its kind and exit code")
 }
 
+// Execute runs gopull. Ctrl-C, SIGTERM and fatal errors stop it through
+// shutdown, which cleans up and exits with the code of the error, see
+// errdefs.
 func Execute() {
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
+	shutdown.Notify()
 	if err := rootCmd.Execute(); err != nil {
-		logtool.SugLog.Fatal(err)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
 	}
 }
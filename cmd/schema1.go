@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/layer"
+	"go_pull/pkgs/model"
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/request"
+	"io"
+	"strconv"
+)
+
+// schema1_manifest reads a legacy manifest and describes its layers the way
+// a schema2 manifest does. Schema1 does not give layer sizes, which the
+// archive needs up front, so they are asked with HEAD requests.
+func schema1_manifest(body []byte) (*model.Schema1, *model.Manifest) {
+	legacy, err := model.ParseSchema1(body)
+	logtool.Fatalerror(err)
+	if verifysig {
+		logtool.Fatalerror(model.VerifySchema1(body))
+	}
+	if legacy.Architecture != "" && !(model.Platform{OS: "linux", Architecture: legacy.Architecture}).Match(platform) {
+		logtool.SugLog.Warnf("%v is a schema1 image for %v, not %v", repository, legacy.Architecture, platform)
+	}
+
+	manifest := &model.Manifest{SchemaVersion: 2, MediaType: model.MediaTypeManifest}
+	sizes := map[string]int64{}
+	for _, digest := range legacy.Layers() {
+		size, ok := sizes[digest]
+		if !ok {
+			size = blob_size(digest)
+			sizes[digest] = size
+		}
+		manifest.Layers = append(manifest.Layers, model.Descriptor{
+			MediaType: model.MediaTypeLayer,
+			Size:      size,
+			Digest:    digest,
+		})
+	}
+	return legacy, manifest
+}
+
+// blob_size finds the size of a blob from the cache or a HEAD request.
+func blob_size(digest string) int64 {
+	if digest == model.EmptyLayerDigest {
+		return int64(len(model.EmptyLayer))
+	}
+	if blobs != nil {
+		if size, ok := blobs.Has(digest); ok {
+			return size
+		}
+	}
+	bresp, err := request.Requests(
+		registry_url(repository, "/blobs/", digest)).
+		Setheads(blob_auth_head()).
+		Settls().
+		Head()
+	if err != nil {
+		logtool.Fatalerror(fmt.Errorf("cannot find layer %v: %w", digest[7:19], err))
+	}
+	if bresp.StatusCode() != 200 {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.HTTPStatus(bresp.StatusCode()),
+			"cannot find layer %v: HTTP %v", digest[7:19], bresp.Status()))
+	}
+	size, err := strconv.ParseInt(bresp.Header().Get("Content-Length"), 10, 64)
+	if err != nil || size < 0 {
+		logtool.Fatalerror(fmt.Errorf("registry gives no size for layer %v", digest[7:19]))
+	}
+	return size
+}
+
+// schema1_config makes the image config of a schema1 image. The config
+// holds the diff_ids of the layers, so every layer is downloaded first,
+// into the cache or dir, and left in spools for the archive.
+func schema1_config(legacy *model.Schema1, dir string, layers []model.Descriptor, spools map[int]*spool) []byte {
+	first := make([]int, len(layers))
+	seen := map[string]int{}
+	for x, l := range layers {
+		if p, ok := seen[l.Digest]; ok {
+			first[x] = p
+		} else {
+			first[x], seen[l.Digest] = x, x
+		}
+	}
+	fetched := func(x int) bool {
+		return first[x] == x && layers[x].Digest != model.EmptyLayerDigest
+	}
+
+	diffIDs := make([]string, len(layers))
+	for x, l := range layers {
+		for p := x; p < len(layers) && p < x+parallel; p++ {
+			if _, ok := spools[p]; !ok && fetched(p) {
+				spools[p] = open_layer(dir, layer_parameter(layers[p]), false)
+			}
+		}
+
+		var err error
+		switch {
+		case first[x] != x:
+			diffIDs[x] = diffIDs[first[x]]
+		case l.Digest == model.EmptyLayerDigest:
+			diffIDs[x], err = layer.DiffID(bytes.NewReader(model.EmptyLayer), layer.Gzip, l.Size)
+		default:
+			s := spools[x]
+			<-s.done
+			logtool.Fatalerror(s.err)
+			diffIDs[x] = s.diffid
+			if s.diffid == "" {
+				// a cached layer is read again
+				diffIDs[x], err = layer.DiffID(io.NewSectionReader(s.file, 0, l.Size), layer.ByMediaType(l.MediaType), l.Size)
+			}
+		}
+		logtool.Fatalerror(err)
+	}
+	config, err := legacy.Config(diffIDs)
+	logtool.Fatalerror(err)
+	return config
+}
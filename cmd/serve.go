@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"go_pull/pkgs/errdefs"
+	v2 "go_pull/pkgs/registry"
+	"go_pull/pkgs/store"
+	"go_pull/pkgs/util/logtool"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	listen   string
+	upstream string
+	tlscert  string
+	tlskey   string
+	tagttl   time.Duration
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve [--root STORE] [--listen ADDR]",
+	Short: "serve the blob store as a read-only registry",
+	Long: `serve answers the pull side of the registry v2 API from a blob store, the
+cache download --cache fills: manifests by tag or digest, blobs with ranges,
+tag lists and the catalog. Images are served under the repository they were
+pulled from, library/alpine for alpine. With --upstream, what the store lacks
+is fetched from that registry, with the settings of the config for it, and
+kept for the next pull. Tags are checked with a HEAD once --tag-ttl passed
+and fetched again when they moved upstream.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if (tlscert == "") != (tlskey == "") {
+			logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "--tls-cert and --tls-key go together"))
+		}
+		startserve()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringVar(&storedir, "root", "", "blob store to serve (default: cache of the config)")
+	serveCmd.Flags().StringVar(&listen, "listen", ":5000", "address to listen on")
+	serveCmd.Flags().StringVar(&upstream, "upstream", "", "registry to fetch what the store lacks from, such as registry-1.docker.io")
+	serveCmd.Flags().StringVar(&tlscert, "tls-cert", "", "certificate to serve https with")
+	serveCmd.Flags().StringVar(&tlskey, "tls-key", "", "key of --tls-cert")
+	serveCmd.Flags().DurationVar(&tagttl, "tag-ttl", time.Minute, "how long a tag is served from the store before --upstream is asked whether it moved, 0 to ask on every pull")
+}
+
+// status_writer keeps the status of a response for the access log.
+type status_writer struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *status_writer) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func startserve() {
+	if storedir == "" {
+		storedir = conf.Cache
+	}
+	if storedir == "" {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "no store, set --root or cache in the config"))
+	}
+	s, err := store.Open(storedir)
+	logtool.Fatalerror(err)
+	srv := &v2.Server{Store: s, TagTTL: tagttl}
+	if upstream != "" {
+		registry = upstream
+		setup_registry()
+		srv.Upstream = &v2.Upstream{
+			URL:   strings.TrimSuffix(registry_url(), "/v2/"),
+			Login: basic_auth(),
+		}
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &status_writer{ResponseWriter: w, status: http.StatusOK}
+		srv.ServeHTTP(sw, r)
+		logtool.SugLog.Infof("%v %v %v %v %v", r.RemoteAddr, r.Method, r.URL.RequestURI(), sw.status, time.Since(start).Round(time.Millisecond))
+	})
+	logtool.SugLog.Infof("serving %v on %v", storedir, listen)
+	if tlscert != "" {
+		err = http.ListenAndServeTLS(listen, tlscert, tlskey, handler)
+	} else {
+		err = http.ListenAndServe(listen, handler)
+	}
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+}
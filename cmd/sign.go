@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/signing"
+	"go_pull/pkgs/util/check_path"
+	"go_pull/pkgs/util/logtool"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	signkey  string
+	certfile string
+	cafile   string
+)
+
+var signCmd = &cobra.Command{
+	Use:   "sign FILE|DIR... --key KEY [--cert CERT]",
+	Short: "write the signed manifest of files to carry: their size and sha256",
+	Long: `sign lists the files given, and every file below the directories given,
+with their size and sha256 in a manifest, gopull-manifest.json next to the
+first one unless --output is set, and signs it into MANIFEST.sig. The key is a
+PEM private key: ed25519, or any key with its X.509 certificate in --cert,
+followed by its intermediates. Files are named relative to the manifest and
+must be below its directory. gopull verify checks them on the other side.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		startsign(args)
+	},
+}
+
+var verifyCmd = &cobra.Command{
+	Use:   "verify [MANIFEST] --key KEY | --ca CA",
+	Short: "check the signature of a manifest gopull sign wrote, then every file it lists",
+	Long: `verify checks the signature of the manifest, gopull-manifest.json by default,
+against a public key or certificate given in --key, or against the CA
+certificates of --ca for manifests signed with a code signing certificate.
+Then it reads every file of the manifest and reports those missing or
+changed, and the files below the directories signed as a whole that the
+manifest does not list. Nothing should
+be loaded unless it succeeds.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		manifest := signing.ManifestName
+		if len(args) == 1 {
+			manifest = args[0]
+		}
+		startverify(manifest)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(signCmd)
+	rootCmd.AddCommand(verifyCmd)
+	signCmd.Flags().StringVar(&signkey, "key", "", "PEM private key to sign with")
+	signCmd.Flags().StringVar(&certfile, "cert", "", "PEM certificate of the key, then its intermediates")
+	signCmd.Flags().StringVarP(&output, "output", "o", "", "manifest to write (default: gopull-manifest.json next to the first file)")
+	signCmd.MarkFlagRequired("key")
+	verifyCmd.Flags().StringVar(&signkey, "key", "", "PEM public key or certificate the manifest was signed with")
+	verifyCmd.Flags().StringVar(&cafile, "ca", "", "PEM CA certificates the certificate of the signature must chain to")
+}
+
+func startsign(args []string) {
+	data, err := os.ReadFile(signkey)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	key, err := signing.ParsePrivateKey(data)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	var chain []*x509.Certificate
+	if certfile != "" {
+		data, err := os.ReadFile(certfile)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		chain, err = signing.ParseCertificates(data)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	}
+
+	out := output
+	if out == "" {
+		dir := args[0]
+		if !check_path.Check_path(dir).Adir() {
+			dir = filepath.Dir(dir)
+		}
+		out = filepath.Join(dir, signing.ManifestName)
+	}
+	dir := filepath.Dir(out)
+	names, dirs := sign_files(dir, args, out)
+	m, err := signing.Build(dir, names)
+	logtool.Fatalerror(err)
+	m.Dirs = dirs
+	body, err := json.MarshalIndent(m, "", "  ")
+	logtool.Fatalerror(err)
+	body = append(body, '\n')
+	sig, err := signing.Sign(body, key, chain)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	sigbody, err := json.MarshalIndent(sig, "", "  ")
+	logtool.Fatalerror(err)
+	write_file(out, body)
+	write_file(out+signing.SignatureSuffix, append(sigbody, '\n'))
+	fmt.Fprintf(logtool.Console, "%v files signed with %v, manifest %v, signature %v\n",
+		len(names), sig.Algorithm, out, out+signing.SignatureSuffix)
+}
+
+// sign_files lists the files of args, and the files below the directories of
+// args, relative to dir, then those directories. Hidden files, such as
+// partial archives, and the manifest out are left out.
+func sign_files(dir string, args []string, out string) ([]string, []string) {
+	seen := map[string]bool{}
+	var names, dirs []string
+	local := func(p string) string {
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || !filepath.IsLocal(rel) {
+			logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "%v is not below %v, where the manifest is", p, dir))
+		}
+		return rel
+	}
+	add := func(p string) {
+		rel := local(p)
+		if seen[rel] || p == out || p == out+signing.SignatureSuffix {
+			return
+		}
+		seen[rel] = true
+		names = append(names, rel)
+	}
+	for _, arg := range args {
+		arg = filepath.Clean(arg)
+		if !check_path.Check_path(arg).Adir() {
+			add(arg)
+			continue
+		}
+		dirs = append(dirs, filepath.ToSlash(local(arg)))
+		err := filepath.WalkDir(arg, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(d.Name(), ".") && p != arg {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if d.Type().IsRegular() {
+				add(p)
+			}
+			return nil
+		})
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	}
+	if len(names) == 0 {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "no file to sign in %v", strings.Join(args, " ")))
+	}
+	return names, dirs
+}
+
+func startverify(manifest string) {
+	if (signkey == "") == (cafile == "") {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "give --key or --ca to verify the signature with"))
+	}
+	body, err := os.ReadFile(manifest)
+	logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+	sigbody, err := os.ReadFile(manifest + signing.SignatureSuffix)
+	if os.IsNotExist(err) {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.DigestMismatch, "%v is not signed, %v is missing",
+			manifest, manifest+signing.SignatureSuffix))
+	}
+	logtool.Fatalerror(err)
+	sig := &signing.Signature{}
+	if err := json.Unmarshal(sigbody, sig); err != nil {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.DigestMismatch, "%v: %v", manifest+signing.SignatureSuffix, err))
+	}
+
+	if signkey != "" {
+		data, err := os.ReadFile(signkey)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		key, err := signing.ParsePublicKey(data)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		logtool.Fatalerror(sig.Verify(body, key))
+	} else {
+		data, err := os.ReadFile(cafile)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		cas, err := signing.ParseCertificates(data)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		roots := x509.NewCertPool()
+		for _, c := range cas {
+			roots.AddCert(c)
+		}
+		_, err = sig.VerifyChain(body, roots)
+		logtool.Fatalerror(err)
+	}
+	signer := sig.Algorithm + " key"
+	if s := sig.Subject(); s != "" {
+		signer = s
+	}
+	fmt.Fprintf(logtool.Console, "signature of %v by %v is valid\n", manifest, signer)
+
+	m, err := signing.Parse(body)
+	logtool.Fatalerror(errdefs.New(errdefs.DigestMismatch, err))
+	problems := signing.Check(manifest, m)
+	for _, p := range problems {
+		fmt.Fprintf(logtool.Console, "%v: %v\n", p.Name, p.Err)
+	}
+	if len(problems) > 0 {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.DigestMismatch, "%v files of %v missing, changed or not listed",
+			len(problems), manifest))
+	}
+	fmt.Fprintf(logtool.Console, "%v files verified\n", len(m.Files))
+}
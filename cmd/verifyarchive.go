@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+	"go_pull/pkgs/archive"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/util/logtool"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var verifyArchiveCmd = &cobra.Command{
+	Use:   "verify-archive ARCHIVE...",
+	Short: "check a docker save archive or OCI layout offline, before a long import",
+	Long: `verify-archive reads archives through, gopull's or from docker save, and
+checks the images of their manifest.json and index.json: every file they
+reference is there, blobs match the digest and size of their descriptor, and
+layers, compressed or not, the diff_ids of their image config. Every problem
+is reported, nothing is fetched.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		startverifyarchive(args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(verifyArchiveCmd)
+}
+
+func startverifyarchive(files []string) {
+	bad := 0
+	for _, file := range files {
+		f, err := os.Open(file)
+		logtool.Fatalerror(errdefs.New(errdefs.Usage, err))
+		rep, err := archive.Verify(f)
+		f.Close()
+		if err != nil {
+			logtool.Fatalerror(errdefs.Errorf(errdefs.Usage, "%v: %v", file, err))
+		}
+		for _, p := range rep.Problems {
+			fmt.Fprintf(logtool.Console, "%v: %v\n", file, p)
+		}
+		state := "ok"
+		if len(rep.Problems) > 0 {
+			bad++
+			state = fmt.Sprintf("%v problems", len(rep.Problems))
+		}
+		fmt.Fprintf(logtool.Console, "%v: %v, %v images, %v layers, %v\n", file, rep.Format, rep.Images, rep.Layers, state)
+	}
+	if bad > 0 {
+		logtool.Fatalerror(errdefs.Errorf(errdefs.DigestMismatch, "%v of %v archives have problems", bad, len(files)))
+	}
+}
@@ -0,0 +1,206 @@
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/layer"
+	"go_pull/pkgs/model"
+	"go_pull/pkgs/store"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Image is an image Import put in the store.
+type Image struct {
+	// Name is the reference the archive names the image with,
+	// docker.io/library/redis:7, "" when it has none
+	Name string
+	// Tag is the bare tag of an OCI layout naming its images by tag
+	// alone, for a repository given by the caller
+	Tag    string
+	Digest string // of its manifest or index
+	// Converted tells the manifest was made from the layout of docker
+	// save, not kept from the registry
+	Converted bool
+}
+
+// maybeBlob tells whether the archive entry name may be a blob, a config,
+// layer or OCI blob, and not metadata of the archive.
+func maybeBlob(name string) bool {
+	switch path.Base(name) {
+	case "VERSION", "json", "manifest.json", "repositories", "index.json", "oci-layout":
+		return false
+	}
+	return true
+}
+
+// ingestFile digests a file of the archive as digestFile does while writing
+// it into the store, under the digest of its content.
+func ingestFile(s *store.Store, r io.Reader, size int64) (*digested, error) {
+	b, err := s.Ingest()
+	if err != nil {
+		return nil, err
+	}
+	f, err := digestFile(io.TeeReader(r, b), size)
+	if err != nil {
+		b.Abort()
+		return nil, err
+	}
+	if err := b.Commit(); err != nil {
+		return nil, err
+	}
+	return f, b.Close()
+}
+
+// Import reads the archive r through into the store s: every blob of a
+// docker save archive or OCI layout, checked as Verify does. The images of
+// an OCI layout keep their manifests, those of a docker save archive get a
+// manifest made from their config and layers, laid out as docker push
+// does. The manifest gets back the digest it had in the registry only
+// where the archive kept the original blobs: docker save writes the layers
+// uncompressed, gopull keeps them as pulled. The blobs are left in the
+// store when the archive has problems, the images are not imported then.
+func Import(r io.Reader, s *store.Store) ([]Image, error) {
+	c, err := digestAll(r, s)
+	if err != nil {
+		return nil, err
+	}
+	return c.importInto(s)
+}
+
+// ImportDir is Import for the directory dir, an OCI layout as skopeo oci:
+// and buildah push oci: write it, or an unpacked archive.
+func ImportDir(dir string, s *store.Store) ([]Image, error) {
+	c, err := digestDir(dir, s)
+	if err != nil {
+		return nil, err
+	}
+	return c.importInto(s)
+}
+
+// importInto checks the images of c, whose blobs are in the store s, and
+// adds the manifests made for docker save images.
+func (c *contents) importInto(s *store.Store) ([]Image, error) {
+	rep, err := c.verify()
+	if err != nil {
+		return nil, err
+	}
+	if len(rep.Problems) > 0 {
+		return nil, errdefs.Errorf(errdefs.DigestMismatch, "%v", strings.Join(rep.Problems, "\n"))
+	}
+	if f, ok := c.file("index.json"); ok {
+		return importIndex(f.data)
+	}
+	f, _ := c.file("manifest.json")
+	var items []model.ManifestItem
+	if err := json.Unmarshal(f.data, &items); err != nil {
+		return nil, err
+	}
+	var images []Image
+	for _, item := range items {
+		body, err := c.convert(item)
+		if err != nil {
+			return nil, err
+		}
+		dgst := digest.FromBytes(body).String()
+		if err := s.Put(dgst, body); err != nil {
+			return nil, err
+		}
+		if len(item.RepoTags) == 0 {
+			images = append(images, Image{Digest: dgst, Converted: true})
+		}
+		for _, name := range item.RepoTags {
+			images = append(images, Image{Name: name, Digest: dgst, Converted: true})
+		}
+	}
+	return images, nil
+}
+
+// importIndex lists the images of the index.json of an OCI layout, named
+// by their annotations. Their blobs are already in the store.
+func importIndex(data []byte) ([]Image, error) {
+	var index model.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, err
+	}
+	var images []Image
+	for _, desc := range index.Manifests {
+		image := Image{Digest: desc.Digest, Name: desc.Annotations["io.containerd.image.name"]}
+		if ref := desc.Annotations["org.opencontainers.image.ref.name"]; image.Name == "" && ref != "" {
+			// a full reference, or a tag as skopeo writes it
+			if strings.ContainsAny(ref, ":/@") {
+				image.Name = ref
+			} else {
+				image.Tag = ref
+			}
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// convert makes the manifest of an image of manifest.json: a docker
+// manifest, or an OCI one when a layer is zstd, which docker has no media
+// type for. The blobs are the files of the archive, foreign layers the
+// descriptors of LayerSources.
+func (c *contents) convert(item model.ManifestItem) ([]byte, error) {
+	cf, _ := c.file(item.Config)
+	config, err := model.ParseImageConfig(cf.data)
+	if err != nil {
+		return nil, err
+	}
+	oci := false
+	var comps []layer.Compression
+	for _, name := range item.Layers {
+		comp := layer.Uncompressed
+		if l, ok := c.file(name); ok {
+			comp = l.comp
+		}
+		comps = append(comps, comp)
+		oci = oci || comp == layer.Zstd
+	}
+	m := model.Manifest{
+		SchemaVersion: 2,
+		MediaType:     model.MediaTypeManifest,
+		Config:        model.Descriptor{MediaType: model.MediaTypeImageConfig, Size: cf.size, Digest: cf.digest},
+	}
+	if oci {
+		m.MediaType, m.Config.MediaType = model.MediaTypeOCIManifest, model.MediaTypeOCIConfig
+	}
+	for x, name := range item.Layers {
+		l, ok := c.file(name)
+		if !ok {
+			// Verify let it through, a foreign layer
+			src := item.LayerSources[config.RootFS.DiffIDs[x]]
+			if oci && src.MediaType == model.MediaTypeForeignLayer {
+				src.MediaType = model.MediaTypeOCIForeignGz
+			}
+			m.Layers = append(m.Layers, src)
+			continue
+		}
+		m.Layers = append(m.Layers, model.Descriptor{MediaType: layerType(comps[x], oci), Size: l.size, Digest: l.digest})
+	}
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("%v: %v", item.Config, err)
+	}
+	return json.MarshalIndent(m, "", "   ")
+}
+
+// layerType is the media type of a layer compressed with comp.
+func layerType(comp layer.Compression, oci bool) string {
+	switch {
+	case oci && comp == layer.Zstd:
+		return model.MediaTypeOCILayerZstd
+	case oci && comp == layer.Gzip:
+		return model.MediaTypeOCILayerGzip
+	case oci:
+		return model.MediaTypeOCILayer
+	case comp == layer.Gzip:
+		return model.MediaTypeLayer
+	}
+	return model.MediaTypeLayerTar
+}
@@ -0,0 +1,177 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/model"
+	"go_pull/pkgs/store"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestImportSave(t *testing.T) {
+	s, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, app := gz("base layer"), "app layer"
+	c := config(digest.FromString("base layer").String(), digest.FromString(app).String())
+	cdgst := digest.FromString(c)
+	save := func(layer []byte) []byte {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.AddFile(cdgst.Encoded()+".json", []byte(c))
+		w.AddFile("a/layer.tar", base)
+		w.AddFile("a/json", []byte(`{}`))
+		w.AddFile("b/layer.tar", layer)
+		w.AddFile("manifest.json", []byte(`[{"Config":"`+cdgst.Encoded()+`.json","RepoTags":["app:1","app:2"],`+
+			`"Layers":["a/layer.tar","b/layer.tar"]}]`))
+		w.Close()
+		return buf.Bytes()
+	}
+	images, err := Import(bytes.NewReader(save([]byte(app))), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 2 || images[0].Name != "app:1" || images[1].Name != "app:2" || !images[0].Converted ||
+		images[0].Digest != images[1].Digest {
+		t.Fatalf("images: %+v", images)
+	}
+	f, err := s.Open(images[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m model.Manifest
+	json.NewDecoder(f).Decode(&m)
+	f.Close()
+	want := []model.Descriptor{
+		{MediaType: model.MediaTypeLayer, Size: int64(len(base)), Digest: digest.FromBytes(base).String()},
+		{MediaType: model.MediaTypeLayerTar, Size: int64(len(app)), Digest: digest.FromString(app).String()},
+	}
+	if m.MediaType != model.MediaTypeManifest || m.Config.Digest != cdgst.String() || len(m.Layers) != 2 ||
+		m.Layers[0].Digest != want[0].Digest || m.Layers[1].MediaType != want[1].MediaType {
+		t.Fatalf("manifest: %+v", m)
+	}
+	for _, d := range append(want, m.Config) {
+		if _, ok := s.Has(d.Digest); !ok {
+			t.Fatalf("%v is not in the store", d.Digest)
+		}
+	}
+	if _, ok := s.Has(digest.FromString(`{}`).String()); ok {
+		t.Fatal("legacy layer json stored")
+	}
+
+	if _, err := Import(bytes.NewReader(save([]byte("app layeR"))), s); errdefs.KindOf(err) != errdefs.DigestMismatch {
+		t.Fatalf("changed layer imported: %v", err)
+	}
+}
+
+// TestImportDockerSave imports the layout of docker save, which writes every
+// layer uncompressed.
+func TestImportDockerSave(t *testing.T) {
+	s, _ := store.Open(t.TempDir())
+	layers := []string{"base layer", "app layer"}
+	c := []byte(config(digest.FromString(layers[0]).String(), digest.FromString(layers[1]).String()))
+	save, err := model.NewSave(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.AddFile(save.Config, c)
+	for x, l := range save.Layers {
+		w.AddFile(l.ID+"/VERSION", []byte(model.VERSION))
+		w.AddFile(l.ID+"/json", l.JSON)
+		w.AddFile(l.Path(), []byte(layers[x]))
+	}
+	manifest, _ := save.Manifest([]string{"app:1"}, nil, nil)
+	repositories, _ := save.Repositories("app", "1")
+	w.AddFile("manifest.json", manifest)
+	w.AddFile("repositories", repositories)
+	w.Close()
+
+	images, err := Import(&buf, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Name != "app:1" || !images[0].Converted {
+		t.Fatalf("images: %+v", images)
+	}
+	f, err := s.Open(images[0].Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m model.Manifest
+	json.NewDecoder(f).Decode(&m)
+	f.Close()
+	if m.MediaType != model.MediaTypeManifest || m.Config.MediaType != model.MediaTypeImageConfig || len(m.Layers) != 2 {
+		t.Fatalf("manifest: %+v", m)
+	}
+	for x, l := range m.Layers {
+		want := model.Descriptor{MediaType: model.MediaTypeLayerTar, Size: int64(len(layers[x])), Digest: digest.FromString(layers[x]).String()}
+		if l.MediaType != want.MediaType || l.Size != want.Size || l.Digest != want.Digest {
+			t.Fatalf("layer %v: %+v, want %+v", x, l, want)
+		}
+	}
+}
+
+func TestImportOCI(t *testing.T) {
+	layer := gz("layer")
+	c := config(digest.FromString("layer").String())
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",` +
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"` + digest.FromString(c).String() + `","size":` +
+		fmt.Sprint(len(c)) + `},"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"` +
+		digest.FromBytes(layer).String() + `","size":` + fmt.Sprint(len(layer)) + `}]}`
+	mdgst := digest.FromString(manifest).String()
+	desc := `{"mediaType":"application/vnd.oci.image.manifest.v1+json","digest":"` + mdgst + `","size":` + fmt.Sprint(len(manifest))
+	files := map[string][]byte{
+		"oci-layout":                               []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		blobPath(digest.FromString(c).String()):    []byte(c),
+		blobPath(digest.FromBytes(layer).String()): layer,
+		blobPath(mdgst):                            []byte(manifest),
+		"index.json": []byte(`{"schemaVersion":2,"manifests":[` +
+			desc + `,"annotations":{"org.opencontainers.image.ref.name":"1.0"}},` +
+			desc + `,"annotations":{"io.containerd.image.name":"docker.io/library/app:2","org.opencontainers.image.ref.name":"2"}}]}`),
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	// the layout as skopeo oci: writes it, a directory
+	dir := t.TempDir()
+	for name, data := range files {
+		w.AddFile(name, data)
+		os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755)
+		os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), data, 0644)
+	}
+	w.Close()
+
+	for _, from := range []string{"tar", "directory"} {
+		s, _ := store.Open(t.TempDir())
+		var images []Image
+		var err error
+		if from == "tar" {
+			images, err = Import(&buf, s)
+		} else {
+			images, err = ImportDir(dir, s)
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", from, err)
+		}
+		if len(images) != 2 || images[0].Tag != "1.0" || images[0].Name != "" || images[1].Name != "docker.io/library/app:2" ||
+			images[0].Digest != mdgst || images[0].Converted {
+			t.Fatalf("%v: images: %+v", from, images)
+		}
+		if _, ok := s.Has(mdgst); !ok {
+			t.Fatalf("%v: manifest is not in the store", from)
+		}
+	}
+	os.WriteFile(filepath.Join(dir, filepath.FromSlash(blobPath(digest.FromBytes(layer).String()))), gz("other"), 0644)
+	s, _ := store.Open(t.TempDir())
+	if _, err := ImportDir(dir, s); errdefs.KindOf(err) != errdefs.DigestMismatch {
+		t.Fatalf("changed layer of a directory imported: %v", err)
+	}
+}
@@ -0,0 +1,111 @@
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Merge writes the docker save archives of paths into w as one archive that
+// loads all their images. Layers and configs the images share are written
+// once, manifest.json lists every image and repositories every tag.
+func Merge(w io.Writer, paths []string) error {
+	aw := NewWriter(w)
+	var manifest []json.RawMessage
+	repositories := map[string]map[string]string{}
+	for _, p := range paths {
+		if err := merge(aw, p, &manifest, repositories); err != nil {
+			return fmt.Errorf("%v: %w", p, err)
+		}
+	}
+	//docker save leaves these two at the epoch
+	aw.ModTime = time.Unix(0, 0)
+	if err := addjson(aw, "manifest.json", manifest); err != nil {
+		return err
+	}
+	if len(repositories) == 0 {
+		// untagged images only, docker save writes no repositories then
+		return aw.Close()
+	}
+	if err := addjson(aw, "repositories", repositories); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// addjson writes v on one line ending with a newline, as docker save does.
+func addjson(aw *Writer, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return aw.AddFile(name, append(data, '\n'))
+}
+
+func merge(aw *Writer, p string, manifest *[]json.RawMessage, repositories map[string]map[string]string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := clean(h.Name)
+		switch {
+		case name == "manifest.json":
+			var items []json.RawMessage
+			if err := json.NewDecoder(tr).Decode(&items); err != nil {
+				return fmt.Errorf("manifest.json: %v", err)
+			}
+			*manifest = append(*manifest, items...)
+			continue
+		case name == "repositories":
+			var repos map[string]map[string]string
+			if err := json.NewDecoder(tr).Decode(&repos); err != nil {
+				return fmt.Errorf("repositories: %v", err)
+			}
+			for repo, tags := range repos {
+				if repositories[repo] == nil {
+					repositories[repo] = map[string]string{}
+				}
+				for tag, id := range tags {
+					repositories[repo][tag] = id
+				}
+			}
+			continue
+		case h.Typeflag == tar.TypeDir:
+			// written with the entries in them
+			continue
+		case aw.Has(name):
+			// entries are named by the digest of their content
+			continue
+		}
+		aw.ModTime = h.ModTime
+		switch h.Typeflag {
+		case tar.TypeReg:
+			fw, err := aw.Create(name, h.Size)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(fw, tr); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := aw.Symlink(name, h.Linkname); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%v: unsupported entry type %c", name, h.Typeflag)
+		}
+	}
+}
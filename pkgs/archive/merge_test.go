@@ -0,0 +1,75 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// save writes a docker save like archive of one image with its layers.
+func save(t *testing.T, dir string, name string, config string, repo string, layers ...string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, l := range layers {
+		if err := w.AddFile(l+"/layer.tar", []byte(l)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.AddFile(config, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	w.AddFile("manifest.json", []byte(`[{"Config":"`+config+`","RepoTags":["`+repo+`:1"]}]`+"\n"))
+	w.AddFile("repositories", []byte(`{"`+repo+`":{"1":"`+layers[len(layers)-1]+`"}}`+"\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	a := save(t, dir, "a.tar", "aaa.json", "a", "base", "la")
+	b := save(t, dir, "b.tar", "bbb.json", "b", "base", "lb")
+	var buf bytes.Buffer
+	if err := Merge(&buf, []string{a, b}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"base/", "base/layer.tar=base", "la/", "la/layer.tar=la", "aaa.json={}",
+		"lb/", "lb/layer.tar=lb", "bbb.json={}",
+		`manifest.json=[{"Config":"aaa.json","RepoTags":["a:1"]},{"Config":"bbb.json","RepoTags":["b:1"]}]`,
+		`repositories={"a":{"1":"la"},"b":{"1":"lb"}}`}
+	var got []string
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeDir {
+			got = append(got, h.Name)
+			continue
+		}
+		b, _ := io.ReadAll(tr)
+		got = append(got, h.Name+"="+strings.TrimSuffix(string(b), "\n"))
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("entries %v, want %v", got, want)
+	}
+
+	if err := Merge(io.Discard, []string{filepath.Join(dir, "missing.tar")}); err == nil {
+		t.Fatal("missing archive merged")
+	}
+}
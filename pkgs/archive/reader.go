@@ -0,0 +1,97 @@
+package archive
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"go_pull/pkgs/model"
+	"io"
+	"path"
+	"strings"
+)
+
+// maxMeta is the size up to which entries are read by ReadMeta: image
+// configs and manifests are much smaller, layers are skipped.
+const maxMeta = 4 << 20
+
+// Meta is what a docker save archive tells of its images without its
+// layers: manifest.json and the image configs it points to.
+type Meta struct {
+	Manifest []model.ManifestItem
+	files    map[string][]byte
+}
+
+// ReadMeta reads the archive r through, keeping manifest.json and the image
+// configs it names. Configs may come before manifest.json, so the small json
+// files are held until it is read; layers, tars or compressed, are not.
+func ReadMeta(r io.Reader) (*Meta, error) {
+	m := &Meta{files: map[string][]byte{}}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := clean(h.Name)
+		if h.Typeflag != tar.TypeReg || h.Size > maxMeta || h.Size == 0 {
+			continue
+		}
+		first := make([]byte, 1)
+		if _, err := io.ReadFull(tr, first); err != nil {
+			return nil, err
+		}
+		if name != "manifest.json" && first[0] != '{' {
+			continue
+		}
+		rest, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		m.files[name] = append(first, rest...)
+	}
+	data, ok := m.files["manifest.json"]
+	if !ok {
+		return nil, fmt.Errorf("no manifest.json, not a docker save archive")
+	}
+	if err := json.Unmarshal(data, &m.Manifest); err != nil {
+		return nil, fmt.Errorf("manifest.json: %v", err)
+	}
+	named := map[string]bool{"manifest.json": true}
+	for _, item := range m.Manifest {
+		named[clean(item.Config)] = true
+	}
+	for name := range m.files {
+		if !named[name] {
+			delete(m.files, name)
+		}
+	}
+	return m, nil
+}
+
+// File returns the content of entry name, manifest.json or a config it names.
+func (m *Meta) File(name string) ([]byte, bool) {
+	data, ok := m.files[clean(name)]
+	return data, ok
+}
+
+// Config returns the image config of an image of the archive and its
+// digest, told by the file name: <hex>.json, or blobs/sha256/<hex> as
+// docker 25 names it.
+func (m *Meta) Config(item model.ManifestItem) (*model.ImageConfig, string, error) {
+	data, ok := m.File(item.Config)
+	if !ok {
+		return nil, "", fmt.Errorf("config %v is not in the archive", item.Config)
+	}
+	c, err := model.ParseImageConfig(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%v: %v", item.Config, err)
+	}
+	return c, "sha256:" + strings.TrimSuffix(path.Base(item.Config), ".json"), nil
+}
+
+func clean(name string) string {
+	return strings.TrimPrefix(path.Clean(name), "/")
+}
@@ -0,0 +1,49 @@
+package archive
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadMeta(t *testing.T) {
+	config := `{"architecture":"arm64","os":"linux","rootfs":{"type":"layers","diff_ids":["sha256:` +
+		strings.Repeat("a", 64) + `"]}}`
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.AddFile("abc/layer.tar", []byte("layer"))
+	w.AddFile("0123.json", []byte(config))
+	w.AddFile("4567.json", []byte(config))
+	w.AddFile("manifest.json", []byte(`[{"Config":"0123.json","RepoTags":["redis:7"],"Layers":["abc/layer.tar"]}]`))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadMeta(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Manifest) != 1 || m.Manifest[0].RepoTags[0] != "redis:7" {
+		t.Fatalf("manifest %+v", m.Manifest)
+	}
+	c, dgst, err := m.Config(m.Manifest[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dgst != "sha256:0123" || c.Architecture != "arm64" {
+		t.Fatalf("config %v %+v", dgst, c)
+	}
+	// small layers and the files manifest.json does not name are not kept
+	for _, name := range []string{"/abc/layer.tar", "4567.json"} {
+		if _, ok := m.File(name); ok {
+			t.Fatalf("%v kept", name)
+		}
+	}
+
+	buf.Reset()
+	w = NewWriter(&buf)
+	w.AddFile("index.json", []byte("{}"))
+	w.Close()
+	if _, err := ReadMeta(&buf); err == nil {
+		t.Fatal("archive without manifest.json accepted")
+	}
+}
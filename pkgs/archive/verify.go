@@ -0,0 +1,371 @@
+package archive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"go_pull/pkgs/layer"
+	"go_pull/pkgs/model"
+	"go_pull/pkgs/store"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// digested is a regular file of an archive as Verify read it.
+type digested struct {
+	size   int64
+	digest string
+	// diffid is the digest of the tar a compressed file holds, digest for
+	// a file that is not compressed
+	diffid string
+	err    error // the file could not be decompressed
+	comp   layer.Compression
+	data   []byte
+}
+
+// Report is what Verify found in an archive.
+type Report struct {
+	Format   string // docker save, OCI layout or both
+	Images   int
+	Layers   int
+	Problems []string
+}
+
+func (rep *Report) problem(format string, a ...interface{}) {
+	rep.Problems = append(rep.Problems, fmt.Sprintf(format, a...))
+}
+
+// contents are the files of an archive by name, with its symlinks.
+type contents struct {
+	files map[string]*digested
+	links map[string]string
+}
+
+// file returns the regular file name, following symlinks.
+func (c *contents) file(name string) (*digested, bool) {
+	name = clean(name)
+	for i := 0; i < 16; i++ {
+		if f, ok := c.files[name]; ok {
+			return f, true
+		}
+		target, ok := c.links[name]
+		if !ok {
+			return nil, false
+		}
+		name = target
+	}
+	return nil, false
+}
+
+// Verify reads the archive r through once and checks the images of its
+// manifest.json, docker save, and of its index.json, OCI layout: every file
+// they reference exists, blobs match their digest and size, and layers the
+// diff_ids of their image config. It only fails when r cannot be read as a
+// tar, the problems found are in the report.
+func Verify(r io.Reader) (*Report, error) {
+	c, err := digestAll(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.verify()
+}
+
+// verify checks the images of the archive c holds.
+func (c *contents) verify() (*Report, error) {
+	rep := &Report{}
+	var formats []string
+	if f, ok := c.file("manifest.json"); ok {
+		formats = append(formats, "docker save")
+		c.verifySave(rep, f.data)
+	}
+	if f, ok := c.file("index.json"); ok {
+		formats = append(formats, "OCI layout")
+		if _, ok := c.file("oci-layout"); !ok {
+			rep.problem("oci-layout: missing")
+		}
+		c.verifyIndex(rep, "index.json", f.data, map[string]bool{})
+	}
+	if len(formats) == 0 {
+		return nil, fmt.Errorf("no manifest.json or index.json, not a docker save archive or OCI layout")
+	}
+	rep.Format = strings.Join(formats, " and ")
+	return rep, nil
+}
+
+// digestAll digests every regular file of the archive r, and the tar of
+// those compressed. With a store, the files that may be blobs are also
+// written into it.
+func digestAll(r io.Reader, s *store.Store) (*contents, error) {
+	c := &contents{files: map[string]*digested{}, links: map[string]string{}}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return c, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := clean(h.Name)
+		switch h.Typeflag {
+		case tar.TypeSymlink:
+			c.links[name] = clean(path.Join(path.Dir(name), h.Linkname))
+		case tar.TypeLink:
+			c.links[name] = clean(h.Linkname)
+		case tar.TypeReg:
+			if err := c.add(name, tr, h.Size, s); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// digestDir is digestAll for a directory, an OCI layout as skopeo and
+// buildah write it or an unpacked archive.
+func digestDir(dir string, s *store.Store) (*contents, error) {
+	c := &contents{files: map[string]*digested{}, links: map[string]string{}}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := clean(filepath.ToSlash(rel))
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			c.links[name] = clean(path.Join(path.Dir(name), filepath.ToSlash(target)))
+		case d.Type().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			info, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			return c.add(name, f, info.Size(), s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// add digests the regular file name of size read from r, and writes it into
+// the store s when it may be a blob.
+func (c *contents) add(name string, r io.Reader, size int64, s *store.Store) error {
+	var f *digested
+	var err error
+	if s != nil && maybeBlob(name) {
+		f, err = ingestFile(s, r, size)
+	} else {
+		f, err = digestFile(r, size)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %w", name, err)
+	}
+	c.files[name] = f
+	return nil
+}
+
+func digestFile(r io.Reader, size int64) (*digested, error) {
+	f := &digested{size: size}
+	h := sha256.New()
+	br := bufio.NewReader(io.TeeReader(r, h))
+	var w io.Writer = io.Discard
+	var kept bytes.Buffer
+	magic, _ := br.Peek(4)
+	if f.comp = layer.Detect(magic); f.comp != layer.Uncompressed {
+		f.diffid, f.err = layer.DiffID(br, f.comp, size)
+	} else if size <= maxMeta {
+		w = &kept
+	}
+	// the rest after the compressed stream, or all of an uncompressed file
+	if _, err := io.Copy(w, br); err != nil {
+		return nil, err
+	}
+	f.digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	if f.diffid == "" && f.err == nil {
+		f.diffid = f.digest
+	}
+	f.data = kept.Bytes()
+	return f, nil
+}
+
+// verifySave checks the images of the manifest.json of a docker save
+// archive.
+func (c *contents) verifySave(rep *Report, data []byte) {
+	var items []model.ManifestItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		rep.problem("manifest.json: %v", err)
+		return
+	}
+	for i, item := range items {
+		rep.Images++
+		image := fmt.Sprintf("image %v", i+1)
+		if len(item.RepoTags) > 0 {
+			image = item.RepoTags[0]
+		}
+		f, ok := c.file(item.Config)
+		if !ok {
+			rep.problem("%v: config %v: missing", image, item.Config)
+			continue
+		}
+		// named <hex>.json, or blobs/sha256/<hex> since docker 25
+		if hexs := strings.TrimSuffix(path.Base(item.Config), ".json"); digest.Digest("sha256:"+hexs).Validate() == nil &&
+			f.digest != "sha256:"+hexs {
+			rep.problem("%v: config %v: its sha256 is %v", image, item.Config, f.digest)
+		}
+		config, err := model.ParseImageConfig(f.data)
+		if err != nil {
+			rep.problem("%v: config %v: %v", image, item.Config, err)
+			continue
+		}
+		diffids := config.RootFS.DiffIDs
+		if len(item.Layers) != len(diffids) {
+			rep.problem("%v: %v layers for %v diff_ids in the config", image, len(item.Layers), len(diffids))
+		}
+		for x, name := range item.Layers {
+			rep.Layers++
+			want := ""
+			if x < len(diffids) {
+				want = diffids[x]
+			}
+			l, ok := c.file(name)
+			if !ok {
+				if _, foreign := item.LayerSources[want]; !foreign || want == "" {
+					rep.problem("%v: layer %v: missing", image, name)
+				}
+				continue
+			}
+			if l.err != nil {
+				rep.problem("%v: layer %v: cannot decompress: %v", image, name, l.err)
+				continue
+			}
+			if want != "" && l.diffid != want {
+				rep.problem("%v: layer %v: diff_id %v, the config has %v", image, name, l.diffid, want)
+			}
+		}
+	}
+}
+
+// verifyIndex checks the manifests of an index, index.json or a nested one,
+// and the blobs they reference. seen avoids checking a manifest twice.
+func (c *contents) verifyIndex(rep *Report, name string, data []byte, seen map[string]bool) {
+	var index model.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		rep.problem("%v: %v", name, err)
+		return
+	}
+	for _, desc := range index.Manifests {
+		if seen[desc.Digest] {
+			continue
+		}
+		seen[desc.Digest] = true
+		f, ok := c.blob(rep, name, desc)
+		if !ok {
+			continue
+		}
+		kind, err := model.Kind(desc.MediaType, f.data)
+		if err != nil {
+			rep.problem("%v: %v", desc.Digest, err)
+			continue
+		}
+		switch kind {
+		case model.MediaTypeManifestList:
+			c.verifyIndex(rep, desc.Digest, f.data, seen)
+		case model.MediaTypeManifest:
+			rep.Images++
+			c.verifyManifest(rep, desc.Digest, f.data)
+		default:
+			rep.problem("%v: unsupported %v", desc.Digest, kind)
+		}
+	}
+}
+
+// verifyManifest checks the config and layers of an image manifest.
+func (c *contents) verifyManifest(rep *Report, name string, data []byte) {
+	m, err := model.ParseManifest(data)
+	if err != nil {
+		rep.problem("%v: %v", name, err)
+		return
+	}
+	var diffids []string
+	if f, ok := c.blob(rep, name, m.Config); ok {
+		config, err := model.ParseImageConfig(f.data)
+		if err != nil {
+			rep.problem("%v: config %v: %v", name, m.Config.Digest, err)
+		} else {
+			diffids = config.RootFS.DiffIDs
+		}
+	}
+	if diffids != nil && len(diffids) != len(m.Layers) {
+		rep.problem("%v: %v layers for %v diff_ids in the config", name, len(m.Layers), len(diffids))
+	}
+	for x, desc := range m.Layers {
+		rep.Layers++
+		if _, ok := c.file(blobPath(desc.Digest)); !ok && desc.Foreign() {
+			continue
+		}
+		f, ok := c.blob(rep, name, desc)
+		if !ok {
+			continue
+		}
+		if f.err != nil {
+			rep.problem("%v: layer %v: cannot decompress: %v", name, desc.Digest, f.err)
+			continue
+		}
+		if x < len(diffids) && f.diffid != diffids[x] {
+			rep.problem("%v: layer %v: diff_id %v, the config has %v", name, desc.Digest, f.diffid, diffids[x])
+		}
+	}
+}
+
+// blob returns the blob of desc, referenced by from, when it is in the
+// archive and matches desc.
+func (c *contents) blob(rep *Report, from string, desc model.Descriptor) (*digested, bool) {
+	if err := desc.Validate(); err != nil {
+		rep.problem("%v: %v", from, err)
+		return nil, false
+	}
+	p := blobPath(desc.Digest)
+	f, ok := c.file(p)
+	if !ok {
+		rep.problem("%v: %v: missing", from, p)
+		return nil, false
+	}
+	if f.size != desc.Size {
+		rep.problem("%v: %v: %v bytes, the descriptor has %v", from, p, f.size, desc.Size)
+		return nil, false
+	}
+	if f.digest != desc.Digest {
+		rep.problem("%v: %v: its sha256 is %v", from, p, f.digest)
+		return nil, false
+	}
+	return f, true
+}
+
+// blobPath is where an OCI layout keeps the blob of dgst.
+func blobPath(dgst string) string {
+	algo, hexs, _ := strings.Cut(dgst, ":")
+	return path.Join("blobs", algo, hexs)
+}
@@ -0,0 +1,97 @@
+package archive
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func gz(data string) []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte(data))
+	w.Close()
+	return b.Bytes()
+}
+
+func config(diffids ...string) string {
+	return `{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":["` +
+		strings.Join(diffids, `","`) + `"]}}`
+}
+
+func TestVerifySave(t *testing.T) {
+	base, app := "base layer", "app layer"
+	c := config(digest.FromString(base).String(), digest.FromString(app).String(), digest.FromString(base).String())
+	cdgst := digest.FromString(c)
+	save := func(layer []byte, withConfig bool) *Report {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		if withConfig {
+			w.AddFile(cdgst.Encoded()+".json", []byte(c))
+		}
+		w.AddFile("a/layer.tar", []byte(base))
+		w.AddFile("b/layer.tar", layer)
+		w.Symlink("c/layer.tar", "../a/layer.tar")
+		w.AddFile("manifest.json", []byte(`[{"Config":"`+cdgst.Encoded()+`.json","RepoTags":["app:1"],`+
+			`"Layers":["a/layer.tar","b/layer.tar","c/layer.tar"]}]`))
+		w.Close()
+		rep, err := Verify(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rep
+	}
+	// layers are checked compressed or not
+	for _, layer := range [][]byte{[]byte(app), gz(app)} {
+		if rep := save(layer, true); len(rep.Problems) != 0 || rep.Images != 1 || rep.Layers != 3 || rep.Format != "docker save" {
+			t.Fatalf("intact archive: %+v", rep)
+		}
+	}
+	if rep := save(gz("app layeR"), true); len(rep.Problems) != 1 || !strings.Contains(rep.Problems[0], "b/layer.tar: diff_id") {
+		t.Fatalf("changed layer: %v", rep.Problems)
+	}
+	if rep := save([]byte(app), false); len(rep.Problems) != 1 || !strings.Contains(rep.Problems[0], "missing") {
+		t.Fatalf("missing config: %v", rep.Problems)
+	}
+	if _, err := Verify(bytes.NewReader(nil)); err == nil {
+		t.Fatal("empty archive accepted")
+	}
+}
+
+func TestVerifyOCI(t *testing.T) {
+	layer := gz("layer")
+	c := config(digest.FromString("layer").String())
+	manifest := fmt.Sprintf(`{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+		`"config":{"mediaType":"application/vnd.oci.image.config.v1+json","digest":"%v","size":%v},`+
+		`"layers":[{"mediaType":"application/vnd.oci.image.layer.v1.tar+gzip","digest":"%v","size":%v}]}`,
+		digest.FromString(c), len(c), digest.FromBytes(layer), len(layer))
+	index := fmt.Sprintf(`{"schemaVersion":2,"manifests":[{"mediaType":"application/vnd.oci.image.manifest.v1+json",`+
+		`"digest":"%v","size":%v}]}`, digest.FromString(manifest), len(manifest))
+	oci := func(layerdata []byte) *Report {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.AddFile("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+		w.AddFile(blobPath(digest.FromString(c).String()), []byte(c))
+		w.AddFile(blobPath(digest.FromBytes(layer).String()), layerdata)
+		w.AddFile(blobPath(digest.FromString(manifest).String()), []byte(manifest))
+		w.AddFile("index.json", []byte(index))
+		w.Close()
+		rep, err := Verify(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rep
+	}
+	if rep := oci(layer); len(rep.Problems) != 0 || rep.Images != 1 || rep.Layers != 1 || rep.Format != "OCI layout" {
+		t.Fatalf("intact layout: %+v", rep)
+	}
+	damaged := append([]byte{}, layer...)
+	damaged[len(damaged)-5] ^= 1
+	if rep := oci(damaged); len(rep.Problems) != 1 || !strings.Contains(rep.Problems[0], "its sha256 is") {
+		t.Fatalf("damaged blob: %v", rep.Problems)
+	}
+}
@@ -0,0 +1,120 @@
+// Package archive writes image archives as a single tar stream. Entries are
+// emitted as soon as their content is available, so an image never has to
+// be staged on disk before it is packed.
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// Writer emits tar entries in the order they are added. The parent
+// directories of an entry are written before it, once.
+type Writer struct {
+	ModTime time.Time // modification time of every entry
+
+	tw      *tar.Writer
+	entries map[string]bool
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		ModTime: time.Now(),
+		tw:      tar.NewWriter(w),
+		entries: map[string]bool{},
+	}
+}
+
+// Has reports whether an entry called name was already written.
+func (w *Writer) Has(name string) bool {
+	return w.entries[name]
+}
+
+// AddFile writes a small file held in memory.
+func (w *Writer) AddFile(name string, data []byte) error {
+	fw, err := w.Create(name, int64(len(data)))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, bytes.NewReader(data))
+	return err
+}
+
+// Create starts a file entry of exactly size bytes and returns the writer
+// for its content. The content may be written in several calls, but must be
+// complete before the next entry is created or the archive is closed.
+func (w *Writer) Create(name string, size int64) (io.Writer, error) {
+	name = clean(name)
+	if w.entries[name] {
+		return nil, fmt.Errorf("archive: duplicate entry %v", name)
+	}
+	if err := w.mkdir(path.Dir(name)); err != nil {
+		return nil, err
+	}
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  w.ModTime,
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.entries[name] = true
+	return w.tw, nil
+}
+
+// Symlink adds a symbolic link called name pointing to target, relative to
+// the directory of name.
+func (w *Writer) Symlink(name string, target string) error {
+	name = clean(name)
+	if w.entries[name] {
+		return fmt.Errorf("archive: duplicate entry %v", name)
+	}
+	if err := w.mkdir(path.Dir(name)); err != nil {
+		return err
+	}
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     name,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  w.ModTime,
+	})
+	if err != nil {
+		return err
+	}
+	w.entries[name] = true
+	return nil
+}
+
+func (w *Writer) mkdir(dir string) error {
+	if dir == "." || dir == "/" || w.entries[dir+"/"] {
+		return nil
+	}
+	if err := w.mkdir(path.Dir(dir)); err != nil {
+		return err
+	}
+	err := w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     dir + "/",
+		Mode:     0755,
+		ModTime:  w.ModTime,
+	})
+	if err != nil {
+		return err
+	}
+	w.entries[dir+"/"] = true
+	return nil
+}
+
+// Close finishes the archive. It fails if the last entry is incomplete. The
+// underlying writer is not closed.
+func (w *Writer) Close() error {
+	return w.tw.Close()
+}
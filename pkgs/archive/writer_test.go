@@ -0,0 +1,78 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.AddFile("manifest.json", []byte("[]")); err != nil {
+		t.Fatal(err)
+	}
+	// a layer streamed in two parts, as after a resumed download
+	fw, err := w.Create("abc/layer.tar", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, "01234")
+	io.WriteString(fw, "56789")
+	if err := w.AddFile("abc/VERSION", []byte("1.0")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Create("abc/VERSION", 3); err == nil {
+		t.Fatal("duplicate entry accepted")
+	}
+	if err := w.Symlink("def/layer.tar", "../abc/layer.tar"); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Has("abc/layer.tar") || w.Has("abc/json") {
+		t.Fatal("Has does not match the written entries")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"manifest.json=[]", "abc/", "abc/layer.tar=0123456789", "abc/VERSION=1.0",
+		"def/", "def/layer.tar->../abc/layer.tar"}
+	var got []string
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeDir {
+			got = append(got, h.Name)
+			continue
+		}
+		if h.Typeflag == tar.TypeSymlink {
+			got = append(got, h.Name+"->"+h.Linkname)
+			continue
+		}
+		b, _ := io.ReadAll(tr)
+		got = append(got, h.Name+"="+string(b))
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("entries %v, want %v", got, want)
+	}
+}
+
+func TestWriterShortEntry(t *testing.T) {
+	w := NewWriter(io.Discard)
+	fw, err := w.Create("layer.tar", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(fw, "short")
+	if err := w.Close(); err == nil {
+		t.Fatal("incomplete entry not reported")
+	}
+}
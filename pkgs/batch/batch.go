@@ -0,0 +1,109 @@
+// Package batch reads the image lists of download -f: a yaml file of
+// entries, or plain text with one reference per line.
+package batch
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Entry is an image of the list.
+type Entry struct {
+	Image string `yaml:"image"`
+	// Platforms are downloaded one archive each, none uses --platform.
+	Platforms []string `yaml:"platforms,omitempty"`
+	// Name is the archive file name template, "" uses --name.
+	Name string `yaml:"name,omitempty"`
+	// Tag is the name:tag the image is saved as, "" keeps the pulled one.
+	Tag string `yaml:"tag,omitempty"`
+}
+
+// UnmarshalYAML takes an entry or just its image.
+func (e *Entry) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		e.Image = n.Value
+		return nil
+	}
+	type entry Entry
+	return n.Decode((*entry)(e))
+}
+
+// List is an image list. Platforms applies to the entries without any.
+type List struct {
+	Platforms []string `yaml:"platforms,omitempty"`
+	Images    []Entry  `yaml:"images"`
+}
+
+// Job is the download of one platform of an entry.
+type Job struct {
+	Entry
+	Platform string // "" uses --platform
+}
+
+func (j Job) String() string {
+	if j.Platform == "" {
+		return j.Image
+	}
+	return j.Image + " " + j.Platform
+}
+
+// Parse reads the list in data, read from file name: yaml when name ends in
+// .yaml or .yml, text otherwise.
+func Parse(name string, data []byte) (*List, error) {
+	l := &List{}
+	switch filepath.Ext(name) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, l); err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+	default:
+		s := bufio.NewScanner(bytes.NewReader(data))
+		for s.Scan() {
+			line, _, _ := strings.Cut(s.Text(), "#")
+			if line = strings.TrimSpace(line); line != "" {
+				l.Images = append(l.Images, Entry{Image: line})
+			}
+		}
+		if err := s.Err(); err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+	}
+	for i, e := range l.Images {
+		if e.Image == "" {
+			return nil, fmt.Errorf("%v: entry %v has no image", name, i+1)
+		}
+	}
+	if len(l.Images) == 0 {
+		return nil, fmt.Errorf("%v: no images", name)
+	}
+	return l, nil
+}
+
+// Jobs lists the downloads of the list, one per entry and platform. An
+// entry with several platforms and no name gets one with the platform in it,
+// so that its archives do not overwrite each other.
+func (l *List) Jobs() []Job {
+	var jobs []Job
+	for _, e := range l.Images {
+		platforms := e.Platforms
+		if len(platforms) == 0 {
+			platforms = l.Platforms
+		}
+		if len(platforms) == 0 {
+			jobs = append(jobs, Job{Entry: e})
+			continue
+		}
+		if len(platforms) > 1 && e.Name == "" {
+			e.Name = "{{.Name}}_{{.Platform}}.tar"
+		}
+		for _, p := range platforms {
+			jobs = append(jobs, Job{Entry: e, Platform: p})
+		}
+	}
+	return jobs
+}
@@ -0,0 +1,84 @@
+package batch
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseText(t *testing.T) {
+	l, err := Parse("images.txt", []byte("# base images\nredis:7\n\n  alpine  # latest\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Job{{Entry: Entry{Image: "redis:7"}}, {Entry: Entry{Image: "alpine"}}}
+	if got := l.Jobs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("jobs %+v", got)
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	l, err := Parse("images.yaml", []byte(`
+platforms: [linux/amd64]
+images:
+  - redis:7
+  - image: nginx:1.25
+    platforms: [linux/amd64, linux/arm64]
+    tag: mirror.example.com/nginx:1.25
+  - image: alpine
+    name: base.tar
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nginx := Entry{Image: "nginx:1.25", Platforms: []string{"linux/amd64", "linux/arm64"},
+		Name: "{{.Name}}_{{.Platform}}.tar", Tag: "mirror.example.com/nginx:1.25"}
+	want := []Job{
+		{Entry{Image: "redis:7"}, "linux/amd64"},
+		{nginx, "linux/amd64"},
+		{nginx, "linux/arm64"},
+		{Entry{Image: "alpine", Name: "base.tar"}, "linux/amd64"},
+	}
+	if got := l.Jobs(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("jobs %+v", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for name, data := range map[string]string{
+		"empty.txt":   "# nothing\n",
+		"bad.yaml":    "images: redis\n",
+		"noimage.yml": "images:\n  - tag: a:b\n",
+	} {
+		if _, err := Parse(name, []byte(data)); err == nil {
+			t.Errorf("%v accepted", name)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	if p := LockPath("lists/images.yaml"); p != "lists/images.lock" {
+		t.Fatalf("LockPath %v", p)
+	}
+	lock := &Lock{Images: []Locked{{Image: "redis:7", Platform: "linux/arm64",
+		Ref: "registry-1.docker.io/library/redis:7@sha256:00", Digest: "sha256:00"}}}
+	data, err := lock.Encode("written by a test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseLock("images.lock", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, lock) {
+		t.Fatalf("lock %+v", got)
+	}
+	if e, ok := got.Find("redis:7", "linux/arm64"); !ok || e.Digest != "sha256:00" {
+		t.Fatal("locked image not found")
+	}
+	if _, ok := got.Find("redis:7", "linux/amd64"); ok {
+		t.Fatal("found for another platform")
+	}
+	if _, err := ParseLock("bad.lock", []byte("images:\n  - image: redis:7\n")); err == nil {
+		t.Fatal("entry without digest accepted")
+	}
+}
@@ -0,0 +1,68 @@
+package batch
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Lock pins the images of a list to the digests of their platform
+// manifests, so that a list downloads the same images when its tags moved.
+type Lock struct {
+	Images []Locked `yaml:"images"`
+}
+
+// Locked is the digest an image of the list resolved to for a platform.
+type Locked struct {
+	Image    string `yaml:"image"`
+	Platform string `yaml:"platform"`
+	// Ref is the image pinned to Digest, as it is pulled.
+	Ref    string `yaml:"ref"`
+	Digest string `yaml:"digest"`
+}
+
+// LockPath is the lockfile of list file name: name with the extension .lock.
+func LockPath(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".lock"
+}
+
+// ParseLock reads a lockfile.
+func ParseLock(name string, data []byte) (*Lock, error) {
+	l := &Lock{}
+	if err := yaml.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("%v: %v", name, err)
+	}
+	for i, e := range l.Images {
+		if e.Image == "" || e.Ref == "" || e.Digest == "" {
+			return nil, fmt.Errorf("%v: entry %v needs image, ref and digest", name, i+1)
+		}
+	}
+	return l, nil
+}
+
+// Find returns the entry of image for platform.
+func (l *Lock) Find(image string, platform string) (Locked, bool) {
+	for _, e := range l.Images {
+		if e.Image == image && e.Platform == platform {
+			return e, true
+		}
+	}
+	return Locked{}, false
+}
+
+// Encode writes the lockfile, header a comment put first.
+func (l *Lock) Encode(header string) ([]byte, error) {
+	var b bytes.Buffer
+	for _, line := range strings.Split(header, "\n") {
+		fmt.Fprintf(&b, "# %v\n", line)
+	}
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(l); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
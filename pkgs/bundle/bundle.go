@@ -0,0 +1,383 @@
+// Package bundle moves image archives across an air gap as deltas. A bundle
+// holds the files of the archives the other side does not have yet, named by
+// digest, and the recipe to rebuild every archive from them. An index lists
+// the digests the other side has once a bundle is applied, so that the next
+// bundle leaves them out.
+package bundle
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go_pull/pkgs/archive"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/store"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// RecipeName is the entry of a bundle holding its recipe.
+const RecipeName = "bundle.json"
+
+// Recipe tells how to rebuild the archives of a bundle.
+type Recipe struct {
+	Archives []Archive `json:"archives"`
+	// Blobs are the digests of the files the bundle holds.
+	Blobs []string `json:"blobs"`
+}
+
+// Archive is an archive of the bundle, its entries in order.
+type Archive struct {
+	Name    string  `json:"name"`
+	Entries []Entry `json:"entries"`
+}
+
+// Entry is a tar entry of an archive. Files are found by Digest, in the
+// bundle or among the blobs of earlier ones. The rest of the header is kept
+// too, so that the archive is rebuilt byte for byte.
+type Entry struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"` // file, dir, symlink or hardlink
+	Mode    int64  `json:"mode"`
+	ModTime int64  `json:"mtime"`
+	Size    int64  `json:"size,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+	Link    string `json:"link,omitempty"` // target of a symlink or hardlink
+
+	MTimeNsec  int64             `json:"mtime_nsec,omitempty"`
+	AccessTime *time.Time        `json:"atime,omitempty"`
+	ChangeTime *time.Time        `json:"ctime,omitempty"`
+	UID        int               `json:"uid,omitempty"`
+	GID        int               `json:"gid,omitempty"`
+	Uname      string            `json:"uname,omitempty"`
+	Gname      string            `json:"gname,omitempty"`
+	PAX        map[string]string `json:"pax,omitempty"` // PAX records
+	Format     tar.Format        `json:"format,omitempty"`
+}
+
+// entryTypes are the tar entry types of Entry.Type.
+var entryTypes = map[string]byte{
+	"file":     tar.TypeReg,
+	"dir":      tar.TypeDir,
+	"symlink":  tar.TypeSymlink,
+	"hardlink": tar.TypeLink,
+}
+
+// newEntry records the header h.
+func newEntry(h *tar.Header) (Entry, error) {
+	e := Entry{
+		Name: h.Name, Mode: h.Mode, ModTime: h.ModTime.Unix(), MTimeNsec: int64(h.ModTime.Nanosecond()),
+		UID: h.Uid, GID: h.Gid, Uname: h.Uname, Gname: h.Gname, PAX: h.PAXRecords, Format: h.Format,
+	}
+	if !h.AccessTime.IsZero() {
+		e.AccessTime = &h.AccessTime
+	}
+	if !h.ChangeTime.IsZero() {
+		e.ChangeTime = &h.ChangeTime
+	}
+	for name, flag := range entryTypes {
+		if h.Typeflag == flag {
+			e.Type = name
+		}
+	}
+	switch e.Type {
+	case "":
+		return e, fmt.Errorf("%v: unsupported entry type %c", h.Name, h.Typeflag)
+	case "symlink", "hardlink":
+		e.Link = h.Linkname
+	case "file":
+		e.Size = h.Size
+	}
+	return e, nil
+}
+
+// header is the tar header e records.
+func (e Entry) header() (*tar.Header, error) {
+	flag, ok := entryTypes[e.Type]
+	if !ok {
+		return nil, fmt.Errorf("%v: unknown entry type %q", e.Name, e.Type)
+	}
+	h := &tar.Header{
+		Typeflag: flag, Name: e.Name, Linkname: e.Link, Size: e.Size, Mode: e.Mode,
+		ModTime: time.Unix(e.ModTime, e.MTimeNsec), Uid: e.UID, Gid: e.GID, Uname: e.Uname, Gname: e.Gname,
+		PAXRecords: e.PAX, Format: e.Format,
+	}
+	if e.AccessTime != nil {
+		h.AccessTime = *e.AccessTime
+	}
+	if e.ChangeTime != nil {
+		h.ChangeTime = *e.ChangeTime
+	}
+	return h, nil
+}
+
+// Index is a set of digests the other side has.
+type Index map[string]bool
+
+// ReadIndex reads an index: one digest per line.
+func ReadIndex(r io.Reader) (Index, error) {
+	idx := Index{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := digest.Parse(line); err != nil {
+			return nil, fmt.Errorf("index: %v", err)
+		}
+		idx[line] = true
+	}
+	return idx, s.Err()
+}
+
+// Write writes the digests of idx sorted, one per line.
+func (idx Index) Write(w io.Writer) error {
+	var list []string
+	for d := range idx {
+		list = append(list, d)
+	}
+	sort.Strings(list)
+	bw := bufio.NewWriter(w)
+	for _, d := range list {
+		fmt.Fprintln(bw, d)
+	}
+	return bw.Flush()
+}
+
+// blobName is the entry of the blob of dgst in a bundle.
+func blobName(dgst string) string {
+	algo, hex, _ := strings.Cut(dgst, ":")
+	return path.Join("blobs", algo, hex)
+}
+
+// Build writes the bundle of the archives of paths to w: the files whose
+// digest have does not list, and the recipe. It returns the index of the
+// other side once the bundle is applied, have and every digest of the
+// archives. Every archive is read twice, first to digest its files.
+// Archives are rebuilt under their file name, two of the same name are an
+// error.
+func Build(w io.Writer, paths []string, have Index) (Index, error) {
+	recipe := &Recipe{}
+	next := Index{}
+	for d := range have {
+		next[d] = true
+	}
+	names := map[string]string{}
+	for _, p := range paths {
+		if other, ok := names[filepath.Base(p)]; ok {
+			return nil, errdefs.Errorf(errdefs.Usage, "%v and %v would both be rebuilt as %v", other, p, filepath.Base(p))
+		}
+		names[filepath.Base(p)] = p
+	}
+	for _, p := range paths {
+		a, err := scan(p)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", p, err)
+		}
+		recipe.Archives = append(recipe.Archives, a)
+	}
+	aw := archive.NewWriter(w)
+	for i, p := range paths {
+		if err := copyBlobs(aw, p, recipe.Archives[i], have, recipe); err != nil {
+			return nil, fmt.Errorf("%v: %w", p, err)
+		}
+		for _, e := range recipe.Archives[i].Entries {
+			if e.Digest != "" {
+				next[e.Digest] = true
+			}
+		}
+	}
+	aw.ModTime = time.Unix(0, 0)
+	data, err := json.Marshal(recipe)
+	if err != nil {
+		return nil, err
+	}
+	if err := aw.AddFile(RecipeName, append(data, '\n')); err != nil {
+		return nil, err
+	}
+	return next, aw.Close()
+}
+
+// scan lists the entries of the archive p with the digests of its files.
+func scan(p string) (Archive, error) {
+	a := Archive{Name: filepath.Base(p)}
+	f, err := os.Open(p)
+	if err != nil {
+		return a, err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			return a, err
+		}
+		e, err := newEntry(h)
+		if err != nil {
+			return a, err
+		}
+		if e.Type == "file" {
+			d, err := digest.SHA256.FromReader(tr)
+			if err != nil {
+				return a, err
+			}
+			e.Digest = d.String()
+		}
+		a.Entries = append(a.Entries, e)
+	}
+}
+
+// copyBlobs adds the files of the archive p that have lacks to the bundle,
+// once each.
+func copyBlobs(aw *archive.Writer, p string, a Archive, have Index, recipe *Recipe) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	tr := tar.NewReader(f)
+	for _, e := range a.Entries {
+		h, err := tr.Next()
+		if err != nil {
+			return fmt.Errorf("changed while bundled: %v", err)
+		}
+		if h.Name != e.Name {
+			return fmt.Errorf("changed while bundled: %v instead of %v", h.Name, e.Name)
+		}
+		if e.Digest == "" || have[e.Digest] || aw.Has(blobName(e.Digest)) {
+			continue
+		}
+		aw.ModTime = h.ModTime
+		bw, err := aw.Create(blobName(e.Digest), e.Size)
+		if err != nil {
+			return err
+		}
+		v := digest.Digest(e.Digest).Verifier()
+		if _, err := io.Copy(io.MultiWriter(bw, v), tr); err != nil {
+			return err
+		}
+		if !v.Verified() {
+			return errdefs.Errorf(errdefs.DigestMismatch, "%v changed while bundled", e.Name)
+		}
+		recipe.Blobs = append(recipe.Blobs, e.Digest)
+	}
+	return nil
+}
+
+// Apply stores the blobs of the bundle r in s, checking their digests, and
+// returns its recipe. It fails when a file of the recipe is neither in the
+// bundle nor in s.
+func Apply(r io.Reader, s *store.Store) (*Recipe, error) {
+	var recipe *Recipe
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean(h.Name), "/")
+		if name == RecipeName {
+			recipe = &Recipe{}
+			if err := json.NewDecoder(tr).Decode(recipe); err != nil {
+				return nil, fmt.Errorf("%v: %v", RecipeName, err)
+			}
+			continue
+		}
+		rest, ok := strings.CutPrefix(name, "blobs/")
+		if !ok || h.Typeflag != tar.TypeReg {
+			continue
+		}
+		dgst := strings.Replace(rest, "/", ":", 1)
+		if _, ok := s.Has(dgst); ok {
+			continue
+		}
+		b, err := s.Create(dgst)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(b, tr); err != nil {
+			b.Abort()
+			return nil, err
+		}
+		if err := b.Commit(); err != nil {
+			return nil, fmt.Errorf("%v: %w", name, err)
+		}
+		b.Close()
+	}
+	if recipe == nil {
+		return nil, fmt.Errorf("no %v, not a bundle", RecipeName)
+	}
+	var missing []string
+	seen := map[string]bool{}
+	for _, a := range recipe.Archives {
+		for _, e := range a.Entries {
+			if e.Digest == "" || seen[e.Digest] {
+				continue
+			}
+			seen[e.Digest] = true
+			if _, ok := s.Has(e.Digest); !ok {
+				missing = append(missing, e.Digest)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errdefs.Errorf(errdefs.NotFound,
+			"%v files are neither in the bundle nor in %v, apply the bundles it was made --since first: %v",
+			len(missing), s.Root, strings.Join(missing, " "))
+	}
+	return recipe, nil
+}
+
+// Rebuild writes the archive a from the blobs of s, checking every file
+// against its digest.
+func Rebuild(w io.Writer, a Archive, s *store.Store) error {
+	tw := tar.NewWriter(w)
+	for _, e := range a.Entries {
+		h, err := e.header()
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if e.Type != "file" {
+			continue
+		}
+		if err := copyBlob(tw, e, s); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func copyBlob(w io.Writer, e Entry, s *store.Store) error {
+	f, err := s.Open(e.Digest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v := digest.Digest(e.Digest).Verifier()
+	n, err := io.Copy(io.MultiWriter(w, v), f)
+	if err != nil {
+		return err
+	}
+	if n != e.Size || !v.Verified() {
+		return errdefs.Errorf(errdefs.DigestMismatch, "%v: blob %v in the store does not match its digest", e.Name, e.Digest)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"go_pull/pkgs/archive"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/store"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// image writes an archive holding files, name=content, and a link.
+func image(t *testing.T, dir string, name string, files ...string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := archive.NewWriter(&buf)
+	for _, f := range files {
+		n, content, _ := strings.Cut(f, "=")
+		if err := w.AddFile(n, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Symlink("link/layer.tar", "../base/layer.tar")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// entries lists the entries of a tar with their content.
+func entries(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	var got []string
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(tr)
+		got = append(got, h.Name+"="+string(b)+h.Linkname)
+	}
+}
+
+func TestDelta(t *testing.T) {
+	dir := t.TempDir()
+	v1 := image(t, dir, "app.tar", "base/layer.tar=base", "v1/layer.tar=one", "manifest.json=[1]")
+	var full bytes.Buffer
+	idx, err := Build(&full, []string{v1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ib bytes.Buffer
+	idx.Write(&ib)
+	if idx, err = ReadIndex(&ib); err != nil || len(idx) != 3 {
+		t.Fatalf("index %v %v", idx, err)
+	}
+
+	v2 := image(t, filepath.Join(dir), "app2.tar", "base/layer.tar=base", "v2/layer.tar=two", "manifest.json=[2]")
+	var delta bytes.Buffer
+	if _, err := Build(&delta, []string{v2}, idx); err != nil {
+		t.Fatal(err)
+	}
+	var blobs []string
+	for _, e := range entries(t, bytes.NewReader(delta.Bytes())) {
+		if strings.HasPrefix(e, "blobs/sha256/") && !strings.HasSuffix(e, "/=") {
+			blobs = append(blobs, e[strings.Index(e, "=")+1:])
+		}
+	}
+	if want := []string{"two", "[2]"}; !reflect.DeepEqual(blobs, want) {
+		t.Fatalf("delta holds %v, want %v", blobs, want)
+	}
+	// two archives of one name would overwrite each other on apply
+	os.Mkdir(filepath.Join(dir, "b"), 0755)
+	other := image(t, filepath.Join(dir, "b"), "app.tar", "manifest.json=[3]")
+	if _, err := Build(io.Discard, []string{v1, other}, nil); errdefs.KindOf(err) != errdefs.Usage {
+		t.Fatalf("archives of one name bundled: %v", err)
+	}
+
+	// the delta alone lacks the base layer
+	empty, _ := store.Open(t.TempDir())
+	if _, err := Apply(bytes.NewReader(delta.Bytes()), empty); errdefs.KindOf(err) != errdefs.NotFound {
+		t.Fatalf("delta applied without its base: %v", err)
+	}
+
+	s, _ := store.Open(t.TempDir())
+	if _, err := Apply(&full, s); err != nil {
+		t.Fatal(err)
+	}
+	recipe, err := Apply(&delta, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rebuilt bytes.Buffer
+	if err := Rebuild(&rebuilt, recipe.Archives[0], s); err != nil {
+		t.Fatal(err)
+	}
+	if orig, _ := os.ReadFile(v2); !bytes.Equal(rebuilt.Bytes(), orig) {
+		t.Fatalf("rebuilt %v, want %v", entries(t, &rebuilt), entries(t, bytes.NewReader(orig)))
+	}
+
+	// a blob damaged in the store is caught
+	for _, e := range recipe.Archives[0].Entries {
+		if e.Name == "v2/layer.tar" {
+			os.WriteFile(s.Path(e.Digest), []byte("tw0"), 0644)
+		}
+	}
+	if err := Rebuild(io.Discard, recipe.Archives[0], s); errdefs.KindOf(err) != errdefs.DigestMismatch {
+		t.Fatalf("damaged blob not reported: %v", err)
+	}
+}
+
+func TestRebuildHeaders(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	mtime := time.Date(2024, 5, 1, 10, 20, 30, 123456789, time.UTC)
+	for _, h := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755, ModTime: mtime.Truncate(time.Second), Uid: 0, Gid: 0,
+			Uname: "root", Gname: "root", Format: tar.FormatUSTAR},
+		{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0644, Size: 4, ModTime: mtime, Uid: 1000, Gid: 100,
+			Uname: "build", Gname: "users", AccessTime: mtime, ChangeTime: mtime,
+			PAXRecords: map[string]string{"SCHILY.xattr.user.origin": "bundle"}, Format: tar.FormatPAX},
+		{Typeflag: tar.TypeLink, Name: "etc/passwd-", Linkname: "etc/passwd", Mode: 0644, ModTime: mtime.Truncate(time.Second)},
+		{Typeflag: tar.TypeSymlink, Name: "etc/" + strings.Repeat("long", 30), Linkname: "passwd", Mode: 0777,
+			ModTime: mtime.Truncate(time.Second), AccessTime: mtime.Truncate(time.Second), Format: tar.FormatGNU},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Size > 0 {
+			tw.Write([]byte("root"))
+		}
+	}
+	tw.Close()
+	dir := t.TempDir()
+	p := filepath.Join(dir, "rootfs.tar")
+	os.WriteFile(p, buf.Bytes(), 0644)
+
+	var b bytes.Buffer
+	if _, err := Build(&b, []string{p}, nil); err != nil {
+		t.Fatal(err)
+	}
+	s, _ := store.Open(t.TempDir())
+	recipe, err := Apply(&b, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rebuilt bytes.Buffer
+	if err := Rebuild(&rebuilt, recipe.Archives[0], s); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt.Bytes(), buf.Bytes()) {
+		t.Fatalf("rebuilt archive differs:\n%q\n%q", rebuilt.Bytes(), buf.Bytes())
+	}
+}
@@ -0,0 +1,274 @@
+// Package config reads the defaults of gopull and the settings of the
+// registries it pulls from. /etc/gopull/config.yaml is read first, then
+// ~/.config/gopull/config.yaml, then GOPULL_* environment variables; each
+// one overrides what the ones before set, and flags override them all.
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the defaults of the flags, named like the flags, and the
+// settings of registries by host.
+type Config struct {
+	Platform   string `yaml:"platform,omitempty"`
+	Output     string `yaml:"output,omitempty"`
+	Name       string `yaml:"name,omitempty"`
+	Cache      string `yaml:"cache,omitempty"`
+	Tmpdir     string `yaml:"tmpdir,omitempty"`
+	Parallel   int    `yaml:"parallel,omitempty"`
+	Recompress string `yaml:"recompress,omitempty"`
+	Timeout    int    `yaml:"timeout,omitempty"`
+	IOTimeout  int    `yaml:"iotimeout,omitempty"`
+	Retry      *int   `yaml:"retry,omitempty"`
+	Level      string `yaml:"level,omitempty"`
+	LogFormat  string `yaml:"log-format,omitempty"`
+
+	Registries map[string]Registry `yaml:"registries,omitempty"`
+
+	// Files are the files the config was read from.
+	Files []string `yaml:"-"`
+}
+
+// Registry are the settings of a registry.
+type Registry struct {
+	// Mirrors are hosts tried in order before the registry itself.
+	Mirrors []string `yaml:"mirrors,omitempty"`
+	// CA is a PEM file of the certificates the registry is verified with.
+	CA string `yaml:"ca,omitempty"`
+	// Insecure talks https to the registry without verifying its
+	// certificate, or plain http when it does not answer https. Registries
+	// are verified otherwise.
+	Insecure bool `yaml:"insecure,omitempty"`
+	// Parallel is how many layers are downloaded at once from it.
+	Parallel int `yaml:"parallel,omitempty"`
+	// Username and Password, or Auth, the base64 of username:password as
+	// in docker's config.json, log in to the registry.
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Auth     string `yaml:"auth,omitempty"`
+}
+
+// EnvPrefix starts the environment variables of the settings, GOPULL_ and
+// the name of the setting in capitals, - as _: GOPULL_LOG_FORMAT.
+const EnvPrefix = "GOPULL_"
+
+// Paths are the config files read when they exist, lowest priority first.
+// GOPULL_CONFIG replaces the file of the user.
+func Paths() []string {
+	paths := []string{"/etc/gopull/config.yaml"}
+	if p := os.Getenv(EnvPrefix + "CONFIG"); p != "" {
+		return append(paths, p)
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(dir, "gopull", "config.yaml"))
+	}
+	return paths
+}
+
+// Load reads the files of paths that exist, then the environment.
+func Load(paths []string, environ []string) (*Config, error) {
+	c := &Config{}
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var f Config
+		if err := yaml.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("%v: %v", p, err)
+		}
+		c.merge(&f)
+		c.Files = append(c.Files, p)
+	}
+	if err := c.env(environ); err != nil {
+		return nil, err
+	}
+	for _, p := range []*string{&c.Output, &c.Cache, &c.Tmpdir} {
+		*p = home(*p)
+	}
+	for host, r := range c.Registries {
+		r.CA = home(r.CA)
+		c.Registries[host] = r
+	}
+	return c, nil
+}
+
+// home expands a path starting with ~/, as the shell does for flags.
+func home(p string) string {
+	rest, ok := strings.CutPrefix(p, "~/")
+	if !ok {
+		return p
+	}
+	dir, err := os.UserHomeDir()
+	if err != nil {
+		return p
+	}
+	return filepath.Join(dir, rest)
+}
+
+// merge sets what f sets. Registries are merged setting by setting.
+func (c *Config) merge(f *Config) {
+	cv, fv := reflect.ValueOf(c).Elem(), reflect.ValueOf(f).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		if key(cv.Type().Field(i)) != "" && !fv.Field(i).IsZero() {
+			cv.Field(i).Set(fv.Field(i))
+		}
+	}
+	for host, r := range f.Registries {
+		if c.Registries == nil {
+			c.Registries = map[string]Registry{}
+		}
+		old := c.Registries[host]
+		ov, rv := reflect.ValueOf(&old).Elem(), reflect.ValueOf(r)
+		for i := 0; i < ov.NumField(); i++ {
+			if !rv.Field(i).IsZero() {
+				ov.Field(i).Set(rv.Field(i))
+			}
+		}
+		c.Registries[host] = old
+	}
+}
+
+// env sets the settings given by GOPULL_* variables.
+func (c *Config) env(environ []string) error {
+	for _, k := range keys() {
+		name := EnvPrefix + strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		for _, e := range environ {
+			val, ok := strings.CutPrefix(e, name+"=")
+			if !ok || val == "" {
+				continue
+			}
+			if err := c.Set(k, val); err != nil {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Set sets the setting of flag name from its value on the command line.
+func (c *Config) Set(name string, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if key(v.Type().Field(i)) != name {
+			continue
+		}
+		n := yaml.Node{Kind: yaml.ScalarNode, Value: value}
+		if err := n.Decode(v.Field(i).Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid value %q", value)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown setting %v", name)
+}
+
+// Known tells whether flag name has a setting.
+func Known(name string) bool {
+	for _, k := range keys() {
+		if k == name {
+			return true
+		}
+	}
+	return false
+}
+
+func keys() []string {
+	var keys []string
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		if k := key(t.Field(i)); k != "" {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// key is the name of a setting given to a flag, "" for other fields.
+func key(f reflect.StructField) string {
+	k, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if k == "-" || f.Type.Kind() == reflect.Map {
+		return ""
+	}
+	return k
+}
+
+// Flags returns the settings that are set, by flag name, as flag values.
+func (c *Config) Flags() map[string]string {
+	flags := map[string]string{}
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		k, f := key(v.Type().Field(i)), v.Field(i)
+		if k == "" || f.IsZero() {
+			continue
+		}
+		flags[k] = fmt.Sprint(reflect.Indirect(f).Interface())
+	}
+	return flags
+}
+
+// Registry returns the settings of host. Docker Hub settings may be given
+// under docker.io, index.docker.io or registry-1.docker.io.
+func (c *Config) Registry(host string) Registry {
+	if r, ok := c.Registries[host]; ok {
+		return r
+	}
+	if host == "registry-1.docker.io" {
+		for _, alias := range []string{"docker.io", "index.docker.io"} {
+			if r, ok := c.Registries[alias]; ok {
+				return r
+			}
+		}
+	}
+	return Registry{}
+}
+
+// Credentials returns the username and password to log in with, if any.
+func (r Registry) Credentials() (string, string, error) {
+	if r.Auth == "" {
+		return r.Username, r.Password, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(r.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid auth: %v", err)
+	}
+	user, pass, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return "", "", fmt.Errorf("invalid auth: not username:password")
+	}
+	return user, pass, nil
+}
+
+// Show writes c as yaml, passwords masked.
+func (c *Config) Show() ([]byte, error) {
+	shown := *c
+	shown.Registries = map[string]Registry{}
+	for host, r := range c.Registries {
+		if r.Password != "" {
+			r.Password = "********"
+		}
+		if r.Auth != "" {
+			r.Auth = "********"
+		}
+		shown.Registries[host] = r
+	}
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(&shown); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
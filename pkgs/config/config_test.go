@@ -0,0 +1,93 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func write(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	system := write(t, dir, "system.yaml", `
+platform: arm64v8
+retry: 2
+registries:
+  docker.io:
+    mirrors: [mirror.example.com]
+    parallel: 2
+`)
+	user := write(t, dir, "user.yaml", `
+platform: linux/amd64
+cache: ~/.cache/gopull
+registries:
+  docker.io:
+    parallel: 4
+    auth: Ym9iOnNlY3JldA==
+`)
+	c, err := Load([]string{system, filepath.Join(dir, "missing.yaml"), user},
+		[]string{"GOPULL_RETRY=0", "GOPULL_LOG_FORMAT=json", "GOPULL_TIMEOUT=", "HOME=/root"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.Files, []string{system, user}) {
+		t.Fatalf("files %v", c.Files)
+	}
+	home, _ := os.UserHomeDir()
+	want := map[string]string{
+		"platform":   "linux/amd64",
+		"cache":      filepath.Join(home, ".cache/gopull"),
+		"retry":      "0",
+		"log-format": "json",
+	}
+	if got := c.Flags(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("flags %v", got)
+	}
+
+	hub := c.Registry("registry-1.docker.io")
+	if hub.Parallel != 4 || !reflect.DeepEqual(hub.Mirrors, []string{"mirror.example.com"}) {
+		t.Fatalf("docker.io %+v", hub)
+	}
+	if user, pass, err := hub.Credentials(); err != nil || user != "bob" || pass != "secret" {
+		t.Fatalf("credentials %v %v %v", user, pass, err)
+	}
+	if r := c.Registry("quay.io"); !reflect.DeepEqual(r, Registry{}) {
+		t.Fatalf("quay.io %+v", r)
+	}
+
+	b, err := c.Show()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "Ym9iOnNlY3JldA") {
+		t.Fatalf("auth shown:\n%s", b)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := write(t, dir, "bad.yaml", "parallel: many\n")
+	if _, err := Load([]string{bad}, nil); err == nil || !strings.Contains(err.Error(), bad) {
+		t.Fatalf("invalid file: %v", err)
+	}
+	if _, err := Load(nil, []string{"GOPULL_PARALLEL=many"}); err == nil {
+		t.Fatal("invalid variable accepted")
+	}
+	c := &Config{}
+	if err := c.Set("no-such-flag", "1"); err == nil {
+		t.Fatal("unknown setting accepted")
+	}
+	if !Known("iotimeout") || Known("registries") {
+		t.Fatal("Known")
+	}
+}
@@ -0,0 +1,154 @@
+// Package errdefs classifies the errors a run fails with. Every class has
+// an exit code of its own, so scripts can tell a missing image from a
+// network outage without reading messages.
+package errdefs
+
+import (
+	"errors"
+	"fmt"
+	"go_pull/pkgs/util/shutdown"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+)
+
+// Kind is the class of an error.
+type Kind int
+
+const (
+	Unknown Kind = iota
+	Usage
+	NotFound
+	Unauthorized
+	RateLimited
+	Network
+	DigestMismatch
+	DiskFull
+)
+
+var names = [...]string{
+	Unknown:        "unknown",
+	Usage:          "usage",
+	NotFound:       "not_found",
+	Unauthorized:   "unauthorized",
+	RateLimited:    "rate_limited",
+	Network:        "network",
+	DigestMismatch: "digest_mismatch",
+	DiskFull:       "disk_full",
+}
+
+func (k Kind) String() string {
+	if k < 0 || int(k) >= len(names) {
+		return names[Unknown]
+	}
+	return names[k]
+}
+
+// ExitCode is the exit code of a run failing with an error of kind k.
+func (k Kind) ExitCode() int {
+	switch k {
+	case Usage:
+		return shutdown.ExitUsage
+	case NotFound:
+		return shutdown.ExitNotFound
+	case Unauthorized:
+		return shutdown.ExitUnauthorized
+	case RateLimited:
+		return shutdown.ExitRateLimited
+	case Network:
+		return shutdown.ExitNetwork
+	case DigestMismatch:
+		return shutdown.ExitDigestMismatch
+	case DiskFull:
+		return shutdown.ExitDiskFull
+	}
+	return shutdown.ExitError
+}
+
+// FromExitCode is the kind of error a run exiting with code failed with.
+func FromExitCode(code int) Kind {
+	for k := Usage; k <= DiskFull; k++ {
+		if k.ExitCode() == code {
+			return k
+		}
+	}
+	return Unknown
+}
+
+// Error is an error of a known kind.
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// New gives err the kind k, nil stays nil.
+func New(k Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: k, Err: err}
+}
+
+// Errorf formats an error of kind k, as fmt.Errorf.
+func Errorf(k Kind, format string, a ...any) error {
+	return &Error{Kind: k, Err: fmt.Errorf(format, a...)}
+}
+
+// KindOf finds the kind of err: the outermost kind given in its chain, or
+// what the errors of the system and the network it wraps tell.
+func KindOf(err error) Kind {
+	if err == nil {
+		return Unknown
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return DiskFull
+	}
+	// a missing or unreadable file is no network failure, though its
+	// syscall.Errno is a net.Error too
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) {
+		return Unknown
+	}
+	var (
+		operr   *net.OpError
+		urlerr  *url.Error
+		dnserr  *net.DNSError
+		timeout interface{ Timeout() bool }
+	)
+	if errors.As(err, &operr) || errors.As(err, &urlerr) || errors.As(err, &dnserr) ||
+		(errors.As(err, &timeout) && timeout.Timeout()) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) {
+		return Network
+	}
+	return Unknown
+}
+
+// HTTPStatus is the kind of a failed registry response. Server errors are
+// network errors: both are worth a retry later.
+func HTTPStatus(code int) Kind {
+	switch {
+	case code == http.StatusUnauthorized, code == http.StatusForbidden:
+		return Unauthorized
+	case code == http.StatusNotFound:
+		return NotFound
+	case code == http.StatusTooManyRequests:
+		return RateLimited
+	case code >= 500:
+		return Network
+	}
+	return Unknown
+}
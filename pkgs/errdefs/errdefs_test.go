@@ -0,0 +1,67 @@
+package errdefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestKindOf(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want Kind
+	}{
+		{nil, Unknown},
+		{errors.New("boom"), Unknown},
+		{Errorf(NotFound, "manifest unknown"), NotFound},
+		{fmt.Errorf("layer 1: %w", Errorf(DigestMismatch, "digest mismatch")), DigestMismatch},
+		// the outermost kind wins
+		{New(Network, fmt.Errorf("retry: %w", Errorf(RateLimited, "HTTP 429"))), Network},
+		{&os.PathError{Op: "write", Path: "a.tar", Err: syscall.ENOSPC}, DiskFull},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, Network},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), Network},
+		{&net.DNSError{Err: "no such host", Name: "registry"}, Network},
+		{&os.PathError{Op: "open", Path: "a.tar", Err: syscall.EACCES}, Unknown},
+	} {
+		if got := KindOf(c.err); got != c.want {
+			t.Errorf("KindOf(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+	_, err := os.Open("/nonexistent/volume.001")
+	if got := KindOf(err); got == Network {
+		t.Fatalf("KindOf(%v) = %v", err, got)
+	}
+	if New(NotFound, nil) != nil {
+		t.Fatal("New(nil) is not nil")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	seen := map[int]Kind{}
+	for k := Unknown; k <= DiskFull; k++ {
+		code := k.ExitCode()
+		if p, ok := seen[code]; ok {
+			t.Fatalf("%v and %v exit with %v", p, k, code)
+		}
+		seen[code] = k
+		if FromExitCode(code) != k {
+			t.Fatalf("FromExitCode(%v) = %v, want %v", code, FromExitCode(code), k)
+		}
+	}
+	if Unknown.ExitCode() != 1 || Kind(99).String() != "unknown" {
+		t.Fatal("unknown errors exit with 1")
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	for code, want := range map[int]Kind{401: Unauthorized, 403: Unauthorized, 404: NotFound,
+		429: RateLimited, 500: Network, 503: Network, 400: Unknown} {
+		if got := HTTPStatus(code); got != want {
+			t.Errorf("HTTPStatus(%v) = %v, want %v", code, got, want)
+		}
+	}
+}
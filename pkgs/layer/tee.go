@@ -0,0 +1,249 @@
+package layer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+	"github.com/opencontainers/go-digest"
+)
+
+// Compression is how a layer blob is compressed.
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	Zstd
+	// Unknown is the compression of a generic or unknown media type,
+	// Decompress tells it from the first bytes of the blob.
+	Unknown
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	case Unknown:
+		return "unknown"
+	}
+	return "none"
+}
+
+// ParseCompression reads the name of a compression, gzip, zstd or none.
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "gzip":
+		return Gzip, nil
+	case "zstd":
+		return Zstd, nil
+	case "none":
+		return Uncompressed, nil
+	}
+	return 0, fmt.Errorf("unknown compression %q, use gzip, zstd or none", s)
+}
+
+// ByMediaType tells the compression of a layer from its media type, Unknown
+// for media types without a known suffix, application/octet-stream or none.
+func ByMediaType(mediaType string) Compression {
+	switch {
+	case strings.HasSuffix(mediaType, "zstd"):
+		return Zstd
+	case strings.HasSuffix(mediaType, "gzip"):
+		return Gzip
+	case strings.HasSuffix(mediaType, ".tar"):
+		return Uncompressed
+	}
+	return Unknown
+}
+
+// BigLayer is the compressed size from which gzip layers are decompressed
+// by the parallel decoder, which reads ahead in blocks.
+var BigLayer int64 = 32 << 20
+
+// Detect tells the compression of a blob from its first bytes. zstd:chunked
+// layers may start with a skippable frame.
+func Detect(magic []byte) Compression {
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return Gzip
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return Zstd
+	case len(magic) >= 4 && magic[0]&0xf0 == 0x50 && bytes.Equal(magic[1:4], []byte{0x2a, 0x4d, 0x18}):
+		return Zstd
+	}
+	return Uncompressed
+}
+
+// Decompress returns the tar of a layer blob compressed with c, the
+// compression of its media type. The first bytes of the blob only decide
+// for Unknown, a blob they tell is compressed otherwise is an error.
+func Decompress(r io.Reader, c Compression, size int64) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(4)
+	switch d := Detect(magic); {
+	case c == Unknown:
+		c = d
+	case d != c:
+		return nil, fmt.Errorf("layer is %v, its media type says %v", d, c)
+	}
+	r = br
+	switch c {
+	case Gzip:
+		if size >= BigLayer {
+			return pgzip.NewReaderN(r, 1<<20, 8)
+		}
+		return gzip.NewReader(r)
+	case Zstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// Compress returns a writer compressing a tar into w.
+func Compress(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case Gzip:
+		return pgzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w)
+	}
+	return nopCloser{w}, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+// DiffID computes the digest of the tar of a layer blob.
+func DiffID(r io.Reader, c Compression, size int64) (string, error) {
+	return Convert(nil, r, c, Uncompressed, size)
+}
+
+// Convert decompresses a layer blob read from r, compresses its tar again
+// with to into w, and returns the diff_id. A nil w only computes the
+// diff_id.
+func Convert(w io.Writer, r io.Reader, c Compression, to Compression, size int64) (string, error) {
+	tr, err := Decompress(r, c, size)
+	if err != nil {
+		return "", err
+	}
+	defer tr.Close()
+	h := sha256.New()
+	var dst io.Writer = h
+	var cw io.WriteCloser
+	if w != nil {
+		if cw, err = Compress(w, to); err != nil {
+			return "", err
+		}
+		dst = io.MultiWriter(h, cw)
+	}
+	if _, err := io.Copy(dst, tr); err != nil {
+		return "", err
+	}
+	if cw != nil {
+		if err := cw.Close(); err != nil {
+			return "", err
+		}
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Tee passes a layer blob on to w while it downloads and checks it on the
+// way: the blob is hashed for its digest, and decompressed in a goroutine
+// fed through a pipe to hash the tar for its diff_id. Both are known once
+// the last byte is written, without reading the blob again.
+type Tee struct {
+	w        io.Writer
+	digest   digest.Digest
+	verifier digest.Verifier
+	pw       *io.PipeWriter
+	broken   bool // the decompressor stopped, the rest is not fed to it
+	done     chan struct{}
+	diffID   string
+	err      error
+}
+
+// NewTee starts checking a blob of the given digest, compression and size
+// written to w.
+func NewTee(w io.Writer, dgst string, c Compression, size int64) (*Tee, error) {
+	return NewConvertTee(w, dgst, c, size, nil, Uncompressed)
+}
+
+// NewConvertTee is NewTee also writing the tar, compressed with to, into
+// out while the blob downloads.
+func NewConvertTee(w io.Writer, dgst string, c Compression, size int64, out io.Writer, to Compression) (*Tee, error) {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	t := &Tee{
+		w:        w,
+		digest:   d,
+		verifier: d.Verifier(),
+		pw:       pw,
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(t.done)
+		t.diffID, t.err = Convert(out, pr, c, to, size)
+		if t.err == nil {
+			// drain what the decompressor left unread, so writes never block
+			_, t.err = io.Copy(io.Discard, pr)
+		}
+		pr.CloseWithError(t.err)
+	}()
+	return t, nil
+}
+
+// Write passes b on to w, then to the digest and the decompressor.
+func (t *Tee) Write(b []byte) (int, error) {
+	n, err := t.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	t.verifier.Write(b[:n])
+	if !t.broken {
+		// an error of the decompressor is reported by Close
+		if _, err := t.pw.Write(b[:n]); err != nil {
+			t.broken = true
+		}
+	}
+	return n, nil
+}
+
+// Close waits for the decompressor and checks the digest of what was
+// written.
+func (t *Tee) Close() error {
+	t.pw.Close()
+	<-t.done
+	if !t.verifier.Verified() {
+		return errdefs.Errorf(errdefs.DigestMismatch, "digest mismatch, expected %v", t.digest)
+	}
+	if t.err != nil {
+		return fmt.Errorf("cannot decompress: %v", t.err)
+	}
+	return nil
+}
+
+// DiffID is the digest of the tar, set once Close succeeded.
+func (t *Tee) DiffID() string {
+	return t.diffID
+}
@@ -0,0 +1,167 @@
+package layer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func sum(b []byte) string {
+	s := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(s[:])
+}
+
+func compress(t *testing.T, c Compression, b []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch c {
+	case Gzip:
+		w = gzip.NewWriter(&buf)
+	case Zstd:
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = zw
+	default:
+		return b
+	}
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestTee(t *testing.T) {
+	tar := bytes.Repeat([]byte("layer content\n"), 10000)
+	for _, big := range []bool{false, true} {
+		if big {
+			BigLayer = 0
+		}
+		for _, c := range []Compression{Uncompressed, Gzip, Zstd} {
+			blob := compress(t, c, tar)
+			var out bytes.Buffer
+			tee, err := NewTee(&out, sum(blob), c, int64(len(blob)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// written in pieces, as a download arrives
+			for b := blob; len(b) > 0; {
+				n := 1000
+				if n > len(b) {
+					n = len(b)
+				}
+				if _, err := tee.Write(b[:n]); err != nil {
+					t.Fatal(err)
+				}
+				b = b[n:]
+			}
+			if err := tee.Close(); err != nil {
+				t.Fatalf("%v: %v", c, err)
+			}
+			if !bytes.Equal(out.Bytes(), blob) || tee.DiffID() != sum(tar) {
+				t.Fatalf("%v: diff_id %v, want %v", c, tee.DiffID(), sum(tar))
+			}
+		}
+	}
+	BigLayer = 32 << 20
+}
+
+func TestTeeErrors(t *testing.T) {
+	blob := compress(t, Gzip, []byte("content"))
+	tee, _ := NewTee(io.Discard, sum([]byte("other")), Gzip, int64(len(blob)))
+	tee.Write(blob)
+	if err := tee.Close(); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Fatalf("wrong blob: %v", err)
+	}
+
+	// a broken gzip blob still goes through, and fails at Close
+	blob = append([]byte{0x1f, 0x8b}, bytes.Repeat([]byte("not gzip"), 100000)...)
+	var out bytes.Buffer
+	tee, _ = NewTee(&out, sum(blob), Gzip, int64(len(blob)))
+	if n, err := tee.Write(blob); err != nil || n != len(blob) {
+		t.Fatalf("write %v, %v", n, err)
+	}
+	if err := tee.Close(); err == nil || !strings.Contains(err.Error(), "cannot decompress") || out.Len() != len(blob) {
+		t.Fatalf("not gzip: %v", err)
+	}
+
+	if _, err := NewTee(io.Discard, "sha256:12", Gzip, 0); err == nil {
+		t.Fatal("invalid digest accepted")
+	}
+}
+
+func TestByMediaType(t *testing.T) {
+	for mt, want := range map[string]Compression{
+		"application/vnd.docker.image.rootfs.diff.tar.gzip":            Gzip,
+		"application/vnd.docker.image.rootfs.foreign.diff.tar.gzip":    Gzip,
+		"application/vnd.oci.image.layer.v1.tar+gzip":                  Gzip,
+		"application/vnd.oci.image.layer.v1.tar+zstd":                  Zstd,
+		"application/vnd.oci.image.layer.v1.tar":                       Uncompressed,
+		"application/vnd.oci.image.layer.nondistributable.v1.tar+zstd": Zstd,
+		"application/octet-stream":                                     Unknown,
+		"":                                                             Unknown,
+	} {
+		if got := ByMediaType(mt); got != want {
+			t.Errorf("ByMediaType(%q) = %v, want %v", mt, got, want)
+		}
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tar := bytes.Repeat([]byte{0}, 1024)
+	for _, c := range []Compression{Uncompressed, Gzip, Zstd} {
+		blob := compress(t, c, tar)
+		if got := Detect(blob[:4]); got != c {
+			t.Errorf("Detect(%v) = %v", c, got)
+		}
+		// the media type wins, the first bytes only tell an unknown one
+		for _, mt := range []Compression{Uncompressed, Gzip, Zstd, Unknown} {
+			id, err := DiffID(bytes.NewReader(blob), mt, int64(len(blob)))
+			if mt == c || mt == Unknown {
+				if err != nil || id != sum(tar) {
+					t.Errorf("DiffID(%v as %v) = %v, %v", c, mt, id, err)
+				}
+			} else if err == nil {
+				t.Errorf("%v layer read as %v", c, mt)
+			}
+		}
+	}
+	if got := Detect([]byte{0x50, 0x2a, 0x4d, 0x18}); got != Zstd {
+		t.Errorf("skippable frame detected as %v", got)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	tar := bytes.Repeat([]byte("converted\n"), 5000)
+	blob := compress(t, Gzip, tar)
+	for _, to := range []Compression{Uncompressed, Gzip, Zstd} {
+		var out, conv bytes.Buffer
+		tee, err := NewConvertTee(&out, sum(blob), Gzip, int64(len(blob)), &conv, to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tee.Write(blob)
+		if err := tee.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), blob) || tee.DiffID() != sum(tar) {
+			t.Fatalf("%v: blob not passed on", to)
+		}
+		if Detect(conv.Bytes()) != to {
+			t.Fatalf("converted to %v", Detect(conv.Bytes()))
+		}
+		id, err := DiffID(&conv, to, int64(conv.Len()))
+		if err != nil || id != sum(tar) {
+			t.Fatalf("%v: converted layer diff_id %v, %v", to, id, err)
+		}
+	}
+	if _, err := ParseCompression("bzip2"); err == nil {
+		t.Fatal("bzip2 accepted")
+	}
+}
@@ -0,0 +1,236 @@
+package model
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// jwsSignature is a signature of a schema1 manifest, a JSON web signature
+// in the libtrust pretty format: the payload is the manifest itself, cut
+// before the signatures.
+type jwsSignature struct {
+	Header struct {
+		JWK *jwk     `json:"jwk,omitempty"`
+		X5C []string `json:"x5c,omitempty"`
+		Alg string   `json:"alg"`
+	} `json:"header"`
+	Signature string `json:"signature"`
+	Protected string `json:"protected"`
+}
+
+// jwsProtected tells where the payload ends in the signed manifest and how
+// the closing of the manifest reads without the signatures.
+type jwsProtected struct {
+	FormatLength int    `json:"formatLength"`
+	FormatTail   string `json:"formatTail"`
+}
+
+// jwk is a public key of a signature, EC or RSA.
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func b64(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+func schema1Signatures(b []byte) ([]jwsSignature, error) {
+	var m struct {
+		Signatures []jwsSignature `json:"signatures"`
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid schema1 manifest: %v", err)
+	}
+	return m.Signatures, nil
+}
+
+// payload rebuilds the signed content from the manifest b.
+func (s *jwsSignature) payload(b []byte) ([]byte, error) {
+	header, err := b64(s.Protected)
+	if err != nil {
+		return nil, fmt.Errorf("schema1 signature: invalid protected header: %v", err)
+	}
+	var p jwsProtected
+	if err := json.Unmarshal(header, &p); err != nil {
+		return nil, fmt.Errorf("schema1 signature: invalid protected header: %v", err)
+	}
+	tail, err := b64(p.FormatTail)
+	if err != nil {
+		return nil, fmt.Errorf("schema1 signature: invalid formatTail: %v", err)
+	}
+	if p.FormatLength <= 0 || p.FormatLength > len(b) {
+		return nil, fmt.Errorf("schema1 signature: invalid formatLength %v", p.FormatLength)
+	}
+	payload := append([]byte{}, b[:p.FormatLength]...)
+	return append(payload, tail...), nil
+}
+
+// schema1Payload returns the manifest without its signatures; an unsigned
+// manifest is its own payload. All signatures must cover the same payload.
+func schema1Payload(b []byte) ([]byte, error) {
+	sigs, err := schema1Signatures(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(sigs) == 0 {
+		return b, nil
+	}
+	var payload []byte
+	for i := range sigs {
+		p, err := sigs[i].payload(b)
+		if err != nil {
+			return nil, err
+		}
+		if payload != nil && string(p) != string(payload) {
+			return nil, fmt.Errorf("schema1 signatures cover different content")
+		}
+		payload = p
+	}
+	return payload, nil
+}
+
+// VerifySchema1 checks every signature of a signed schema1 manifest
+// against the key it carries, a JWK or the leaf of an x5c chain. It only
+// proves the manifest was not changed since it was signed, not who signed
+// it: registries sign with keys of their own.
+func VerifySchema1(b []byte) error {
+	sigs, err := schema1Signatures(b)
+	if err != nil {
+		return err
+	}
+	if len(sigs) == 0 {
+		return fmt.Errorf("schema1 manifest is not signed")
+	}
+	for i, s := range sigs {
+		if err := s.verify(b); err != nil {
+			return fmt.Errorf("schema1 signature %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (s *jwsSignature) verify(b []byte) error {
+	payload, err := s.payload(b)
+	if err != nil {
+		return err
+	}
+	sig, err := b64(s.Signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %v", err)
+	}
+	key, err := s.key()
+	if err != nil {
+		return err
+	}
+	input := []byte(s.Protected + "." + base64.RawURLEncoding.EncodeToString(payload))
+
+	var hash crypto.Hash
+	switch s.Header.Alg {
+	case "ES256", "RS256":
+		hash = crypto.SHA256
+	case "ES384", "RS384":
+		hash = crypto.SHA384
+	case "ES512", "RS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", s.Header.Alg)
+	}
+	h := hash.New()
+	h.Write(input)
+	sum := h.Sum(nil)
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if s.Header.Alg[0] != 'E' {
+			return fmt.Errorf("algorithm %v for an EC key", s.Header.Alg)
+		}
+		n := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*n {
+			return fmt.Errorf("invalid signature length %v", len(sig))
+		}
+		r := new(big.Int).SetBytes(sig[:n])
+		ss := new(big.Int).SetBytes(sig[n:])
+		if !ecdsa.Verify(k, sum, r, ss) {
+			return fmt.Errorf("signature does not match")
+		}
+	case *rsa.PublicKey:
+		if s.Header.Alg[0] != 'R' {
+			return fmt.Errorf("algorithm %v for an RSA key", s.Header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, hash, sum, sig); err != nil {
+			return fmt.Errorf("signature does not match")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil
+}
+
+// key returns the public key of the signature.
+func (s *jwsSignature) key() (crypto.PublicKey, error) {
+	if len(s.Header.X5C) > 0 {
+		der, err := base64.StdEncoding.DecodeString(s.Header.X5C[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid x5c: %v", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x5c: %v", err)
+		}
+		return cert.PublicKey, nil
+	}
+	k := s.Header.JWK
+	if k == nil {
+		return nil, fmt.Errorf("signature has no key")
+	}
+	switch k.Kty {
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk: %v", err)
+		}
+		y, err := b64(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk: %v", err)
+		}
+		pub := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("invalid jwk: point not on curve")
+		}
+		return pub, nil
+	case "RSA":
+		n, err := b64(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk: %v", err)
+		}
+		e, err := b64(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid jwk exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,66 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// EmptyLayer is the gzip compressed empty tar (1024 zero bytes) registries
+// store for layers without content.
+var EmptyLayer = []byte{
+	31, 139, 8, 0, 0, 9, 110, 136, 0, 255, 98, 24, 5, 163, 96, 20, 140, 88,
+	0, 8, 0, 0, 255, 255, 46, 175, 181, 239, 0, 4, 0, 0,
+}
+
+// EmptyLayerDigest is the digest of EmptyLayer.
+const EmptyLayerDigest = "sha256:a3ed95caeb02ffe68cdd9fd84406680ae93d633cb16422d00e8a7c22955b46d4"
+
+func sha256digest(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// ChainIDs returns the chain ID of every layer from the diff IDs of an
+// image: the first layer's is its diff ID, the next ones digest the chain ID
+// below them and their own diff ID, separated by a space.
+func ChainIDs(diffIDs []string) []string {
+	chain := make([]string, len(diffIDs))
+	for i, id := range diffIDs {
+		if i == 0 {
+			chain[i] = id
+			continue
+		}
+		chain[i] = sha256digest([]byte(chain[i-1] + " " + id))
+	}
+	return chain
+}
+
+// V1ID computes the legacy layer ID docker save gives a layer: the digest of
+// its json without the id, with the chain ID as layer_id and the parent
+// layer ID. parent is the hex of the parent ID, "" for the first layer. The
+// hex of the result names the layer directory.
+func V1ID(v1 V1Image, chainID string, parent string) (string, error) {
+	v1.ID = ""
+	b, err := json.Marshal(v1)
+	if err != nil {
+		return "", err
+	}
+	var config map[string]json.RawMessage
+	if err := json.Unmarshal(b, &config); err != nil {
+		return "", err
+	}
+	if config["layer_id"], err = json.Marshal(chainID); err != nil {
+		return "", err
+	}
+	if parent != "" {
+		if config["parent"], err = json.Marshal("sha256:" + parent); err != nil {
+			return "", err
+		}
+	}
+	b, err = json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return sha256digest(b)[len("sha256:"):], nil
+}
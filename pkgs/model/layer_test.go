@@ -0,0 +1,36 @@
+package model
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+var (
+	diff1 = "sha256:" + strings.Repeat("1", 64)
+	diff2 = "sha256:" + strings.Repeat("2", 64)
+)
+
+func TestChainIDs(t *testing.T) {
+	got := ChainIDs([]string{diff1, diff2})
+	want := []string{diff1, "sha256:9932074217c35353d2e03a3f5a86549f7c67bfeb0ba53e23d69f4d4c8f7958f5"}
+	if len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("ChainIDs = %v, want %v", got, want)
+	}
+}
+
+func TestEmptyLayer(t *testing.T) {
+	if sha256digest(EmptyLayer) != EmptyLayerDigest {
+		t.Fatal("EmptyLayerDigest does not match EmptyLayer")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(EmptyLayer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tar, err := io.ReadAll(zr)
+	if err != nil || !bytes.Equal(tar, make([]byte, 1024)) {
+		t.Fatalf("EmptyLayer is not an empty tar: %v", err)
+	}
+}
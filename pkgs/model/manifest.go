@@ -0,0 +1,336 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/opencontainers/go-digest"
+)
+
+// Media types of the manifests, configs and layers a registry serves.
+const (
+	MediaTypeManifestList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeManifest      = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeImageConfig   = "application/vnd.docker.container.image.v1+json"
+	MediaTypeLayer         = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	MediaTypeLayerTar      = "application/vnd.docker.image.rootfs.diff.tar"
+	MediaTypeForeignLayer  = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+	MediaTypeOCIIndex      = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest   = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIConfig     = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer      = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGzip  = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeOCILayerZstd  = "application/vnd.oci.image.layer.v1.tar+zstd"
+	MediaTypeOCIForeign    = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+	MediaTypeOCIForeignGz  = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+	MediaTypeOCIForeignZst = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+	MediaTypeSchema1       = "application/vnd.docker.distribution.manifest.v1+json"
+	MediaTypeSchema1Signed = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+)
+
+// Platform is the system an image of an index runs on.
+type Platform struct {
+	Architecture string   `json:"architecture"`
+	OS           string   `json:"os"`
+	OSVersion    string   `json:"os.version,omitempty"`
+	OSFeatures   []string `json:"os.features,omitempty"`
+	Variant      string   `json:"variant,omitempty"`
+	Features     []string `json:"features,omitempty"`
+}
+
+// String is the platform as -p takes it: the architecture followed by the
+// variant, arm64v8, for linux, and os/arch/variant for other systems.
+func (p Platform) String() string {
+	if p.OS != "linux" {
+		return strings.TrimSuffix(p.OS+"/"+p.Architecture+"/"+p.Variant, "/")
+	}
+	return p.Architecture + p.Variant
+}
+
+// Match reports whether the platform is the one asked for with -p: arm64v8
+// as before, or the os/arch/variant form, linux/arm64/v8. A missing os is
+// linux, as docker pull takes it, a missing variant matches any.
+func (p Platform) Match(s string) bool {
+	parts := strings.Split(s, "/")
+	if len(parts) == 3 {
+		return parts[0] == p.OS && parts[1] == p.Architecture && parts[2] == p.Variant
+	}
+	if len(parts) == 2 && parts[0] == p.OS && parts[1] == p.Architecture {
+		return true
+	}
+	if p.OS != "linux" {
+		return false
+	}
+	switch len(parts) {
+	case 1:
+		return s == p.String() || s == p.Architecture
+	case 2:
+		return parts[0] == p.Architecture && parts[1] == p.Variant
+	}
+	return false
+}
+
+// Descriptor points to a blob or manifest.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	URLs        []string          `json:"urls,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Foreign reports whether the blob is not stored in the registry but at
+// its URLs, as Windows base layers are.
+func (d Descriptor) Foreign() bool {
+	switch d.MediaType {
+	case MediaTypeForeignLayer, MediaTypeOCIForeign, MediaTypeOCIForeignGz, MediaTypeOCIForeignZst:
+		return true
+	}
+	return false
+}
+
+// Validate checks the digest and size of the descriptor and that its URLs
+// are http or https.
+func (d Descriptor) Validate() error {
+	if _, err := digest.Parse(d.Digest); err != nil {
+		return fmt.Errorf("invalid digest %q: %v", d.Digest, err)
+	}
+	if d.Size < 0 {
+		return fmt.Errorf("%v: invalid size %v", d.Digest, d.Size)
+	}
+	for _, u := range d.URLs {
+		pu, err := url.Parse(u)
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			return fmt.Errorf("%v: invalid url %q", d.Digest, u)
+		}
+	}
+	return nil
+}
+
+// Index is a Docker manifest list or an OCI image index.
+type Index struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Manifests     []Descriptor      `json:"manifests"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Validate checks every entry of the index.
+func (x *Index) Validate() error {
+	if x.SchemaVersion != 2 {
+		return fmt.Errorf("unsupported index schemaVersion %v", x.SchemaVersion)
+	}
+	for i, m := range x.Manifests {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("index manifest %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// Find returns the manifest for the platform asked with -p, and the
+// platforms of the index when there is none.
+func (x *Index) Find(platform string) (Descriptor, []string, bool) {
+	var platforms []string
+	for _, m := range x.Manifests {
+		if m.Platform == nil {
+			continue
+		}
+		if m.Platform.Match(platform) {
+			return m, nil, true
+		}
+		platforms = append(platforms, m.Platform.String())
+	}
+	return Descriptor{}, platforms, false
+}
+
+// Manifest is a Docker schema2 or OCI image manifest.
+type Manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType,omitempty"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Validate checks the config and layer descriptors.
+func (m *Manifest) Validate() error {
+	if m.SchemaVersion != 2 {
+		return fmt.Errorf("unsupported manifest schemaVersion %v", m.SchemaVersion)
+	}
+	if err := m.Config.Validate(); err != nil {
+		return fmt.Errorf("manifest config: %v", err)
+	}
+	if len(m.Layers) == 0 {
+		return fmt.Errorf("manifest has no layers")
+	}
+	for i, l := range m.Layers {
+		if err := l.Validate(); err != nil {
+			return fmt.Errorf("manifest layer %v: %v", i, err)
+		}
+		if l.Foreign() && len(l.URLs) == 0 {
+			return fmt.Errorf("manifest layer %v: foreign layer %v has no urls", i, l.Digest)
+		}
+	}
+	return nil
+}
+
+// RootFS lists the uncompressed digests of the layers of an image.
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// History describes how a layer of an image was built. The fields are in
+// the order the docker daemon writes them.
+type History struct {
+	Created    time.Time `json:"created"`
+	Author     string    `json:"author,omitempty"`
+	CreatedBy  string    `json:"created_by,omitempty"`
+	Comment    string    `json:"comment,omitempty"`
+	EmptyLayer bool      `json:"empty_layer,omitempty"`
+}
+
+// ImageConfig is a Docker or OCI image config.
+type ImageConfig struct {
+	Created      *time.Time        `json:"created,omitempty"`
+	Author       string            `json:"author,omitempty"`
+	Architecture string            `json:"architecture"`
+	Variant      string            `json:"variant,omitempty"`
+	OS           string            `json:"os"`
+	OSVersion    string            `json:"os.version,omitempty"`
+	Config       *container.Config `json:"config,omitempty"`
+	RootFS       RootFS            `json:"rootfs"`
+	History      []History         `json:"history,omitempty"`
+}
+
+// Validate checks the layer digests of the config.
+func (c *ImageConfig) Validate() error {
+	if c.RootFS.Type != "layers" {
+		return fmt.Errorf("image config: unsupported rootfs type %q", c.RootFS.Type)
+	}
+	if len(c.RootFS.DiffIDs) == 0 {
+		return fmt.Errorf("image config has no rootfs.diff_ids")
+	}
+	for _, id := range c.RootFS.DiffIDs {
+		if _, err := digest.Parse(id); err != nil {
+			return fmt.Errorf("image config: invalid diff_id %q: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// Kind tells what a manifest response is from its mediaType, the
+// Content-Type header or, as older registries send neither, its fields. It
+// returns MediaTypeManifestList for any index, MediaTypeManifest for any
+// schema2 image manifest and MediaTypeSchema1 for legacy manifests.
+func Kind(contentType string, body []byte) (string, error) {
+	var probe struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		MediaType     string          `json:"mediaType"`
+		Manifests     json.RawMessage `json:"manifests"`
+		Layers        json.RawMessage `json:"layers"`
+		FSLayers      json.RawMessage `json:"fsLayers"`
+	}
+	if err := json.Unmarshal(body, &probe); err != nil {
+		return "", fmt.Errorf("invalid manifest: %v", err)
+	}
+	mediaType := probe.MediaType
+	if mediaType == "" {
+		mediaType, _, _ = strings.Cut(contentType, ";")
+		mediaType = strings.TrimSpace(mediaType)
+	}
+	switch mediaType {
+	case MediaTypeManifestList, MediaTypeOCIIndex:
+		return MediaTypeManifestList, nil
+	case MediaTypeManifest, MediaTypeOCIManifest:
+		return MediaTypeManifest, nil
+	case MediaTypeSchema1, MediaTypeSchema1Signed:
+		return MediaTypeSchema1, nil
+	}
+	switch {
+	case probe.Manifests != nil:
+		return MediaTypeManifestList, nil
+	case probe.Layers != nil:
+		return MediaTypeManifest, nil
+	case probe.FSLayers != nil || probe.SchemaVersion == 1:
+		return MediaTypeSchema1, nil
+	}
+	return "", fmt.Errorf("unsupported manifest type %q", mediaType)
+}
+
+// ParseIndex decodes and validates a manifest list or image index.
+func ParseIndex(b []byte) (*Index, error) {
+	var x Index
+	if err := json.Unmarshal(b, &x); err != nil {
+		return nil, fmt.Errorf("invalid index: %v", err)
+	}
+	if err := x.Validate(); err != nil {
+		return nil, err
+	}
+	return &x, nil
+}
+
+// ParseManifest decodes and validates an image manifest.
+func ParseManifest(b []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ParseImageConfig decodes and validates an image config.
+func ParseImageConfig(b []byte) (*ImageConfig, error) {
+	var c ImageConfig
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("invalid image config: %v", err)
+	}
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Token is the answer of a registry token endpoint.
+type Token struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// ParseToken decodes a token answer. Endpoints may send access_token
+// instead of token, and leave out the lifetime, which is then 60 seconds.
+func ParseToken(b []byte, now time.Time) (*Token, error) {
+	var t Token
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("invalid token response: %v", err)
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	if t.Token == "" {
+		return nil, fmt.Errorf("token response has no token")
+	}
+	if t.ExpiresIn <= 0 {
+		t.ExpiresIn = 60
+	}
+	if t.IssuedAt.IsZero() {
+		t.IssuedAt = now
+	}
+	return &t, nil
+}
+
+// Expires is when the token stops being valid.
+func (t *Token) Expires() time.Time {
+	return t.IssuedAt.Add(time.Duration(t.ExpiresIn) * time.Second)
+}
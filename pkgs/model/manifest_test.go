@@ -0,0 +1,128 @@
+package model
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	dgstA = "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	dgstB = "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+)
+
+func TestKind(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"", `{"schemaVersion":2,"mediaType":"` + MediaTypeManifestList + `","manifests":[]}`, MediaTypeManifestList},
+		{MediaTypeOCIIndex, `{"schemaVersion":2,"manifests":[]}`, MediaTypeManifestList},
+		{MediaTypeOCIManifest + "; charset=utf-8", `{"schemaVersion":2}`, MediaTypeManifest},
+		{"application/json", `{"schemaVersion":2,"layers":[]}`, MediaTypeManifest},
+		{"application/json", `{"schemaVersion":2,"manifests":[]}`, MediaTypeManifestList},
+		{MediaTypeSchema1Signed, `{"schemaVersion":1}`, MediaTypeSchema1},
+		{"application/json", `{"schemaVersion":1,"fsLayers":[]}`, MediaTypeSchema1},
+	}
+	for _, tt := range tests {
+		got, err := Kind(tt.contentType, []byte(tt.body))
+		if err != nil || got != tt.want {
+			t.Errorf("Kind(%q, %s) = %q, %v, want %q", tt.contentType, tt.body, got, err, tt.want)
+		}
+	}
+	for _, body := range []string{`{"schemaVersion":2}`, `not json`} {
+		if _, err := Kind("", []byte(body)); err == nil {
+			t.Errorf("Kind(%s) succeeded", body)
+		}
+	}
+}
+
+func TestParseManifest(t *testing.T) {
+	m, err := ParseManifest([]byte(`{"schemaVersion":2,"mediaType":"` + MediaTypeManifest + `",
+		"config":{"mediaType":"` + MediaTypeImageConfig + `","size":10,"digest":"` + dgstA + `"},
+		"layers":[{"mediaType":"` + MediaTypeForeignLayer + `","size":20,"digest":"` + dgstB + `",
+			"urls":["https://example.com/layer"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Config.Digest != dgstA || len(m.Layers) != 1 || !m.Layers[0].Foreign() || m.Layers[0].URLs[0] != "https://example.com/layer" {
+		t.Fatalf("parsed %+v", m)
+	}
+
+	bad := []struct{ body, err string }{
+		{`{"schemaVersion":2,"config":{"digest":"sha256:12"},"layers":[{"digest":"` + dgstB + `"}]}`, "invalid digest"},
+		{`{"schemaVersion":2,"config":{"digest":"` + dgstA + `"},"layers":[]}`, "no layers"},
+		{`{"schemaVersion":2,"config":{"digest":"` + dgstA + `"},"layers":[{"digest":"` + dgstB + `","mediaType":"` + MediaTypeForeignLayer + `"}]}`, "has no urls"},
+		{`{"schemaVersion":2,"config":{"digest":"` + dgstA + `"},"layers":[{"digest":"` + dgstB + `","urls":["file:///etc/passwd"]}]}`, "invalid url"},
+		{`{"schemaVersion":2,"config":{"digest":"` + dgstA + `"},"layers":[{"digest":"` + dgstB + `","urls":"https://x"}]}`, "invalid manifest"},
+		{`{"schemaVersion":2,"config":{"digest":"` + dgstA + `","size":-1},"layers":[{"digest":"` + dgstB + `"}]}`, "invalid size"},
+	}
+	for _, tt := range bad {
+		if _, err := ParseManifest([]byte(tt.body)); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseManifest(%s) = %v, want %q", tt.body, err, tt.err)
+		}
+	}
+}
+
+func TestIndexFind(t *testing.T) {
+	x, err := ParseIndex([]byte(`{"schemaVersion":2,"manifests":[
+		{"digest":"` + dgstB + `","size":1,"platform":{"architecture":"amd64","os":"windows","os.version":"10.0.17763.5329"}},
+		{"digest":"` + dgstA + `","size":1,"platform":{"architecture":"amd64","os":"linux"}},
+		{"digest":"` + dgstB + `","size":1,"platform":{"architecture":"arm64","os":"linux","variant":"v8"}},
+		{"digest":"` + dgstB + `","size":1,"annotations":{"vnd.docker.reference.type":"attestation-manifest"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{
+		"amd64": dgstA, "linux/amd64": dgstA, "windows/amd64": dgstB,
+		"arm64v8": dgstB, "arm64/v8": dgstB, "linux/arm64/v8": dgstB, "arm64": dgstB,
+	} {
+		m, _, ok := x.Find(p)
+		if !ok || m.Digest != want {
+			t.Errorf("Find(%q) = %v, %v", p, m.Digest, ok)
+		}
+	}
+	if _, platforms, ok := x.Find("s390x"); ok || strings.Join(platforms, " ") != "windows/amd64 amd64 arm64v8" {
+		t.Errorf("Find(s390x) = %v, %v", platforms, ok)
+	}
+	if _, err := ParseIndex([]byte(`{"schemaVersion":2,"manifests":[{"digest":"md5:00"}]}`)); err == nil {
+		t.Error("index with an invalid digest accepted")
+	}
+}
+
+func TestParseImageConfig(t *testing.T) {
+	c, err := ParseImageConfig([]byte(`{"architecture":"amd64","os":"linux","created":"2023-01-02T03:04:05Z",
+		"config":{"Cmd":["/bin/sh"]},"rootfs":{"type":"layers","diff_ids":["` + dgstA + `"]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Config.Cmd[0] != "/bin/sh" || c.Created.Year() != 2023 {
+		t.Fatalf("parsed %+v", c)
+	}
+	for _, body := range []string{
+		`{"rootfs":{"type":"layers","diff_ids":[]}}`,
+		`{"rootfs":{"type":"layers","diff_ids":["nope"]}}`,
+		`{"rootfs":{"type":"other","diff_ids":["` + dgstA + `"]}}`,
+		`{"rootfs":{"type":"layers","diff_ids":"` + dgstA + `"}}`,
+	} {
+		if _, err := ParseImageConfig([]byte(body)); err == nil {
+			t.Errorf("ParseImageConfig(%s) succeeded", body)
+		}
+	}
+}
+
+func TestParseToken(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tk, err := ParseToken([]byte(`{"token":"t","expires_in":300,"issued_at":"2024-01-01T10:00:00Z"}`), now)
+	if err != nil || tk.Expires() != time.Date(2024, 1, 1, 10, 5, 0, 0, time.UTC) {
+		t.Fatalf("token %+v, %v", tk, err)
+	}
+	tk, err = ParseToken([]byte(`{"access_token":"a"}`), now)
+	if err != nil || tk.Token != "a" || tk.Expires() != now.Add(time.Minute) {
+		t.Fatalf("token %+v, %v", tk, err)
+	}
+	if _, err := ParseToken([]byte(`{"expires_in":300}`), now); err == nil {
+		t.Fatal("answer without a token accepted")
+	}
+}
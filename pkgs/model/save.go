@@ -0,0 +1,160 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+)
+
+// VERSION is the content of the VERSION file of every layer directory.
+const VERSION = "1.0"
+
+// V1Image is the legacy image json docker save writes into every layer
+// directory, image.V1Image of the docker daemon.
+type V1Image struct {
+	ID              string            `json:"id,omitempty"`
+	Parent          string            `json:"parent,omitempty"`
+	Comment         string            `json:"comment,omitempty"`
+	Created         time.Time         `json:"created"`
+	Container       string            `json:"container,omitempty"`
+	ContainerConfig container.Config  `json:"container_config,omitempty"`
+	DockerVersion   string            `json:"docker_version,omitempty"`
+	Author          string            `json:"author,omitempty"`
+	Config          *container.Config `json:"config,omitempty"`
+	Architecture    string            `json:"architecture,omitempty"`
+	Variant         string            `json:"variant,omitempty"`
+	OS              string            `json:"os,omitempty"`
+	Size            int64             `json:",omitempty"`
+}
+
+// saveConfig is what docker save reads from an image config. The parent of
+// an image config is not the parent of its legacy layer, so it shadows
+// V1Image.Parent as in the daemon's image.Image.
+type saveConfig struct {
+	V1Image
+	Parent string `json:"parent,omitempty"`
+	RootFS *struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs,omitempty"`
+}
+
+// ManifestItem is the entry of an image in manifest.json. RepoDigests is
+// gopull's, docker load ignores it: name@digest of what the image was pulled
+// as, the index or manifest its tag pointed to, as docker inspect lists them.
+type ManifestItem struct {
+	Config       string
+	RepoTags     []string
+	RepoDigests  []string `json:",omitempty"`
+	Layers       []string
+	Parent       string                `json:",omitempty"`
+	LayerSources map[string]Descriptor `json:",omitempty"`
+}
+
+// SaveLayer is a legacy layer directory of a docker save archive.
+type SaveLayer struct {
+	ID     string // hex of the legacy layer ID, names the directory
+	DiffID string
+	JSON   []byte // content of <ID>/json
+	// Link is the target of <ID>/layer.tar when an earlier layer has the
+	// same diff_id: docker save writes a layer once and links the others.
+	Link string
+}
+
+// Path is the name of the layer tar in the archive.
+func (l SaveLayer) Path() string {
+	return l.ID + "/layer.tar"
+}
+
+// Save is the content of a docker save archive of one image, except the
+// layer tars.
+type Save struct {
+	Config  string    // file name of the image config, <config hex>.json
+	Created time.Time // creation time of the image, the mtime of its files
+	Layers  []SaveLayer
+}
+
+// NewSave computes the legacy layers docker save writes for an image config:
+// each layer gets an ID derived from its chain ID and its parent, and a json
+// holding only a creation time, but for the last layer which carries the
+// image config.
+func NewSave(config []byte) (*Save, error) {
+	var img saveConfig
+	if err := json.Unmarshal(config, &img); err != nil {
+		return nil, fmt.Errorf("invalid image config: %v", err)
+	}
+	if img.RootFS == nil || len(img.RootFS.DiffIDs) == 0 {
+		return nil, fmt.Errorf("image config has no rootfs.diff_ids")
+	}
+	s := &Save{
+		Config:  sha256digest(config)[len("sha256:"):] + ".json",
+		Created: img.Created,
+	}
+	chain := ChainIDs(img.RootFS.DiffIDs)
+	paths := map[string]string{}
+	var parent string
+	for i, diffID := range img.RootFS.DiffIDs {
+		// the epoch creation time is for docker before 1.9
+		v1 := V1Image{Created: time.Unix(0, 0).UTC()}
+		if i == len(chain)-1 {
+			v1 = img.V1Image
+		}
+		id, err := V1ID(v1, chain[i], parent)
+		if err != nil {
+			return nil, err
+		}
+		v1.ID = id
+		v1.Parent = parent
+		v1.OS = img.OS
+		data, err := json.Marshal(v1)
+		if err != nil {
+			return nil, err
+		}
+
+		l := SaveLayer{ID: id, DiffID: diffID, JSON: data}
+		if p, ok := paths[diffID]; ok {
+			l.Link = "../" + p
+		} else {
+			paths[diffID] = l.Path()
+		}
+		s.Layers = append(s.Layers, l)
+		parent = id
+	}
+	return s, nil
+}
+
+// Manifest encodes manifest.json for the image tagged repoTags and pulled
+// as repoDigests. sources maps diff_ids of layers that are not stored in the
+// registry to where they come from.
+func (s *Save) Manifest(repoTags []string, repoDigests []string, sources map[string]Descriptor) ([]byte, error) {
+	item := ManifestItem{
+		Config:       s.Config,
+		RepoTags:     repoTags,
+		RepoDigests:  repoDigests,
+		LayerSources: sources,
+	}
+	for _, l := range s.Layers {
+		item.Layers = append(item.Layers, l.Path())
+	}
+	return encode([]ManifestItem{item})
+}
+
+// Repositories encodes the repositories file, which maps the familiar name
+// and tag of the image to its last layer.
+func (s *Save) Repositories(name string, tag string) ([]byte, error) {
+	return encode(map[string]map[string]string{
+		name: {tag: s.Layers[len(s.Layers)-1].ID},
+	})
+}
+
+// encode writes v as docker save does, on one line ending with a newline.
+func encode(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,135 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The directories of testdata/save hold the config of alpine:3.17 as Docker
+// Hub serves it, and the manifest.json, repositories and VERSION and json of
+// the layer directory that image/tarexport of docker 20.10 writes for it,
+// tagged and untagged; the layer tar is left out. testdata/buildkit.json is
+// a config written for the tests, with a foreign, a repeated empty layer
+// and a parent.
+
+// readSaved reads the file name of the saved archive dir.
+func readSaved(t *testing.T, dir string, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", "save", dir, filepath.FromSlash(name)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestSaveDocker(t *testing.T) {
+	tests := []struct {
+		dir      string
+		config   string
+		repoTags []string
+		name     string
+		tag      string
+	}{
+		{"alpine", "16112f0a06f4857b0733bd8a2eadb0d2579ef29bcee48b0feeaef11295b44ce2.json",
+			[]string{"alpine:3.17"}, "alpine", "3.17"},
+		{"untagged", "16112f0a06f4857b0733bd8a2eadb0d2579ef29bcee48b0feeaef11295b44ce2.json", nil, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			s, err := NewSave(readSaved(t, tt.dir, tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s.Config != tt.config {
+				t.Fatalf("config file %v, docker save wrote %v", s.Config, tt.config)
+			}
+			for _, l := range s.Layers {
+				if got := readSaved(t, tt.dir, l.ID+"/VERSION"); string(got) != VERSION {
+					t.Fatalf("%v/VERSION: %q", l.ID, got)
+				}
+				if got := readSaved(t, tt.dir, l.ID+"/json"); !bytes.Equal(l.JSON, got) {
+					t.Fatalf("%v/json differs from docker save:\n%s\n%s", l.ID, l.JSON, got)
+				}
+				link, _ := os.Readlink(filepath.Join("testdata", "save", tt.dir, filepath.FromSlash(l.Path())))
+				if l.Link != link {
+					t.Fatalf("%v links to %q, docker save to %q", l.Path(), l.Link, link)
+				}
+			}
+			manifest, err := s.Manifest(tt.repoTags, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := readSaved(t, tt.dir, "manifest.json"); !bytes.Equal(manifest, want) {
+				t.Fatalf("manifest.json differs from docker save:\n%s%s", manifest, want)
+			}
+			if tt.tag == "" {
+				// docker save writes no repositories for untagged images
+				if _, err := os.Stat(filepath.Join("testdata", "save", tt.dir, "repositories")); !os.IsNotExist(err) {
+					t.Fatalf("repositories of an untagged image: %v", err)
+				}
+				return
+			}
+			repositories, err := s.Repositories(tt.name, tt.tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := readSaved(t, tt.dir, "repositories"); !bytes.Equal(repositories, want) {
+				t.Fatalf("repositories differs from docker save:\n%s%s", repositories, want)
+			}
+		})
+	}
+}
+
+func TestSaveLayers(t *testing.T) {
+	config, err := os.ReadFile(filepath.Join("testdata", "buildkit.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewSave(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Config != sha256digest(config)[len("sha256:"):]+".json" {
+		t.Fatalf("config file %v", s.Config)
+	}
+	if len(s.Layers) != 4 {
+		t.Fatalf("%v layers", len(s.Layers))
+	}
+	// the repeated empty layer links to its first copy
+	if s.Layers[1].Link != "" || s.Layers[3].Link != "../"+s.Layers[1].Path() {
+		t.Fatalf("links %q %q", s.Layers[1].Link, s.Layers[3].Link)
+	}
+
+	var first, last map[string]interface{}
+	json.Unmarshal(s.Layers[0].JSON, &first)
+	json.Unmarshal(s.Layers[3].JSON, &last)
+	if first["created"] != "1970-01-01T00:00:00Z" || first["parent"] != nil || first["os"] != "linux" {
+		t.Fatalf("first layer json %s", s.Layers[0].JSON)
+	}
+	// the parent of the image config is not the parent layer
+	if last["parent"] != s.Layers[2].ID || last["created"] != "2024-05-01T10:20:30.123Z" || last["variant"] != "v8" {
+		t.Fatalf("last layer json %s", s.Layers[3].JSON)
+	}
+	if _, ok := last["history"]; ok {
+		t.Fatal("history copied into the layer json")
+	}
+
+	foreign := map[string]Descriptor{s.Layers[0].DiffID: {MediaType: MediaTypeForeignLayer, Size: 1024,
+		Digest: "sha256:" + strings.Repeat("a", 64), URLs: []string{"https://example.com/base.tar.gz"}}}
+	manifest, err := s.Manifest([]string{"app:1.0"}, []string{"app@" + sha256digest(config)}, foreign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []ManifestItem
+	json.Unmarshal(manifest, &items)
+	if len(items) != 1 || len(items[0].Layers) != 4 || items[0].RepoDigests[0] != "app@"+sha256digest(config) || items[0].LayerSources[s.Layers[0].DiffID].URLs[0] != "https://example.com/base.tar.gz" {
+		t.Fatalf("manifest.json %s", manifest)
+	}
+
+	if _, err := NewSave([]byte(`{"rootfs":{"type":"layers"}}`)); err == nil {
+		t.Fatal("config without diff_ids accepted")
+	}
+}
@@ -0,0 +1,193 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/versions"
+	"github.com/opencontainers/go-digest"
+)
+
+// Schema1 is a legacy image manifest, still served by old registries. It
+// has no config: every layer carries its own v1 image json, and the
+// layers are listed from the top one down.
+type Schema1 struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	Name          string `json:"name"`
+	Tag           string `json:"tag"`
+	Architecture  string `json:"architecture"`
+	FSLayers      []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+	Signatures []json.RawMessage `json:"signatures,omitempty"`
+
+	// Payload is the manifest without its signatures, the content the
+	// manifest digest is computed from.
+	Payload []byte `json:"-"`
+}
+
+// v1Compatibility is what is read from the v1 image json of a layer.
+type v1Compatibility struct {
+	V1Image
+	ThrowAway bool `json:"throwaway,omitempty"`
+}
+
+// ParseSchema1 decodes a schema1 manifest, signed or not, and checks its
+// layers the way the docker daemon does before pulling them. Layers
+// repeated next to each other with the same v1 ID are dropped.
+func ParseSchema1(b []byte) (*Schema1, error) {
+	payload, err := schema1Payload(b)
+	if err != nil {
+		return nil, err
+	}
+	var m Schema1
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, fmt.Errorf("invalid schema1 manifest: %v", err)
+	}
+	m.Payload = payload
+	var signed struct {
+		Signatures []json.RawMessage `json:"signatures"`
+	}
+	json.Unmarshal(b, &signed)
+	m.Signatures = signed.Signatures
+	if m.SchemaVersion != 1 {
+		return nil, fmt.Errorf("unsupported schema1 manifest schemaVersion %v", m.SchemaVersion)
+	}
+	if len(m.FSLayers) == 0 {
+		return nil, fmt.Errorf("schema1 manifest has no layers")
+	}
+	if len(m.FSLayers) != len(m.History) {
+		return nil, fmt.Errorf("schema1 manifest has %v layers and %v history entries", len(m.FSLayers), len(m.History))
+	}
+	for i, l := range m.FSLayers {
+		if _, err := digest.Parse(l.BlobSum); err != nil {
+			return nil, fmt.Errorf("schema1 layer %v: invalid digest %q: %v", i, l.BlobSum, err)
+		}
+	}
+	if err := m.fixLayers(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// fixLayers checks that every layer is the parent of the one above it,
+// and removes layers repeated with the same ID, as fixManifestLayers of the
+// docker daemon.
+func (m *Schema1) fixLayers() error {
+	imgs := make([]v1Compatibility, len(m.History))
+	for i, h := range m.History {
+		if err := json.Unmarshal([]byte(h.V1Compatibility), &imgs[i]); err != nil {
+			return fmt.Errorf("schema1 layer %v: invalid v1Compatibility: %v", i, err)
+		}
+		if len(imgs[i].ID) != 64 || strings.Trim(imgs[i].ID, "0123456789abcdef") != "" {
+			return fmt.Errorf("schema1 layer %v: invalid id %q", i, imgs[i].ID)
+		}
+	}
+	if imgs[len(imgs)-1].Parent != "" {
+		return fmt.Errorf("schema1 manifest: invalid parent ID in the base layer")
+	}
+	seen := map[string]bool{}
+	var last string
+	for _, img := range imgs {
+		if img.ID != last && seen[img.ID] {
+			return fmt.Errorf("schema1 manifest: ID %v appears multiple times", img.ID)
+		}
+		last = img.ID
+		seen[last] = true
+	}
+	for i := len(imgs) - 2; i >= 0; i-- {
+		if imgs[i].ID == imgs[i+1].ID {
+			m.FSLayers = append(m.FSLayers[:i], m.FSLayers[i+1:]...)
+			m.History = append(m.History[:i], m.History[i+1:]...)
+		} else if imgs[i].Parent != imgs[i+1].ID {
+			return fmt.Errorf("schema1 manifest: invalid parent ID, expected %v, got %v", imgs[i+1].ID, imgs[i].Parent)
+		}
+	}
+	return nil
+}
+
+// Layers returns the digests of the layers that make the root filesystem,
+// base layer first. Throwaway layers, which only hold metadata, are left
+// out.
+func (m *Schema1) Layers() []string {
+	var layers []string
+	for i := len(m.FSLayers) - 1; i >= 0; i-- {
+		var img v1Compatibility
+		json.Unmarshal([]byte(m.History[i].V1Compatibility), &img)
+		if img.ThrowAway {
+			continue
+		}
+		layers = append(layers, m.FSLayers[i].BlobSum)
+	}
+	return layers
+}
+
+// Config makes the image config the docker daemon makes when it pulls the
+// manifest: the v1 image json of the top layer, without its legacy fields,
+// with the rootfs of diffIDs, the uncompressed digests of Layers, and a
+// history entry for every layer.
+func (m *Schema1) Config(diffIDs []string) ([]byte, error) {
+	var history []History
+	for i := len(m.History) - 1; i >= 0; i-- {
+		var img v1Compatibility
+		if err := json.Unmarshal([]byte(m.History[i].V1Compatibility), &img); err != nil {
+			return nil, err
+		}
+		history = append(history, History{
+			Author:     img.Author,
+			Created:    img.Created,
+			CreatedBy:  strings.Join(img.ContainerConfig.Cmd, " "),
+			Comment:    img.Comment,
+			EmptyLayer: img.ThrowAway,
+		})
+	}
+	if n := len(m.Layers()); n != len(diffIDs) {
+		return nil, fmt.Errorf("schema1 manifest has %v layers, got %v diff_ids", n, len(diffIDs))
+	}
+
+	top := []byte(m.History[0].V1Compatibility)
+	var dver struct {
+		DockerVersion string `json:"docker_version"`
+	}
+	if err := json.Unmarshal(top, &dver); err != nil {
+		return nil, err
+	}
+	// json written by docker before 1.8.3 may not be valid, it is read
+	// through V1Image first
+	if versions.LessThan(dver.DockerVersion, "1.8.3") {
+		var v1 V1Image
+		if err := json.Unmarshal(top, &v1); err != nil {
+			return nil, err
+		}
+		b, err := json.Marshal(v1)
+		if err != nil {
+			return nil, err
+		}
+		top = b
+	}
+	var c map[string]*json.RawMessage
+	if err := json.Unmarshal(top, &c); err != nil {
+		return nil, err
+	}
+	for _, k := range []string{"id", "parent", "Size", "parent_id", "layer_id", "throwaway"} {
+		delete(c, k)
+	}
+	rootfs, err := json.Marshal(struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids,omitempty"`
+	}{"layers", diffIDs})
+	if err != nil {
+		return nil, err
+	}
+	hist, err := json.Marshal(history)
+	if err != nil {
+		return nil, err
+	}
+	c["rootfs"] = (*json.RawMessage)(&rootfs)
+	c["history"] = (*json.RawMessage)(&hist)
+	return json.Marshal(c)
+}
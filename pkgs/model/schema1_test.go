@@ -0,0 +1,188 @@
+package model
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// sign signs a schema1 manifest the way libtrust does: the signatures go
+// before the closing brace and the protected header tells how to cut them
+// out again.
+func sign(t *testing.T, payload []byte, key crypto.Signer) []byte {
+	t.Helper()
+	end := bytes.LastIndexByte(payload, '}')
+	n := bytes.LastIndexFunc(payload[:end], func(r rune) bool { return r != ' ' && r != '\n' }) + 1
+	enc := base64.RawURLEncoding.EncodeToString
+	protected, _ := json.Marshal(map[string]interface{}{
+		"formatLength": n,
+		"formatTail":   enc(payload[n:]),
+		"time":         "2023-05-04T17:37:03Z",
+	})
+	p64 := enc(protected)
+	input := []byte(p64 + "." + enc(payload))
+
+	header := map[string]interface{}{}
+	var sig []byte
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		h := crypto.SHA256.New()
+		h.Write(input)
+		r, s, err := ecdsa.Sign(rand.Reader, k, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		header["alg"] = "ES256"
+		header["jwk"] = map[string]string{"kty": "EC", "crv": "P-256",
+			"x": enc(k.X.FillBytes(make([]byte, 32))), "y": enc(k.Y.FillBytes(make([]byte, 32)))}
+	case *rsa.PrivateKey:
+		h := crypto.SHA256.New()
+		h.Write(input)
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, h.Sum(nil)); err != nil {
+			t.Fatal(err)
+		}
+		header["alg"] = "RS256"
+		header["jwk"] = map[string]string{"kty": "RSA", "n": enc(k.N.Bytes()),
+			"e": enc(big.NewInt(int64(k.E)).Bytes())}
+	}
+	sigs, _ := json.MarshalIndent([]interface{}{map[string]interface{}{
+		"header": header, "signature": enc(sig), "protected": p64,
+	}}, "   ", "   ")
+	var b bytes.Buffer
+	b.Write(payload[:n])
+	b.WriteString(",\n   \"signatures\": ")
+	b.Write(sigs)
+	b.Write(payload[n:])
+	return b.Bytes()
+}
+
+func readSchema1(t *testing.T) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", "schema1", "hello.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestSchema1(t *testing.T) {
+	payload := readSchema1(t)
+	m, err := ParseSchema1(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// base first, without the throwaway top layer
+	if got := strings.Join(m.Layers(), " "); got != diff2+" "+diff1 {
+		t.Fatalf("Layers = %v", got)
+	}
+	config, err := m.Config([]string{diff1, diff2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	golden := filepath.Join("testdata", "schema1", "hello.config.golden")
+	if *update {
+		if err := os.WriteFile(golden, config, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(config, want) {
+		t.Fatalf("config differs from %v:\n%s", golden, config)
+	}
+	c, err := ParseImageConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.History) != 3 || !c.History[2].EmptyLayer || c.History[0].Comment != "base layer" ||
+		c.History[2].CreatedBy != `/bin/sh -c #(nop)  CMD ["/hello"]` {
+		t.Fatalf("history %+v", c.History)
+	}
+	if _, err := NewSave(config); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Config([]string{diff1}); err == nil {
+		t.Fatal("config with a missing diff_id accepted")
+	}
+}
+
+func TestSchema1Layers(t *testing.T) {
+	var m map[string]interface{}
+	json.Unmarshal(readSchema1(t), &m)
+	history := m["history"].([]interface{})
+	layers := m["fsLayers"].([]interface{})
+
+	// a layer repeated with the same id is dropped
+	m["history"] = append([]interface{}{history[0]}, history...)
+	m["fsLayers"] = append([]interface{}{layers[0]}, layers...)
+	b, _ := json.Marshal(m)
+	s, err := ParseSchema1(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.FSLayers) != 3 || len(s.History) != 3 {
+		t.Fatalf("%v layers, %v history entries", len(s.FSLayers), len(s.History))
+	}
+
+	m["history"] = []interface{}{history[0], history[2]}
+	m["fsLayers"] = []interface{}{layers[0], layers[2]}
+	b, _ = json.Marshal(m)
+	if _, err := ParseSchema1(b); err == nil || !strings.Contains(err.Error(), "invalid parent ID") {
+		t.Fatalf("broken parent chain: %v", err)
+	}
+	m["history"] = history[:2]
+	b, _ = json.Marshal(m)
+	if _, err := ParseSchema1(b); err == nil {
+		t.Fatal("fsLayers and history of different lengths accepted")
+	}
+}
+
+func TestVerifySchema1(t *testing.T) {
+	payload := readSchema1(t)
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []crypto.Signer{ec, rk} {
+		signed := sign(t, payload, key)
+		if err := VerifySchema1(signed); err != nil {
+			t.Fatalf("%T: %v", key, err)
+		}
+		m, err := ParseSchema1(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(m.Payload, payload) || len(m.Signatures) != 1 {
+			t.Fatalf("%T: payload not recovered:\n%s", key, m.Payload)
+		}
+
+		tampered := bytes.Replace(signed, []byte(`"tag": "latest"`), []byte(`"tag": "latent"`), 1)
+		if err := VerifySchema1(tampered); err == nil {
+			t.Fatalf("%T: tampered manifest verified", key)
+		}
+	}
+	if err := VerifySchema1(payload); err == nil {
+		t.Fatal("unsigned manifest verified")
+	}
+}
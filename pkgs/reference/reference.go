@@ -0,0 +1,109 @@
+// Package reference parses image references the way the docker client does:
+// [registry/][path/]name[:tag][@digest]. A first element is only taken as
+// the registry when it contains a '.' or ':' or is "localhost", and images
+// without one come from Docker Hub.
+package reference
+
+import (
+	"fmt"
+	"strings"
+
+	dref "github.com/docker/distribution/reference"
+)
+
+const (
+	// DefaultRegistry is the host images without a registry are pulled from.
+	DefaultRegistry = "registry-1.docker.io"
+	// DefaultTag is used when a reference has neither tag nor digest.
+	DefaultTag = "latest"
+
+	hubDomain = "docker.io"
+)
+
+// Reference is a parsed image reference.
+type Reference struct {
+	Registry   string // host[:port] serving the image
+	Repository string // path on the registry, library/redis for official images
+	Tag        string // tag, DefaultTag when nothing was given, "" for a bare digest
+	Digest     string // sha256:... when pinned
+}
+
+// Parse parses and normalizes an image reference.
+func Parse(s string) (Reference, error) {
+	named, err := dref.ParseNormalizedNamed(strings.TrimSpace(s))
+	if err != nil {
+		return Reference{}, fmt.Errorf("invalid image reference %q: %v", s, err)
+	}
+
+	r := Reference{
+		Registry:   dref.Domain(named),
+		Repository: dref.Path(named),
+	}
+	switch r.Registry {
+	case hubDomain, "index.docker.io", DefaultRegistry:
+		r.Registry = DefaultRegistry
+		if !strings.Contains(r.Repository, "/") {
+			r.Repository = "library/" + r.Repository
+		}
+	}
+	if t, ok := named.(dref.Tagged); ok {
+		r.Tag = t.Tag()
+	}
+	if d, ok := named.(dref.Digested); ok {
+		r.Digest = d.Digest().String()
+	}
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = DefaultTag
+	}
+	return r, nil
+}
+
+// Hub reports whether the image is pulled from Docker Hub.
+func (r Reference) Hub() bool {
+	return r.Registry == DefaultRegistry
+}
+
+// Name is the last element of the repository path, "redis" for
+// "quay.io/foo/redis".
+func (r Reference) Name() string {
+	return r.Repository[strings.LastIndex(r.Repository, "/")+1:]
+}
+
+// Familiar is the repository name docker shows and tags images with: Docker
+// Hub images drop the registry and the "library/" prefix.
+func (r Reference) Familiar() string {
+	if r.Hub() {
+		return strings.TrimPrefix(r.Repository, "library/")
+	}
+	return r.Registry + "/" + r.Repository
+}
+
+// RepoTag is the familiar name with the tag, as listed in RepoTags, "" for
+// an image pinned by digest alone, which docker save leaves untagged.
+func (r Reference) RepoTag() string {
+	if r.Tag == "" {
+		return ""
+	}
+	return r.Familiar() + ":" + r.Tag
+}
+
+// Ref is what to ask the registry's manifest endpoint for: the digest when
+// pinned, the tag otherwise.
+func (r Reference) Ref() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// String is the fully qualified reference.
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,45 @@
+package reference
+
+import "testing"
+
+const dgst = "sha256:31120dcdd310e9a65cbcadd504f4fe60a185bd634ab7c6a35e3e44a941904d97"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		want     Reference
+		familiar string
+	}{
+		{"redis", Reference{DefaultRegistry, "library/redis", "latest", ""}, "redis"},
+		{"redis:7", Reference{DefaultRegistry, "library/redis", "7", ""}, "redis"},
+		{"bitnami/redis:7.0", Reference{DefaultRegistry, "bitnami/redis", "7.0", ""}, "bitnami/redis"},
+		{"docker.io/library/redis", Reference{DefaultRegistry, "library/redis", "latest", ""}, "redis"},
+		{"redis@" + dgst, Reference{DefaultRegistry, "library/redis", "", dgst}, "redis"},
+		{"redis:7@" + dgst, Reference{DefaultRegistry, "library/redis", "7", dgst}, "redis"},
+		{"quay.io/coreos/etcd:v3.5", Reference{"quay.io", "coreos/etcd", "v3.5", ""}, "quay.io/coreos/etcd"},
+		{"localhost:5000/team/app", Reference{"localhost:5000", "team/app", "latest", ""}, "localhost:5000/team/app"},
+		{"10.0.0.1:5000/app:1", Reference{"10.0.0.1:5000", "app", "1", ""}, "10.0.0.1:5000/app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := Parse(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("Parse(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+			if got.Familiar() != tt.familiar {
+				t.Fatalf("Familiar() = %q, want %q", got.Familiar(), tt.familiar)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, in := range []string{"", "Redis", "redis:", "redis@sha256:12", "a//b"} {
+		if _, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) succeeded", in)
+		}
+	}
+}
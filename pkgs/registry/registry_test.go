@@ -0,0 +1,194 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"go_pull/pkgs/model"
+	"go_pull/pkgs/store"
+	"go_pull/pkgs/util/logtool"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func init() {
+	logtool.InitEvent("error")
+}
+
+const layer = "layer content"
+
+var (
+	config   = `{"architecture":"amd64","os":"linux","rootfs":{"type":"layers","diff_ids":[]}}`
+	manifest = fmt.Sprintf(`{"schemaVersion":2,"mediaType":"%v",`+
+		`"config":{"mediaType":"%v","digest":"%v","size":%v},`+
+		`"layers":[{"mediaType":"%v","digest":"%v","size":%v}]}`,
+		model.MediaTypeManifest, model.MediaTypeImageConfig, digest.FromString(config), len(config),
+		model.MediaTypeLayer, digest.FromString(layer), len(layer))
+)
+
+func get(t *testing.T, h http.Handler, method string, path string, heads ...string) *http.Response {
+	req := httptest.NewRequest(method, path, nil)
+	for i := 0; i+1 < len(heads); i += 2 {
+		req.Header.Set(heads[i], heads[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func body(resp *http.Response) string {
+	b, _ := io.ReadAll(resp.Body)
+	return string(b)
+}
+
+func newStore(t *testing.T) *store.Store {
+	s, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestServe(t *testing.T) {
+	s := newStore(t)
+	for _, b := range []string{config, layer, manifest} {
+		if err := s.Put(digest.FromString(b).String(), []byte(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mdgst := digest.FromString(manifest).String()
+	for _, tag := range []string{"1", "2", "latest"} {
+		if err := s.Tag("lib/app", tag, mdgst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Tag("base", "latest", mdgst)
+	srv := &Server{Store: s}
+
+	if resp := get(t, srv, "GET", "/v2/"); resp.StatusCode != 200 || resp.Header.Get("Docker-Distribution-API-Version") != "registry/2.0" {
+		t.Fatalf("/v2/: %v", resp.Status)
+	}
+	for _, ref := range []string{"latest", mdgst} {
+		resp := get(t, srv, "GET", "/v2/lib/app/manifests/"+ref)
+		if got := body(resp); resp.StatusCode != 200 || got != manifest ||
+			resp.Header.Get("Docker-Content-Digest") != mdgst || resp.Header.Get("Content-Type") != model.MediaTypeManifest {
+			t.Fatalf("manifest %v: %v %v %q", ref, resp.Status, resp.Header, got)
+		}
+	}
+	if resp := get(t, srv, "HEAD", "/v2/lib/app/manifests/2"); resp.StatusCode != 200 || body(resp) != "" ||
+		resp.Header.Get("Content-Length") != fmt.Sprint(len(manifest)) {
+		t.Fatalf("HEAD manifest: %v", resp.Status)
+	}
+	resp := get(t, srv, "GET", "/v2/lib/app/blobs/"+digest.FromString(layer).String(), "Range", "bytes=6-")
+	if got := body(resp); resp.StatusCode != 206 || got != layer[6:] {
+		t.Fatalf("range: %v %q", resp.Status, got)
+	}
+
+	resp = get(t, srv, "GET", "/v2/lib/app/tags/list?n=2")
+	if got := body(resp); resp.StatusCode != 200 || strings.TrimSpace(got) != `{"name":"lib/app","tags":["1","2"]}` ||
+		resp.Header.Get("Link") != `</v2/lib/app/tags/list?last=2&n=2>; rel="next"` {
+		t.Fatalf("tags: %v %v %q", resp.Status, resp.Header.Get("Link"), got)
+	}
+	if got := body(get(t, srv, "GET", "/v2/lib/app/tags/list?n=2&last=2")); strings.TrimSpace(got) != `{"name":"lib/app","tags":["latest"]}` {
+		t.Fatalf("second page: %q", got)
+	}
+	if got := body(get(t, srv, "GET", "/v2/_catalog")); strings.TrimSpace(got) != `{"repositories":["base","lib/app"]}` {
+		t.Fatalf("catalog: %q", got)
+	}
+
+	for path, want := range map[string]string{
+		"/v2/lib/app/manifests/3":                                    "MANIFEST_UNKNOWN",
+		"/v2/lib/app/manifests/" + digest.FromString(layer).String(): "MANIFEST_UNKNOWN",
+		"/v2/lib/app/blobs/" + digest.FromString("none").String():    "BLOB_UNKNOWN",
+		"/v2/nothing/tags/list":                                      "NAME_UNKNOWN",
+	} {
+		resp := get(t, srv, "GET", path)
+		var e struct{ Errors []apiError }
+		json.NewDecoder(resp.Body).Decode(&e)
+		if resp.StatusCode != 404 || len(e.Errors) != 1 || e.Errors[0].Code != want {
+			t.Errorf("%v: %v %+v, want %v", path, resp.Status, e, want)
+		}
+	}
+	if resp := get(t, srv, "PUT", "/v2/lib/app/manifests/latest"); resp.StatusCode != 405 {
+		t.Fatalf("PUT: %v", resp.Status)
+	}
+}
+
+func TestServeUpstream(t *testing.T) {
+	blobs := map[string]string{}
+	for _, b := range []string{config, layer, manifest} {
+		blobs[digest.FromString(b).String()] = b
+	}
+	hits := map[string]int{}
+	latest := manifest
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("Www-Authenticate", `Bearer realm="http://`+r.Host+`/token",service="test"`)
+			if r.URL.Path == "/token" && r.URL.Query().Get("scope") == "repository:lib/app:pull" {
+				fmt.Fprint(w, `{"token":"secret","expires_in":300}`)
+				return
+			}
+			w.WriteHeader(401)
+			return
+		}
+		switch p := r.URL.Path; {
+		case p == "/v2/lib/app/manifests/latest":
+			w.Header().Set("Content-Type", model.MediaTypeManifest)
+			w.Header().Set("Docker-Content-Digest", digest.FromString(latest).String())
+			fmt.Fprint(w, latest)
+		case p == "/v2/lib/app/tags/list":
+			fmt.Fprint(w, `{"name":"lib/app","tags":["latest"]}`)
+		case strings.HasPrefix(p, "/v2/lib/app/blobs/") && blobs[strings.TrimPrefix(p, "/v2/lib/app/blobs/")] != "":
+			fmt.Fprint(w, blobs[strings.TrimPrefix(p, "/v2/lib/app/blobs/")])
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer up.Close()
+	s := newStore(t)
+	srv := &Server{Store: s, Upstream: &Upstream{URL: up.URL}, TagTTL: time.Hour}
+
+	ldgst := digest.FromString(layer).String()
+	for i := 0; i < 2; i++ {
+		if resp := get(t, srv, "GET", "/v2/lib/app/manifests/latest"); resp.StatusCode != 200 || body(resp) != manifest {
+			t.Fatalf("proxied manifest: %v", resp.Status)
+		}
+		if resp := get(t, srv, "GET", "/v2/lib/app/blobs/"+ldgst); resp.StatusCode != 200 || body(resp) != layer {
+			t.Fatalf("proxied blob: %v", resp.Status)
+		}
+	}
+	// the second pull is served from the store
+	if hits["/v2/lib/app/manifests/latest"] != 2 || hits["/v2/lib/app/blobs/"+ldgst] != 1 {
+		t.Fatalf("upstream hits: %v", hits)
+	}
+	if got, err := s.Resolve("lib/app", "latest"); err != nil || got != digest.FromString(manifest).String() {
+		t.Fatalf("cached tag: %v %v", got, err)
+	}
+	if resp := get(t, srv, "GET", "/v2/lib/app/blobs/"+digest.FromString("none").String()); resp.StatusCode != 404 {
+		t.Fatalf("missing upstream blob: %v", resp.Status)
+	}
+
+	// once the TTL passed, a HEAD tells the tag moved
+	srv.TagTTL = 0
+	if resp := get(t, srv, "GET", "/v2/lib/app/manifests/latest"); body(resp) != manifest || hits["/v2/lib/app/manifests/latest"] != 3 {
+		t.Fatalf("unmoved tag: %v, %v upstream hits", resp.Status, hits["/v2/lib/app/manifests/latest"])
+	}
+	latest = strings.Replace(manifest, `"schemaVersion":2`, `"schemaVersion": 2`, 1)
+	if resp := get(t, srv, "GET", "/v2/lib/app/manifests/latest"); body(resp) != latest {
+		t.Fatalf("moved tag served %v", resp.Header.Get("Docker-Content-Digest"))
+	}
+	if got, _ := s.Resolve("lib/app", "latest"); got != digest.FromString(latest).String() {
+		t.Fatalf("moved tag kept as %v", got)
+	}
+	// the store serves what it has while the upstream is down
+	up.Close()
+	if resp := get(t, srv, "GET", "/v2/lib/app/manifests/latest"); body(resp) != latest {
+		t.Fatalf("upstream down: %v", resp.Status)
+	}
+}
@@ -0,0 +1,385 @@
+// Package registry serves the content store over the read side of the
+// registry v2 API, so a docker pull or a containerd mirror can pull what
+// gopull downloaded without a registry of its own. What the store lacks can
+// be fetched from an upstream registry and is kept for the next pull.
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/model"
+	"go_pull/pkgs/store"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// maxManifest is the largest blob served as a manifest.
+const maxManifest = 4 << 20
+
+// Server is an http.Handler for the /v2/ API over a store.
+type Server struct {
+	Store *store.Store
+	// Upstream is where manifests, tags and blobs missing from the store
+	// are fetched from, nil to serve the store alone
+	Upstream *Upstream
+	// TagTTL is how long a tag is served from the store before the
+	// upstream is asked again whether it moved, 0 to ask on every pull
+	TagTTL time.Duration
+
+	mu       sync.Mutex
+	fetching map[string]chan struct{} // by digest
+	checked  map[string]time.Time     // when the upstream had a tag, by name:tag
+}
+
+// apiError is an error of the registry API, as the distribution spec has it.
+type apiError struct {
+	status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newError(status int, code string, format string, a ...interface{}) *apiError {
+	return &apiError{status: status, Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// notFound turns an error of the store or the upstream into code when it is
+// a missing repository, tag or blob.
+func notFound(err error, code string) error {
+	switch errdefs.KindOf(err) {
+	case errdefs.NotFound:
+		return newError(http.StatusNotFound, code, "%v", err)
+	case errdefs.Usage:
+		return newError(http.StatusBadRequest, "NAME_INVALID", "%v", err)
+	}
+	return err
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if err := s.serve(w, r); err != nil {
+		var e *apiError
+		if !errors.As(err, &e) {
+			e = newError(http.StatusBadGateway, "UNKNOWN", "%v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(e.status)
+		if r.Method != http.MethodHead {
+			json.NewEncoder(w).Encode(map[string][]*apiError{"errors": {e}})
+		}
+	}
+}
+
+// serve routes r, the name of a repository may itself hold slashes.
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return newError(http.StatusMethodNotAllowed, "UNSUPPORTED", "%v is not supported, the registry is read-only", r.Method)
+	}
+	p, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok {
+		return newError(http.StatusNotFound, "NOT_FOUND", "%v is not in the v2 API", r.URL.Path)
+	}
+	switch {
+	case p == "":
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, "{}")
+		return nil
+	case p == "_catalog":
+		return s.catalog(w, r)
+	case strings.HasSuffix(p, "/tags/list"):
+		return s.tags(w, r, strings.TrimSuffix(p, "/tags/list"))
+	}
+	if i := strings.LastIndex(p, "/manifests/"); i > 0 {
+		return s.manifest(w, r, p[:i], p[i+len("/manifests/"):])
+	}
+	if i := strings.LastIndex(p, "/blobs/"); i > 0 {
+		return s.blob(w, r, p[:i], p[i+len("/blobs/"):])
+	}
+	return newError(http.StatusNotFound, "NOT_FOUND", "%v is not in the v2 API", r.URL.Path)
+}
+
+func (s *Server) catalog(w http.ResponseWriter, r *http.Request) error {
+	repos, err := s.Store.Repositories()
+	if err != nil {
+		return err
+	}
+	return writeList(w, r, "repositories", repos, map[string]interface{}{})
+}
+
+func (s *Server) tags(w http.ResponseWriter, r *http.Request, name string) error {
+	tags, err := s.Store.Tags(name)
+	if errdefs.KindOf(err) == errdefs.NotFound && s.Upstream != nil {
+		body, err := s.Upstream.Tags(name)
+		if err != nil {
+			return notFound(err, "NAME_UNKNOWN")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+		return nil
+	}
+	if err != nil {
+		return notFound(err, "NAME_UNKNOWN")
+	}
+	return writeList(w, r, "tags", tags, map[string]interface{}{"name": name})
+}
+
+// writeList writes the sorted list as key of doc, a page of n after last
+// when the query asks for one, with a Link to the next page.
+func writeList(w http.ResponseWriter, r *http.Request, key string, list []string, doc map[string]interface{}) error {
+	q := r.URL.Query()
+	if last := q.Get("last"); last != "" {
+		list = list[sort.SearchStrings(list, last):]
+		if len(list) > 0 && list[0] == last {
+			list = list[1:]
+		}
+	}
+	if q.Has("n") {
+		n, err := strconv.Atoi(q.Get("n"))
+		if err != nil || n < 0 {
+			return newError(http.StatusBadRequest, "PAGINATION_NUMBER_INVALID", "invalid n %q", q.Get("n"))
+		}
+		if n < len(list) {
+			list = list[:n]
+			if n > 0 {
+				next := url.Values{"n": {strconv.Itoa(n)}, "last": {list[n-1]}}
+				w.Header().Set("Link", fmt.Sprintf(`<%v?%v>; rel="next"`, r.URL.Path, next.Encode()))
+			}
+		}
+	}
+	if list == nil {
+		list = []string{}
+	}
+	doc[key] = list
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(doc)
+}
+
+// manifest serves the manifest ref of name, a tag or a digest.
+func (s *Server) manifest(w http.ResponseWriter, r *http.Request, name string, ref string) error {
+	dgst := ref
+	if digest.Digest(ref).Validate() != nil {
+		var err error
+		dgst, err = s.resolve(name, ref)
+		if err != nil {
+			return notFound(err, "MANIFEST_UNKNOWN")
+		}
+	} else if _, ok := s.Store.Has(dgst); !ok {
+		if s.Upstream == nil {
+			return newError(http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest %v is not in the store", dgst)
+		}
+		if _, err := s.fetchManifest(name, dgst); err != nil {
+			return notFound(err, "MANIFEST_UNKNOWN")
+		}
+	}
+	if size, ok := s.Store.Has(dgst); !ok || size > maxManifest {
+		return newError(http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest %v is not in the store", dgst)
+	}
+	f, err := s.Store.Open(dgst)
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	mediaType, err := manifestType(body)
+	if err != nil {
+		return newError(http.StatusNotFound, "MANIFEST_UNKNOWN", "%v is not a manifest: %v", dgst, err)
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", dgst)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+	return nil
+}
+
+// manifestType is the media type a manifest is served with: the one it
+// tells, or the one its fields make it.
+func manifestType(body []byte) (string, error) {
+	var probe struct {
+		MediaType  string          `json:"mediaType"`
+		Signatures json.RawMessage `json:"signatures"`
+	}
+	kind, err := model.Kind("", body)
+	if err != nil {
+		return "", err
+	}
+	json.Unmarshal(body, &probe)
+	switch {
+	case probe.MediaType != "":
+		return probe.MediaType, nil
+	case kind == model.MediaTypeSchema1 && probe.Signatures != nil:
+		return model.MediaTypeSchema1Signed, nil
+	case kind == model.MediaTypeManifestList:
+		// docker lists always tell their type, OCI may leave it out
+		return model.MediaTypeOCIIndex, nil
+	case kind == model.MediaTypeManifest:
+		return model.MediaTypeOCIManifest, nil
+	}
+	return kind, nil
+}
+
+// resolve returns the digest of the tag of name. With an upstream, a tag
+// of the store older than TagTTL is checked with a HEAD and fetched again
+// when it moved. The store keeps serving it while the upstream fails.
+func (s *Server) resolve(name string, tag string) (string, error) {
+	dgst, err := s.Store.Resolve(name, tag)
+	if s.Upstream == nil {
+		return dgst, err
+	}
+	if errdefs.KindOf(err) == errdefs.NotFound {
+		return s.fetchManifest(name, tag)
+	}
+	if err != nil || s.fresh(name, tag) {
+		return dgst, err
+	}
+	current, err := s.Upstream.Digest(name, tag)
+	switch {
+	case err != nil:
+		return dgst, nil
+	case current == dgst:
+		s.check(name, tag)
+		return dgst, nil
+	}
+	if current, err := s.fetchManifest(name, tag); err == nil {
+		return current, nil
+	}
+	return dgst, nil
+}
+
+// fresh tells whether the upstream had the tag of name less than TagTTL
+// ago.
+func (s *Server) fresh(name string, tag string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.checked[name+":"+tag]
+	return ok && time.Since(t) < s.TagTTL
+}
+
+// check records that the upstream has the tag of name as the store does.
+func (s *Server) check(name string, tag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.checked == nil {
+		s.checked = map[string]time.Time{}
+	}
+	s.checked[name+":"+tag] = time.Now()
+}
+
+// fetchManifest keeps the manifest ref of name from the upstream in the
+// store, tagged when ref is a tag, and returns its digest.
+func (s *Server) fetchManifest(name string, ref string) (string, error) {
+	body, err := s.Upstream.Manifest(name, ref)
+	if err != nil {
+		return "", err
+	}
+	dgst := digest.FromBytes(body).String()
+	istag := digest.Digest(ref).Validate() != nil
+	if !istag && dgst != ref {
+		return "", errdefs.Errorf(errdefs.DigestMismatch, "upstream sent manifest %v for %v", dgst, ref)
+	}
+	if err := s.Store.Put(dgst, body); err != nil {
+		return "", err
+	}
+	if istag {
+		if err := s.Store.Tag(name, ref, dgst); err != nil {
+			return "", err
+		}
+		s.check(name, ref)
+	}
+	return dgst, nil
+}
+
+// blob serves the blob dgst, with ranges.
+func (s *Server) blob(w http.ResponseWriter, r *http.Request, name string, dgst string) error {
+	if digest.Digest(dgst).Validate() != nil || s.Store.Path(dgst) == "" {
+		return newError(http.StatusBadRequest, "DIGEST_INVALID", "invalid digest %q", dgst)
+	}
+	if _, ok := s.Store.Has(dgst); !ok {
+		if s.Upstream == nil {
+			return newError(http.StatusNotFound, "BLOB_UNKNOWN", "blob %v is not in the store", dgst)
+		}
+		if err := s.fetchBlob(name, dgst); err != nil {
+			return notFound(err, "BLOB_UNKNOWN")
+		}
+	}
+	f, err := s.Store.Open(dgst)
+	if errors.Is(err, os.ErrNotExist) {
+		return newError(http.StatusNotFound, "BLOB_UNKNOWN", "blob %v is not in the store", dgst)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", dgst)
+	w.Header().Set("Etag", `"`+dgst+`"`)
+	w.Header().Set("Cache-Control", "max-age=31536000")
+	http.ServeContent(w, r, "", st.ModTime(), f)
+	return nil
+}
+
+// fetchBlob keeps the blob dgst of name from the upstream in the store.
+// Concurrent requests for a blob wait for the one fetching it.
+func (s *Server) fetchBlob(name string, dgst string) error {
+	s.mu.Lock()
+	if s.fetching == nil {
+		s.fetching = map[string]chan struct{}{}
+	}
+	if done, ok := s.fetching[dgst]; ok {
+		s.mu.Unlock()
+		<-done
+		if _, ok := s.Store.Has(dgst); !ok {
+			return errdefs.Errorf(errdefs.NotFound, "blob %v could not be fetched", dgst)
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	s.fetching[dgst] = done
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.fetching, dgst)
+		s.mu.Unlock()
+		close(done)
+	}()
+
+	body, err := s.Upstream.Blob(name, dgst)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	b, err := s.Store.Create(dgst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(b, body); err != nil {
+		b.Abort()
+		return err
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	return b.Close()
+}
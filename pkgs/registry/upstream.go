@@ -0,0 +1,180 @@
+package registry
+
+import (
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/model"
+	"go_pull/pkgs/util/request"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// manifestAccept are the manifests asked of the upstream registry.
+var manifestAccept = strings.Join([]string{
+	model.MediaTypeManifestList,
+	model.MediaTypeManifest,
+	model.MediaTypeOCIIndex,
+	model.MediaTypeOCIManifest,
+	model.MediaTypeSchema1Signed,
+	model.MediaTypeSchema1,
+}, ", ")
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// Upstream is the registry the server fetches what the store lacks from.
+type Upstream struct {
+	// URL is the scheme and host of the registry, https://registry-1.docker.io
+	URL string
+	// Login is the Authorization header of the credentials for the
+	// registry, "" to pull anonymously
+	Login string
+
+	mu     sync.Mutex
+	tokens map[string]token // by repository
+}
+
+type token struct {
+	header  string
+	expires time.Time
+}
+
+// Manifest fetches the manifest ref, a tag or digest, of repo.
+func (u *Upstream) Manifest(repo string, ref string) ([]byte, error) {
+	resp, err := u.get(repo, "/manifests/"+ref, manifestAccept, false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(), nil
+}
+
+// Digest asks the digest of the manifest tag of repo with a HEAD, "" when
+// the registry does not tell it.
+func (u *Upstream) Digest(repo string, tag string) (string, error) {
+	resp, err := u.send(true, repo, "/manifests/"+tag, manifestAccept, false)
+	if err != nil {
+		return "", err
+	}
+	return resp.Header().Get("Docker-Content-Digest"), nil
+}
+
+// Blob fetches the blob of dgst from repo. The caller closes the body.
+func (u *Upstream) Blob(repo string, dgst string) (io.ReadCloser, error) {
+	resp, err := u.get(repo, "/blobs/"+dgst, "", true)
+	if err != nil {
+		return nil, err
+	}
+	return resp.RawBody(), nil
+}
+
+// Tags fetches the tag list of repo, as the registry sends it.
+func (u *Upstream) Tags(repo string) ([]byte, error) {
+	resp, err := u.get(repo, "/tags/list", "", false)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(), nil
+}
+
+// get sends a GET for path of repo, logging in when the registry asks to.
+func (u *Upstream) get(repo string, path string, accept string, stream bool) (*resty.Response, error) {
+	return u.send(false, repo, path, accept, stream)
+}
+
+// send is get, or a HEAD when head is set.
+func (u *Upstream) send(head bool, repo string, path string, accept string, stream bool) (*resty.Response, error) {
+	method, url := "GET", u.URL+"/v2/"+repo+path
+	if head {
+		method = "HEAD"
+	}
+	for try := 0; ; try++ {
+		heads := map[string]string{}
+		if accept != "" {
+			heads["Accept"] = accept
+		}
+		if auth := u.auth(repo); auth != "" {
+			heads["Authorization"] = auth
+		}
+		req := request.Requests(url).Setheads(heads).Settls()
+		if stream {
+			req.Notparse()
+		}
+		send := req.Get
+		if head {
+			send = req.Head
+		}
+		resp, err := send()
+		if err == nil && resp.StatusCode() == 200 {
+			return resp, nil
+		}
+		if stream && resp != nil && resp.RawBody() != nil {
+			resp.RawBody().Close()
+		}
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode() != 401 || try > 0 {
+			return nil, errdefs.Errorf(errdefs.HTTPStatus(resp.StatusCode()), "%v %v: HTTP %v", method, url, resp.Status())
+		}
+		if err := u.login(repo, resp.Header().Get("Www-Authenticate")); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// auth returns the Authorization header known for repo.
+func (u *Upstream) auth(repo string) string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if t, ok := u.tokens[repo]; ok && time.Now().Before(t.expires) {
+		return t.header
+	}
+	return ""
+}
+
+// login answers the challenge of the registry: basic with the credentials,
+// or a bearer token for pulling repo.
+func (u *Upstream) login(repo string, challenge string) error {
+	t := token{header: u.Login, expires: time.Now().AddDate(1, 0, 0)}
+	if !strings.HasPrefix(strings.ToLower(challenge), "bearer") {
+		if u.Login == "" {
+			return errdefs.Errorf(errdefs.Unauthorized, "%v asks for a login, set username and password for it in the config", u.URL)
+		}
+	} else {
+		params := map[string]string{}
+		for _, m := range challengeParam.FindAllStringSubmatch(challenge, -1) {
+			params[strings.ToLower(m[1])] = m[2]
+		}
+		if params["realm"] == "" {
+			return fmt.Errorf("%v: no realm in challenge %q", u.URL, challenge)
+		}
+		req := request.Requests(params["realm"] + "?service=" + params["service"] +
+			"&scope=repository:" + repo + ":pull").Settls()
+		if u.Login != "" {
+			req.Setheads(map[string]string{"Authorization": u.Login})
+		}
+		resp, err := req.Get()
+		if err == nil && resp.StatusCode() != 200 {
+			err = errdefs.Errorf(errdefs.HTTPStatus(resp.StatusCode()), "HTTP %v", resp.Status())
+		}
+		if err != nil {
+			return fmt.Errorf("cannot get a token for %v: %w", repo, err)
+		}
+		tok, err := model.ParseToken(resp.Body(), time.Now())
+		if err != nil {
+			return err
+		}
+		t = token{header: "Bearer " + tok.Token, expires: tok.Expires().Add(-2 * time.Second)}
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.tokens == nil {
+		u.tokens = map[string]token{}
+	}
+	u.tokens[repo] = t
+	return nil
+}
@@ -0,0 +1,209 @@
+// Package scan finds the images a deployment uses: in Kubernetes manifests
+// and the output of helm template, in docker compose files and in the FROM
+// and COPY --from lines of Dockerfiles.
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// containerLists are the fields of a Kubernetes pod spec holding containers.
+var containerLists = map[string]bool{"containers": true, "initContainers": true, "ephemeralContainers": true}
+
+// Dockerfile tells whether name is a Dockerfile by its name: Dockerfile,
+// Containerfile, Dockerfile.<anything> or <anything>.dockerfile.
+func Dockerfile(name string) bool {
+	base := filepath.Base(name)
+	lower := strings.ToLower(base)
+	return base == "Dockerfile" || base == "Containerfile" ||
+		strings.HasPrefix(base, "Dockerfile.") || strings.HasSuffix(lower, ".dockerfile")
+}
+
+// File returns the image references of file name, in the order they appear.
+// Dockerfiles are told by their name, everything else is read as yaml.
+// References are returned as written, ARGs a Dockerfile gives no default
+// stay unexpanded.
+func File(name string, data []byte) ([]string, error) {
+	if Dockerfile(name) {
+		return dockerfile(data)
+	}
+	var refs []string
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	for {
+		var doc interface{}
+		err := dec.Decode(&doc)
+		if err == io.EOF {
+			return refs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		if services, ok := compose(doc); ok {
+			for _, s := range services {
+				refs = appendImage(refs, s)
+			}
+			continue
+		}
+		refs = kubernetes(refs, doc)
+	}
+}
+
+// compose returns the services of a compose file.
+func compose(doc interface{}) ([]interface{}, bool) {
+	m, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	services, ok := m["services"].(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	var list []interface{}
+	for _, name := range sortedKeys(services) {
+		list = append(list, services[name])
+	}
+	return list, true
+}
+
+// kubernetes walks a Kubernetes object, or a List of them, for the images of
+// its containers wherever the pod spec is: in a Pod, the template of a
+// Deployment or the job template of a CronJob.
+func kubernetes(refs []string, v interface{}) []string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(v) {
+			if list, ok := v[k].([]interface{}); ok && containerLists[k] {
+				for _, c := range list {
+					refs = appendImage(refs, c)
+				}
+				continue
+			}
+			refs = kubernetes(refs, v[k])
+		}
+	case []interface{}:
+		for _, e := range v {
+			refs = kubernetes(refs, e)
+		}
+	}
+	return refs
+}
+
+// sortedKeys lists the keys of m, the order of a yaml mapping being lost on
+// decoding: the containers of a pod spec first, init containers leading,
+// then the others sorted.
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for _, k := range []string{"initContainers", "containers", "ephemeralContainers"} {
+		if _, ok := m[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+	var rest []string
+	for k := range m {
+		if !containerLists[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	return append(keys, rest...)
+}
+
+// appendImage appends the image of a container or service, if it has one.
+func appendImage(refs []string, v interface{}) []string {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return refs
+	}
+	if image, ok := m["image"].(string); ok && strings.TrimSpace(image) != "" {
+		refs = append(refs, strings.TrimSpace(image))
+	}
+	return refs
+}
+
+var argRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// dockerfile returns the images of the FROM and COPY --from lines. Stages
+// built by the Dockerfile and scratch are not images to pull. The ARGs
+// declared before the first FROM are expanded with their defaults.
+func dockerfile(data []byte) ([]string, error) {
+	var refs []string
+	args := map[string]string{}
+	stages := map[string]bool{}
+	from := false
+	s := bufio.NewScanner(bytes.NewReader(data))
+	var line string
+	for s.Scan() {
+		text := strings.TrimSpace(s.Text())
+		if line == "" && strings.HasPrefix(text, "#") {
+			continue
+		}
+		if strings.HasSuffix(text, `\`) {
+			line += strings.TrimSuffix(text, `\`) + " "
+			continue
+		}
+		line += text
+		fields := strings.Fields(line)
+		line = ""
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			if from {
+				continue
+			}
+			for _, a := range fields[1:] {
+				k, v, _ := strings.Cut(a, "=")
+				args[k] = strings.Trim(v, `"'`)
+			}
+		case "FROM":
+			from = true
+			rest := flags(fields[1:])
+			if len(rest) == 0 {
+				continue
+			}
+			image := argRef.ReplaceAllStringFunc(rest[0], func(ref string) string {
+				m := argRef.FindStringSubmatch(ref)
+				if v := args[m[1]+m[2]]; v != "" {
+					return v
+				}
+				return ref
+			})
+			if image != "scratch" && !stages[strings.ToLower(image)] {
+				refs = append(refs, image)
+			}
+			if len(rest) >= 3 && strings.EqualFold(rest[1], "AS") {
+				stages[strings.ToLower(rest[2])] = true
+			}
+		case "COPY":
+			for _, f := range fields[1:] {
+				image, ok := strings.CutPrefix(f, "--from=")
+				if !ok {
+					continue
+				}
+				if _, err := strconv.Atoi(image); err != nil && !stages[strings.ToLower(image)] {
+					refs = append(refs, image)
+				}
+			}
+		}
+	}
+	return refs, s.Err()
+}
+
+// flags drops the --flags of an instruction.
+func flags(fields []string) []string {
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		fields = fields[1:]
+	}
+	return fields
+}
@@ -0,0 +1,102 @@
+package scan
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestKubernetes(t *testing.T) {
+	refs, err := File("app.yaml", []byte(`
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: registry.example.com/app:1.2
+        - name: sidecar
+          image: envoyproxy/envoy:v1.29
+      initContainers:
+        - name: migrate
+          image: registry.example.com/app:1.2
+---
+# empty document of helm template
+---
+apiVersion: batch/v1
+kind: CronJob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+            - image: busybox
+---
+apiVersion: v1
+kind: Pod
+spec:
+  containers:
+    - image: nginx@sha256:0000000000000000000000000000000000000000000000000000000000000000
+  ephemeralContainers:
+    - image: debian:12
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"registry.example.com/app:1.2", "registry.example.com/app:1.2", "envoyproxy/envoy:v1.29",
+		"busybox", "nginx@sha256:0000000000000000000000000000000000000000000000000000000000000000", "debian:12"}
+	if !reflect.DeepEqual(refs, want) {
+		t.Fatalf("refs %v", refs)
+	}
+}
+
+func TestCompose(t *testing.T) {
+	refs, err := File("docker-compose.yml", []byte(`
+services:
+  web:
+    build: .
+  db:
+    image: postgres:16
+  cache:
+    image: redis:7
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"redis:7", "postgres:16"}; !reflect.DeepEqual(refs, want) {
+		t.Fatalf("refs %v", refs)
+	}
+}
+
+func TestDockerfile(t *testing.T) {
+	refs, err := File("build/Dockerfile.prod", []byte(`
+# syntax=docker/dockerfile:1
+ARG GO=1.22 BASE
+FROM --platform=$BUILDPLATFORM golang:${GO} AS build
+COPY --from=tools/linter:2 /bin/lint /bin/
+RUN go build
+FROM build AS test
+FROM scratch AS empty
+FROM \
+  alpine:3.19
+COPY --from=build /app /app
+COPY --from=0 /x /x
+FROM $BASE
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"golang:1.22", "tools/linter:2", "alpine:3.19", "$BASE"}; !reflect.DeepEqual(refs, want) {
+		t.Fatalf("refs %v", refs)
+	}
+	if !Dockerfile("Containerfile") || !Dockerfile("api.Dockerfile") || Dockerfile("Dockerfile.yaml.txt/x.yaml") {
+		t.Fatal("Dockerfile names")
+	}
+}
+
+func TestFileError(t *testing.T) {
+	if _, err := File("bad.yaml", []byte("a: [")); err == nil {
+		t.Fatal("invalid yaml accepted")
+	}
+}
@@ -0,0 +1,385 @@
+// Package signing writes and checks the signed manifest of files carried
+// across an air gap: every file with its size and sha256, signed with an
+// ed25519 key or the key of an X.509 certificate. The signature is detached,
+// next to the manifest, over its exact bytes.
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// ManifestName is the default file name of a manifest.
+	ManifestName = "gopull-manifest.json"
+	// SignatureSuffix is added to the name of the manifest for its signature.
+	SignatureSuffix = ".sig"
+)
+
+// Manifest lists files by their path relative to the manifest, and the
+// directories signed as a whole, which hold no other file.
+type Manifest struct {
+	Files []File   `json:"files"`
+	Dirs  []string `json:"dirs,omitempty"` // slash separated, "." for the directory of the manifest
+}
+
+// File is a file of a manifest.
+type File struct {
+	Name   string `json:"name"` // slash separated, relative to the manifest
+	Size   int64  `json:"size"`
+	Digest string `json:"digest"`
+}
+
+// Build digests the files names, relative to dir.
+func Build(dir string, names []string) (*Manifest, error) {
+	m := &Manifest{}
+	for _, name := range names {
+		f := File{Name: filepath.ToSlash(name)}
+		if !filepath.IsLocal(name) {
+			return nil, fmt.Errorf("%v is not below %v", name, dir)
+		}
+		r, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		d := digest.SHA256.Digester()
+		f.Size, err = io.Copy(d.Hash(), r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", name, err)
+		}
+		f.Digest = d.Digest().String()
+		m.Files = append(m.Files, f)
+	}
+	return m, nil
+}
+
+// Parse reads a manifest.
+func Parse(data []byte) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("manifest: %v", err)
+	}
+	for _, f := range m.Files {
+		if !filepath.IsLocal(filepath.FromSlash(f.Name)) {
+			return nil, fmt.Errorf("manifest: %q is not below the manifest", f.Name)
+		}
+		if _, err := digest.Parse(f.Digest); err != nil {
+			return nil, fmt.Errorf("manifest: %v: %v", f.Name, err)
+		}
+	}
+	for _, d := range m.Dirs {
+		if !filepath.IsLocal(filepath.FromSlash(d)) {
+			return nil, fmt.Errorf("manifest: %q is not below the manifest", d)
+		}
+	}
+	return m, nil
+}
+
+// Problem is what is wrong with a file of a manifest.
+type Problem struct {
+	File
+	Err error
+}
+
+// Check reads every file of m, the manifest at path manifest, and returns
+// those missing or not matching their size or digest, then the regular
+// files below the directories of m it does not list. Files next to the
+// signed ones, such as the key, are no problem. Hidden files are left out,
+// as sign leaves them out, and so are the manifest and its signature.
+func Check(manifest string, m *Manifest) []Problem {
+	dir := filepath.Dir(manifest)
+	var problems []Problem
+	listed := map[string]bool{}
+	for _, f := range m.Files {
+		listed[f.Name] = true
+		if err := checkFile(dir, f); err != nil {
+			problems = append(problems, Problem{File: f, Err: err})
+		}
+	}
+	skip := map[string]bool{filepath.Clean(manifest): true, filepath.Clean(manifest) + SignatureSuffix: true}
+	for _, signed := range m.Dirs {
+		root := filepath.Join(dir, filepath.FromSlash(signed))
+		err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(d.Name(), ".") && p != root {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			rel, _ := filepath.Rel(dir, p)
+			name := filepath.ToSlash(rel)
+			if !d.Type().IsRegular() || skip[p] || listed[name] {
+				return nil
+			}
+			// a file below two signed directories is reported once
+			listed[name] = true
+			problems = append(problems, Problem{File: File{Name: name},
+				Err: errdefs.Errorf(errdefs.DigestMismatch, "not in the manifest")})
+			return nil
+		})
+		if err != nil {
+			problems = append(problems, Problem{File: File{Name: signed}, Err: err})
+		}
+	}
+	return problems
+}
+
+func checkFile(dir string, f File) error {
+	r, err := os.Open(filepath.Join(dir, filepath.FromSlash(f.Name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errdefs.Errorf(errdefs.NotFound, "missing")
+		}
+		return err
+	}
+	defer r.Close()
+	v := digest.Digest(f.Digest).Verifier()
+	n, err := io.Copy(v, r)
+	if err != nil {
+		return err
+	}
+	if n != f.Size {
+		return errdefs.Errorf(errdefs.DigestMismatch, "%v bytes instead of %v", n, f.Size)
+	}
+	if !v.Verified() {
+		return errdefs.Errorf(errdefs.DigestMismatch, "changed, its sha256 does not match the manifest")
+	}
+	return nil
+}
+
+// Signature is the detached signature of a manifest.
+type Signature struct {
+	// Algorithm is ed25519, or rsa-sha256 (PKCS #1 v1.5) or ecdsa-sha256
+	// for certificates
+	Algorithm string `json:"algorithm"`
+	Value     []byte `json:"signature"`
+	// Certificates is the chain of the key, leaf first, DER
+	Certificates [][]byte `json:"certificates,omitempty"`
+}
+
+// ParsePrivateKey reads a PEM private key: PKCS #8, or EC and RSA keys in
+// the formats of openssl.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM private key found")
+		}
+		var key any
+		var err error
+		switch block.Type {
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "ENCRYPTED PRIVATE KEY":
+			return nil, fmt.Errorf("encrypted private keys are not supported, decrypt it with openssl pkey")
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key %T", key)
+		}
+		return signer, nil
+	}
+}
+
+// ParseCertificates reads the PEM certificates of data, in order.
+func ParseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return certs, nil
+}
+
+// ParsePublicKey reads a PEM public key, or the key of the first PEM
+// certificate.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM public key or certificate found")
+		}
+		switch block.Type {
+		case "PUBLIC KEY":
+			return x509.ParsePKIXPublicKey(block.Bytes)
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			return cert.PublicKey, nil
+		}
+	}
+}
+
+// algorithm is the signature algorithm of key.
+func algorithm(key crypto.PublicKey) (string, error) {
+	switch key.(type) {
+	case ed25519.PublicKey:
+		return "ed25519", nil
+	case *rsa.PublicKey:
+		return "rsa-sha256", nil
+	case *ecdsa.PublicKey:
+		return "ecdsa-sha256", nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", key)
+}
+
+// Sign signs data with key. The chain, leaf first, is the certificate of key
+// and its intermediates, or nil for a bare ed25519 key.
+func Sign(data []byte, key crypto.Signer, chain []*x509.Certificate) (*Signature, error) {
+	alg, err := algorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 && alg != "ed25519" {
+		return nil, fmt.Errorf("an %v key signs with its X.509 certificate, none given", alg)
+	}
+	if len(chain) > 0 {
+		pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !pub.Equal(chain[0].PublicKey) {
+			return nil, fmt.Errorf("the certificate of %v is not that of the private key", subject(chain[0]))
+		}
+	}
+	s := &Signature{Algorithm: alg}
+	for _, c := range chain {
+		s.Certificates = append(s.Certificates, c.Raw)
+	}
+	if alg == "ed25519" {
+		s.Value, err = key.Sign(rand.Reader, data, crypto.Hash(0))
+	} else {
+		sum := sha256.Sum256(data)
+		s.Value, err = key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	}
+	return s, err
+}
+
+// Verify checks that s is a signature of data by key.
+func (s *Signature) Verify(data []byte, key crypto.PublicKey) error {
+	alg, err := algorithm(key)
+	if err != nil {
+		return err
+	}
+	if alg != s.Algorithm {
+		return errdefs.Errorf(errdefs.DigestMismatch, "signed with %v, the key is for %v", s.Algorithm, alg)
+	}
+	ok := false
+	sum := sha256.Sum256(data)
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, data, s.Value)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], s.Value) == nil
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, sum[:], s.Value)
+	}
+	if !ok {
+		return errdefs.Errorf(errdefs.DigestMismatch, "signature does not match, the manifest was changed or signed by another key")
+	}
+	return nil
+}
+
+// VerifyChain checks that the certificate s carries chains to roots and is
+// for code signing, then that s is a signature of data by its key. It
+// returns the certificate.
+func (s *Signature) VerifyChain(data []byte, roots *x509.CertPool) (*x509.Certificate, error) {
+	if len(s.Certificates) == 0 {
+		return nil, errdefs.Errorf(errdefs.DigestMismatch, "signed by a bare key, no certificate to check against the CA")
+	}
+	var chain []*x509.Certificate
+	for _, der := range s.Certificates {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, c)
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}})
+	if err != nil {
+		return nil, errdefs.Errorf(errdefs.DigestMismatch, "certificate %v: %v", subject(chain[0]), err)
+	}
+	// Verify lets a certificate without extended key usages through
+	if !codeSigning(chain[0]) {
+		return nil, errdefs.Errorf(errdefs.DigestMismatch, "certificate %v is not for code signing", subject(chain[0]))
+	}
+	return chain[0], s.Verify(data, chain[0].PublicKey)
+}
+
+// codeSigning tells whether c lists the code signing extended key usage.
+func codeSigning(c *x509.Certificate) bool {
+	for _, u := range c.ExtKeyUsage {
+		if u == x509.ExtKeyUsageCodeSigning {
+			return true
+		}
+	}
+	return false
+}
+
+func subject(c *x509.Certificate) string {
+	if c.Subject.CommonName != "" {
+		return c.Subject.CommonName
+	}
+	return strings.TrimSpace(c.Subject.String())
+}
+
+// Subject names the certificate of s, "" for a bare key.
+func (s *Signature) Subject() string {
+	if len(s.Certificates) == 0 {
+		return ""
+	}
+	c, err := x509.ParseCertificate(s.Certificates[0])
+	if err != nil {
+		return ""
+	}
+	return subject(c)
+}
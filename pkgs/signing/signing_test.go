@@ -0,0 +1,158 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"go_pull/pkgs/errdefs"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// certificate issues a certificate for key and usages, by parent and its
+// key, self signed when parent is nil.
+func certificate(t *testing.T, cn string, key crypto.Signer, parent *x509.Certificate, parentkey crypto.Signer,
+	usages ...x509.ExtKeyUsage) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           usages,
+	}
+	if parent == nil {
+		parent, parentkey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := x509.ParseCertificate(der)
+	return c
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "a.tar"), []byte("archive"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "b.tar"), []byte("other"), 0644)
+	m, err := Build(dir, []string{"a.tar", filepath.Join("sub", "b.tar")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Files[1].Name != "sub/b.tar" || m.Files[0].Size != 7 {
+		t.Fatalf("manifest %+v", m)
+	}
+	if _, err := Build(dir, []string{"../x"}); err == nil {
+		t.Fatal("file outside of dir accepted")
+	}
+	manifest := filepath.Join(dir, ManifestName)
+	for _, name := range []string{manifest, manifest + SignatureSuffix, filepath.Join(dir, ".a.tar.part")} {
+		os.WriteFile(name, []byte("{}"), 0644)
+	}
+	if p := Check(manifest, m); len(p) != 0 {
+		t.Fatalf("intact files reported: %v", p)
+	}
+	// only the directories signed as a whole hold no other file
+	m.Dirs = []string{"sub"}
+	os.WriteFile(filepath.Join(dir, "sign.pem"), []byte("key"), 0600)
+	os.WriteFile(filepath.Join(dir, "a.tar"), []byte("archivE"), 0644)
+	os.Remove(filepath.Join(dir, "sub", "b.tar"))
+	os.WriteFile(filepath.Join(dir, "sub", "c.tar"), []byte("smuggled"), 0644)
+	p := Check(manifest, m)
+	if len(p) != 3 || errdefs.KindOf(p[0].Err) != errdefs.DigestMismatch || errdefs.KindOf(p[1].Err) != errdefs.NotFound ||
+		p[2].Name != "sub/c.tar" {
+		t.Fatalf("problems %v", p)
+	}
+	m.Dirs = []string{"."}
+	if p := Check(manifest, m); len(p) != 4 || p[2].Name != "sign.pem" {
+		t.Fatalf("signed directory of the manifest: %v", p)
+	}
+	if _, err := Parse([]byte(`{"files":[{"name":"../etc/passwd","digest":"sha256:` +
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" + `"}]}`)); err == nil {
+		t.Fatal("manifest naming a file outside of it accepted")
+	}
+	if _, err := Parse([]byte(`{"files":[],"dirs":["../etc"]}`)); err == nil {
+		t.Fatal("manifest naming a directory outside of it accepted")
+	}
+}
+
+func TestEd25519(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(priv)
+	key, err := ParsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`{"files":[]}`)
+	sig, err := Sign(data, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ = x509.MarshalPKIXPublicKey(pub)
+	verifier, err := ParsePublicKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sig.Verify(data, verifier); err != nil {
+		t.Fatal(err)
+	}
+	if err := sig.Verify([]byte(`{"files":[1]}`), verifier); errdefs.KindOf(err) != errdefs.DigestMismatch {
+		t.Fatalf("changed manifest verified: %v", err)
+	}
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	if err := sig.Verify(data, other); err == nil {
+		t.Fatal("verified with another key")
+	}
+}
+
+func TestCertificate(t *testing.T) {
+	cakey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := certificate(t, "transfer CA", cakey, nil, nil)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := certificate(t, "build host", key, ca, cakey, x509.ExtKeyUsageCodeSigning)
+
+	data := []byte(`{"files":[]}`)
+	if _, err := Sign(data, key, nil); err == nil {
+		t.Fatal("ecdsa key signed without its certificate")
+	}
+	if _, err := Sign(data, cakey, []*x509.Certificate{leaf}); err == nil {
+		t.Fatal("signed with the key of another certificate")
+	}
+	sig, err := Sign(data, key, []*x509.Certificate{leaf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	c, err := sig.VerifyChain(data, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Subject.CommonName != "build host" || sig.Subject() != "build host" {
+		t.Fatalf("signed by %v", c.Subject)
+	}
+	if _, err := sig.VerifyChain(data, x509.NewCertPool()); err == nil {
+		t.Fatal("certificate of an unknown CA accepted")
+	}
+	// a certificate of the CA for anything else does not sign
+	for _, usages := range [][]x509.ExtKeyUsage{nil, {x509.ExtKeyUsageServerAuth}} {
+		other := certificate(t, "web server", key, ca, cakey, usages...)
+		sig, _ := Sign(data, key, []*x509.Certificate{other})
+		if _, err := sig.VerifyChain(data, roots); errdefs.KindOf(err) != errdefs.DigestMismatch {
+			t.Fatalf("certificate for %v accepted: %v", usages, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package store keeps downloaded blobs by digest, laid out like the blobs
+// directory of an OCI image layout, so they are reused across downloads.
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/util/shutdown"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Store is a directory of blobs named blobs/<algorithm>/<hex>.
+type Store struct {
+	Root string
+}
+
+// Open creates the blob directory under root when it does not exist.
+func Open(root string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(root, "blobs", "sha256"), 0755); err != nil {
+		return nil, err
+	}
+	return &Store{Root: root}, nil
+}
+
+// Path is where the blob of digest is kept, or "" for a malformed digest.
+func (s *Store) Path(digest string) string {
+	algo, hexs, ok := strings.Cut(digest, ":")
+	if !ok || algo != "sha256" || len(hexs) != sha256.Size*2 {
+		return ""
+	}
+	if _, err := hex.DecodeString(hexs); err != nil {
+		return ""
+	}
+	return filepath.Join(s.Root, "blobs", algo, hexs)
+}
+
+// Has returns the size of the blob of digest when it is in the store.
+func (s *Store) Has(digest string) (int64, bool) {
+	p := s.Path(digest)
+	if p == "" {
+		return 0, false
+	}
+	fi, err := os.Stat(p)
+	if err != nil || !fi.Mode().IsRegular() {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// Open opens the blob of digest for reading.
+func (s *Store) Open(digest string) (*os.File, error) {
+	p := s.Path(digest)
+	if p == "" {
+		return nil, fmt.Errorf("store: invalid digest %q", digest)
+	}
+	return os.Open(p)
+}
+
+// Create starts writing the blob of digest. The content is only visible in
+// the store after Commit checked it against the digest.
+func (s *Store) Create(digest string) (*Blob, error) {
+	p := s.Path(digest)
+	if p == "" {
+		return nil, fmt.Errorf("store: invalid digest %q", digest)
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".ingest-*")
+	if err != nil {
+		return nil, err
+	}
+	shutdown.Remove(f.Name())
+	return &Blob{f: f, digest: digest, path: p, h: sha256.New()}, nil
+}
+
+// Ingest starts writing a blob whose digest is only known once it is
+// written, Commit files it under the digest of its content.
+func (s *Store) Ingest() (*Blob, error) {
+	f, err := os.CreateTemp(filepath.Join(s.Root, "blobs", "sha256"), ".ingest-*")
+	if err != nil {
+		return nil, err
+	}
+	shutdown.Remove(f.Name())
+	return &Blob{f: f, h: sha256.New()}, nil
+}
+
+// Blob is a blob being written into the store. It is only written through
+// Write, which digests what it writes.
+type Blob struct {
+	f      *os.File
+	digest string
+	path   string
+	h      hash.Hash
+}
+
+func (b *Blob) Write(p []byte) (int, error) {
+	n, err := b.f.Write(p)
+	b.h.Write(p[:n])
+	return n, err
+}
+
+// Name is the temporary file the blob is written to.
+func (b *Blob) Name() string {
+	return b.f.Name()
+}
+
+// Close closes the blob, once committed or aborted.
+func (b *Blob) Close() error {
+	return b.f.Close()
+}
+
+// Commit moves the blob into place when its content matches the digest, and
+// discards it otherwise. The blob stays open until Close.
+func (b *Blob) Commit() error {
+	got := "sha256:" + hex.EncodeToString(b.h.Sum(nil))
+	if b.digest == "" {
+		b.digest = got
+		b.path = filepath.Join(filepath.Dir(b.f.Name()), hex.EncodeToString(b.h.Sum(nil)))
+	}
+	if got != b.digest {
+		b.Abort()
+		return errdefs.Errorf(errdefs.DigestMismatch, "store: digest mismatch, expected %v got %v", b.digest, got)
+	}
+	if err := b.f.Sync(); err != nil {
+		b.Abort()
+		return err
+	}
+	if err := os.Chmod(b.f.Name(), 0644); err != nil {
+		b.Abort()
+		return err
+	}
+	if err := os.Rename(b.f.Name(), b.path); err != nil {
+		return err
+	}
+	shutdown.Forget(b.f.Name())
+	return nil
+}
+
+// Digest is the digest of the blob, known for an ingested one once it is
+// committed.
+func (b *Blob) Digest() string {
+	return b.digest
+}
+
+// Abort closes and removes an uncommitted blob.
+func (b *Blob) Abort() {
+	b.f.Close()
+	os.Remove(b.f.Name())
+	shutdown.Forget(b.f.Name())
+}
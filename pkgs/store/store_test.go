@@ -0,0 +1,131 @@
+package store
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("layer content")
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	if _, ok := s.Has(digest); ok {
+		t.Fatal("empty store has a blob")
+	}
+
+	b, err := s.Create(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Write(data[:5])
+	// io.Copy goes through the digest too
+	io.Copy(b, bytes.NewReader(data[5:]))
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if n, ok := s.Has(digest); !ok || n != int64(len(data)) {
+		t.Fatalf("Has = %v, %v", n, ok)
+	}
+	f, err := s.Open(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if got, _ := io.ReadAll(f); string(got) != string(data) {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func TestStoreMismatch(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("expected")))
+	b, err := s.Create(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Write([]byte("something else"))
+	if err := b.Commit(); err == nil {
+		t.Fatal("mismatching blob committed")
+	}
+	if _, ok := s.Has(digest); ok {
+		t.Fatal("mismatching blob is in the store")
+	}
+	if _, err := os.Stat(b.Name()); !os.IsNotExist(err) {
+		t.Fatal("temporary file left behind")
+	}
+	if s.Path("sha256:../../etc") != "" || s.Path("md5:00") != "" {
+		t.Fatal("malformed digest accepted")
+	}
+}
+
+func TestIngest(t *testing.T) {
+	s, _ := Open(t.TempDir())
+	data := []byte("config of unknown digest")
+	b, err := s.Ingest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(b, bytes.NewReader(data))
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+	if b.Digest() != digest {
+		t.Fatalf("Digest = %v, want %v", b.Digest(), digest)
+	}
+	if n, ok := s.Has(digest); !ok || n != int64(len(data)) {
+		t.Fatalf("Has = %v, %v", n, ok)
+	}
+}
+
+func TestTags(t *testing.T) {
+	s, _ := Open(t.TempDir())
+	if repos, err := s.Repositories(); err != nil || len(repos) != 0 {
+		t.Fatalf("empty store has %v %v", repos, err)
+	}
+	manifest := []byte(`{"schemaVersion":2}`)
+	digest := fmt.Sprintf("sha256:%x", sha256.Sum256(manifest))
+	if err := s.Put(digest, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put(digest, []byte("other")); err != nil {
+		t.Fatal("second put of a stored blob not skipped")
+	}
+	for _, tag := range []string{"7", "latest"} {
+		if err := s.Tag("library/redis", tag, digest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Tag("lib/app", "v1", digest)
+	if got, err := s.Resolve("library/redis", "7"); err != nil || got != digest {
+		t.Fatalf("resolved %v %v", got, err)
+	}
+	if _, err := s.Resolve("library/redis", "6"); errdefs.KindOf(err) != errdefs.NotFound {
+		t.Fatalf("missing tag: %v", err)
+	}
+	if tags, _ := s.Tags("library/redis"); !reflect.DeepEqual(tags, []string{"7", "latest"}) {
+		t.Fatalf("tags %v", tags)
+	}
+	if repos, _ := s.Repositories(); !reflect.DeepEqual(repos, []string{"lib/app", "library/redis"}) {
+		t.Fatalf("repositories %v", repos)
+	}
+	for _, bad := range [][2]string{{"../x", "1"}, {"Upper/case", "1"}, {"ok", "../../x"}} {
+		if err := s.Tag(bad[0], bad[1], digest); err == nil {
+			t.Errorf("tag %v:%v accepted", bad[0], bad[1])
+		}
+	}
+}
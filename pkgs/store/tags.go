@@ -0,0 +1,146 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+var (
+	// repoPattern is a repository path as the distribution spec has it
+	repoPattern = regexp.MustCompile(`^[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*(/[a-z0-9]+((\.|_|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern  = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+)
+
+// tagPath is the file holding the digest tag of repo points to, under
+// repositories/<repo>/tags.
+func (s *Store) tagPath(repo string, tag string) (string, error) {
+	if !repoPattern.MatchString(repo) {
+		return "", errdefs.Errorf(errdefs.Usage, "store: invalid repository %q", repo)
+	}
+	if !tagPattern.MatchString(tag) {
+		return "", errdefs.Errorf(errdefs.Usage, "store: invalid tag %q", tag)
+	}
+	return filepath.Join(s.Root, "repositories", filepath.FromSlash(repo), "tags", tag), nil
+}
+
+// Put stores data as the blob of digest, unless the store has it.
+func (s *Store) Put(digest string, data []byte) error {
+	if _, ok := s.Has(digest); ok {
+		return nil
+	}
+	b, err := s.Create(digest)
+	if err != nil {
+		return err
+	}
+	if _, err := b.Write(data); err != nil {
+		b.Abort()
+		return err
+	}
+	if err := b.Commit(); err != nil {
+		return err
+	}
+	return b.Close()
+}
+
+// Tag points tag of repo to the manifest of digest.
+func (s *Store) Tag(repo string, tag string, digest string) error {
+	p, err := s.tagPath(repo, tag)
+	if err != nil {
+		return err
+	}
+	if s.Path(digest) == "" {
+		return fmt.Errorf("store: invalid digest %q", digest)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), ".tag-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(digest + "\n")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Resolve returns the digest tag of repo points to.
+func (s *Store) Resolve(repo string, tag string) (string, error) {
+	p, err := s.tagPath(repo, tag)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", errdefs.Errorf(errdefs.NotFound, "store: %v:%v is not tagged", repo, tag)
+	}
+	if err != nil {
+		return "", err
+	}
+	digest := string(bytes.TrimSpace(data))
+	if s.Path(digest) == "" {
+		return "", fmt.Errorf("store: tag %v:%v holds %q, not a digest", repo, tag, digest)
+	}
+	return digest, nil
+}
+
+// Tags lists the tags of repo, sorted.
+func (s *Store) Tags(repo string) ([]string, error) {
+	if !repoPattern.MatchString(repo) {
+		return nil, errdefs.Errorf(errdefs.Usage, "store: invalid repository %q", repo)
+	}
+	entries, err := os.ReadDir(filepath.Join(s.Root, "repositories", filepath.FromSlash(repo), "tags"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errdefs.Errorf(errdefs.NotFound, "store: no repository %v", repo)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tags []string
+	for _, e := range entries {
+		if e.Type().IsRegular() && tagPattern.MatchString(e.Name()) {
+			tags = append(tags, e.Name())
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// Repositories lists the repositories with tags, sorted.
+func (s *Store) Repositories() ([]string, error) {
+	root := filepath.Join(s.Root, "repositories")
+	var repos []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && p == root {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && d.Name() == "tags" && p != root {
+			rel, _ := filepath.Rel(root, filepath.Dir(p))
+			repos = append(repos, filepath.ToSlash(rel))
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	sort.Strings(repos)
+	return repos, err
+}
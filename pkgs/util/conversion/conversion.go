@@ -19,3 +19,8 @@ func Humanize_bstr(s string) (string, error) {
 	uint64, err := strconv.ParseUint(s, 10, 64)
 	return humanize.IBytes(uint64), err
 }
+
+// Parse_bytes reads a size such as 4G (4000000000 bytes) or 4GiB.
+func Parse_bytes(s string) (uint64, error) {
+	return humanize.ParseBytes(s)
+}
@@ -0,0 +1,39 @@
+//go:build !windows
+
+package filetool
+
+import (
+	"os"
+	"syscall"
+)
+
+// Freespace returns the bytes available to unprivileged users on the
+// filesystem holding path.
+func Freespace(path string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+// Samedevice reports whether both paths live on the same filesystem.
+func Samedevice(a, b string) bool {
+	fa, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	fb, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	sa, ok := fa.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	sb, ok := fb.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	return sa.Dev == sb.Dev
+}
@@ -0,0 +1,13 @@
+package filetool
+
+import "errors"
+
+// Freespace is not implemented on windows; callers skip the check.
+func Freespace(path string) (uint64, error) {
+	return 0, errors.New("free space check not supported on windows")
+}
+
+// Samedevice reports whether both paths live on the same filesystem.
+func Samedevice(a, b string) bool {
+	return false
+}
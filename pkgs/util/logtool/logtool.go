@@ -1,10 +1,14 @@
 package logtool
 
 import (
+	"fmt"
 	//"aopm-agnet/pkg/constant"
 	//"github.com/go-ini/ini"
 	//"github.com/natefinch/lumberjack"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/util/shutdown"
 	"go_pull/pkgs/vmconfig"
+	"io"
 	"os"
 	"strings"
 	"time"
@@ -17,6 +21,14 @@ var SugLog *zap.SugaredLogger
 var Logc *zap.Logger
 var zloglevel zap.AtomicLevel
 
+// Console is where progress bars and messages for the user are printed.
+var Console io.Writer = os.Stdout
+
+var logout zapcore.WriteSyncer = os.Stdout
+
+// Format is the format of the log, text or json.
+var Format = "text"
+
 func InitEvent(loglevel string) {
 	//创建核心对象
 	var coreArr []zapcore.Core
@@ -29,6 +41,9 @@ func InitEvent(loglevel string) {
 	encoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder //按级别显示不同颜色，不需要的话取值zapcore.CapitalLevelEncoder就可以了
 	//encoderConfig.EncodeCaller = zapcore.FullCallerEncoder        //显示完整文件路径
 	encoder := zapcore.NewConsoleEncoder(encoderConfig)
+	if Format == "json" {
+		encoder = zapcore.NewJSONEncoder(encoderConfig)
+	}
 	//配置日志级别
 	zloglevel = getConfigLog(loglevel)
 	//info和debug级别,debug级别是最低的
@@ -43,7 +58,7 @@ func InitEvent(loglevel string) {
 	//infoFileWriteSyncer := getInfoFileWriter()
 	//errorFileWriteSyncer := getErrorFileWriter()
 	//info文件writeSyncer
-	infoFileCore := zapcore.NewCore(encoder, zapcore.NewMultiWriteSyncer(zapcore.AddSync(os.Stdout)), zloglevel) //第三个及之后的参数为写入文件的日志级别,ErrorLevel模式只记录error级别的日志
+	infoFileCore := zapcore.NewCore(encoder, zapcore.NewMultiWriteSyncer(logout), zloglevel) //第三个及之后的参数为写入文件的日志级别,ErrorLevel模式只记录error级别的日志
 	//error文件writeSyncer
 	//errorFileCore := zapcore.NewCore(encoder, zapcore.NewMultiWriteSyncer(zapcore.AddSync(os.Stdout)), highPriority) //第三个及之后的参数为写入文件的日志级别,ErrorLevel模式只记录error级别的日志
 	//处理
@@ -51,7 +66,7 @@ func InitEvent(loglevel string) {
 	//coreArr = append(coreArr, errorFileCore)
 	//zap.AddCaller()为显示文件名和行号，可省略
 	//log := zap.New(zapcore.NewTee(coreArr...), zap.AddCaller(),zap.AddCallerSkip(1))
-	log := zap.New(zapcore.NewTee(coreArr...), zap.AddCaller())
+	log := zap.New(exitcore{zapcore.NewTee(coreArr...)}, zap.AddCaller())
 	//infoLog :=log.WithOptions(zap.AddCallerSkip(1))
 	//获取
 	SugLog = log.Sugar()
@@ -60,6 +75,45 @@ func InitEvent(loglevel string) {
 	//SugLog.Infof("**********日志初始化完成 输出级别=[%v]**********", level)
 }
 
+// exitcore stops the run through shutdown once a fatal entry is written, so
+// a Fatal anywhere, in any goroutine, cleans up before the process exits.
+// The entry gets the kind of its error and the exit code it tells. Errors
+// following the first one, mostly requests cancelled by it, are not logged.
+type exitcore struct {
+	zapcore.Core
+}
+
+func (c exitcore) With(fields []zapcore.Field) zapcore.Core {
+	return exitcore{c.Core.With(fields)}
+}
+
+func (c exitcore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c exitcore) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	if ent.Level < zapcore.FatalLevel {
+		return c.Core.Write(ent, fields)
+	}
+	if shutdown.Stopping() {
+		shutdown.Exit(shutdown.ExitError)
+	}
+	var err error
+	for _, f := range fields {
+		if e, ok := f.Interface.(error); ok && f.Type == zapcore.ErrorType {
+			err = e
+		}
+	}
+	kind := errdefs.KindOf(err)
+	c.Core.Write(ent, append(fields, zap.Stringer("kind", kind), zap.Int("exit_code", kind.ExitCode())))
+	c.Core.Sync()
+	shutdown.Exit(kind.ExitCode())
+	return nil
+}
+
 // 格式获取当前日志级别
 func getConfigLog(loglevel string) (level zap.AtomicLevel) {
 	//默认日志级别设置
@@ -83,13 +137,32 @@ func getConfigLog(loglevel string) (level zap.AtomicLevel) {
 	return level
 }
 
+// UseStderr moves the log and Console to stderr, leaving stdout free for data
+// piped to another program.
+func UseStderr() {
+	level := zloglevel.Level()
+	Console = os.Stderr
+	logout = os.Stderr
+	InitEvent(level.String())
+}
+
+// SetFormat switches the log to format, text or json.
+func SetFormat(format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format %q, use text or json", format)
+	}
+	Format = format
+	InitEvent(zloglevel.Level().String())
+	return nil
+}
+
 func Setloglevel(loglevel string) {
 	if strings.ToLower(loglevel) == vmconfig.DefaultLoglevel {
 		return
 	}
 	level, e := zapcore.ParseLevel(loglevel)
 	if e != nil {
-		Fatalerror(e)
+		Fatalerror(errdefs.New(errdefs.Usage, e))
 	}
 	zloglevel.SetLevel(level)
 }
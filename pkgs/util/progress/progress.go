@@ -3,8 +3,8 @@ package progress
 import (
 	"fmt"
 	"go_pull/pkgs/util/conversion"
+	"go_pull/pkgs/util/logtool"
 	"go_pull/pkgs/util/makestr"
-	"os"
 )
 
 type Progress struct {
@@ -19,11 +19,11 @@ type Progress struct {
 func (p *Progress) Write(b []byte) (n int, err error) {
 	p.Current += len(b)
 	p.progressBar()
-	return
+	return len(b), nil
 }
 
 func (p *Progress) progressBar() {
-	fmt.Print(makestr.Joinstring("", p.Ublob, ": Downloading ["))
+	fmt.Fprint(logtool.Console, makestr.Joinstring("", p.Ublob, ": Downloading ["))
 
 	percent := float64(p.Current) / float64(p.Total)
 	bars := int(percent * float64(p.ProgressBarLength))
@@ -33,11 +33,10 @@ func (p *Progress) progressBar() {
 
 	for i := 0; i < p.ProgressBarLength; i++ {
 		if i < bars {
-			fmt.Print("#")
+			fmt.Fprint(logtool.Console, "#")
 		} else {
-			fmt.Print(" ")
+			fmt.Fprint(logtool.Console, " ")
 		}
 	}
-	fmt.Printf("] %v/%v\n", now_bytes, total_bytes)
-	os.Stdout.Sync()
+	fmt.Fprintf(logtool.Console, "] %v/%v\n", now_bytes, total_bytes)
 }
@@ -1,13 +1,19 @@
 package request
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
-	"errors"
+	"fmt"
 	"go_pull/pkgs/vmconfig"
 	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/util/shutdown"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"sync"
 	"time"
 
 	//"fmt"
@@ -16,44 +22,71 @@ import (
 )
 
 type reqr struct {
-	Client  *resty.Client
-	Clientr *resty.Request
-	resp    *resty.Response
-	Url     string
+	Client   *resty.Client
+	Clientr  *resty.Request
+	resp     *resty.Response
+	Url      string
+	heads    map[string]string
+	notparse bool
+	insecure bool
 }
 
 func (c *reqr) sethead(q string, a string) *reqr {
-	c.Clientr.SetHeader(q, a)
+	c.heads[q] = a
 	return c
 }
 
 func (c *reqr) Setheads(k map[string]string) *reqr {
-	c.Clientr.SetHeaders(k)
+	for q, a := range k {
+		c.heads[q] = a
+	}
 	return c
 }
 
 func (c *reqr) Notparse() *reqr {
-	c.Clientr.SetDoNotParseResponse(true)
+	c.notparse = true
 	return c
 }
 
+// Settls applies the TLS settings of the host: it is verified, with its CA
+// or the system roots, unless SetInsecure made it an exception.
 func (c *reqr) Settls() *reqr {
-	c.Client.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+	c.insecure = true
 	return c
 }
 
+// build binds the request to the long-lived client of its host. It is
+// deferred until the request is sent so Settls can be called in any order.
+// Requests are cancelled when the run stops.
+func (c *reqr) build() *resty.Request {
+	if c.Clientr != nil {
+		return c.Clientr
+	}
+	c.Client = hostclient(c.Url, c.insecure)
+	c.Clientr = c.Client.R().
+		SetContext(shutdown.Context).
+		SetHeaders(c.heads).
+		SetDoNotParseResponse(c.notparse)
+	return c.Clientr
+}
+
 func (c *reqr) Get() (*resty.Response, error) {
-	return c.Clientr.Get(c.Url)
+	return c.build().Get(c.Url)
+}
+
+// Head sends a HEAD request, to learn the size of a blob without fetching it.
+func (c *reqr) Head() (*resty.Response, error) {
+	return c.build().Head(c.Url)
 }
 
 func (c *reqr) setresult(v *interface{}) *reqr {
 	//var v interface{}
-	c.Clientr.SetResult(v)
+	c.build().SetResult(v)
 	return c
 }
 
 func (c *reqr) post(i ...string) (*resty.Response, error) {
-	return c.Clientr.Post(c.Url)
+	return c.build().Post(c.Url)
 }
 
 //type Logger struct {
@@ -85,45 +118,167 @@ func (c *reqr) post(i ...string) (*resty.Response, error) {
 //
 // func (e Logger) Debugf(format string, v ...interface{}) {
 // }
-func TimeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, addr string) (c net.Conn, err error) {
-	return func(netw, addr string) (net.Conn, error) {
-		//conn, err := net.DialTimeout(netw, addr, cTimeout)
-		d := net.Dialer{
-			Timeout:   cTimeout,
-			DualStack: true}
-		conn, err := d.Dial(netw, addr)
 
+// idleconn is a net.Conn whose deadline is pushed forward on every read and
+// write, so a transfer only fails after timeout without any progress instead
+// of after a fixed time since dialing.
+type idleconn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleconn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *idleconn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// IdleTimeoutDialer dials with cTimeout and wraps the connection so that it
+// is closed once no data has moved for rwTimeout.
+func IdleTimeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(ctx context.Context, netw, addr string) (net.Conn, error) {
+	d := net.Dialer{
+		Timeout:   cTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return func(ctx context.Context, netw, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, netw, addr)
 		if err != nil {
 			return nil, err
 		}
-		conn.SetDeadline(time.Now().Add(rwTimeout))
-		return conn, nil
+		if rwTimeout <= 0 {
+			return conn, nil
+		}
+		return &idleconn{Conn: conn, timeout: rwTimeout}, nil
 	}
 }
 
-func Requests(url string) *reqr {
+var (
+	clients   = map[string]*resty.Client{}
+	clientsMu sync.Mutex
+)
+
+// hostclient returns the client shared by every request to the host of
+// rawurl, creating it on first use. Connections are pooled and kept alive
+// between requests, so a download pays the TCP and TLS handshake once per
+// connection instead of once per manifest, token or blob request.
+func hostclient(rawurl string, insecure bool) *resty.Client {
+	key := rawurl
+	if u, err := url.Parse(rawurl); err == nil {
+		key = u.Host
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	insecure = insecure && insecures[key]
+	if insecure {
+		key = key + "#insecure"
+	}
+	if client, ok := clients[key]; ok {
+		return client
+	}
+	tlsconf := &tls.Config{InsecureSkipVerify: insecure}
+	if u, err := url.Parse(rawurl); err == nil && cas[u.Host] != nil {
+		// a host with its own CA is always verified
+		tlsconf = &tls.Config{RootCAs: cas[u.Host]}
+	}
+	client := newclient(tlsconf)
+	clients[key] = client
+	return client
+}
+
+// cas are the certificates hosts are verified with, set before their
+// clients are made.
+var cas = map[string]*x509.CertPool{}
+
+// insecures are the hosts whose certificates are not verified.
+var insecures = map[string]bool{}
+
+// SetInsecure skips certificate verification for host, the registries the
+// config marks insecure.
+func SetInsecure(host string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	insecures[host] = true
+}
+
+// schemes are what the insecure hosts answered, https or http.
+var schemes = map[string]string{}
+
+// InsecureScheme skips certificate verification for host, as SetInsecure,
+// and returns the scheme to talk to it with: https when it answers https,
+// plain http otherwise, as docker does for insecure registries. The answer
+// is kept for the run.
+func InsecureScheme(host string) string {
+	SetInsecure(host)
+	clientsMu.Lock()
+	scheme, ok := schemes[host]
+	clientsMu.Unlock()
+	if ok {
+		return scheme
+	}
+	scheme = "https"
+	if _, err := Requests("https://" + host + "/v2/").Settls().Get(); err != nil {
+		logtool.SugLog.Debugf("%v does not answer https, using http: %v", host, err)
+		scheme = "http"
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	schemes[host] = scheme
+	return scheme
+}
+
+// SetCA verifies host with the PEM certificates of file, instead of the
+// system roots or no verification at all.
+func SetCA(host string, file string) error {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("%v has no PEM certificate", file)
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	cas[host] = pool
+	return nil
+}
+
+func newclient(tlsconf *tls.Config) *resty.Client {
+	connect := time.Duration(vmconfig.Ptimeout) * time.Second
 	client := resty.New().
 		SetTransport(&http.Transport{
-			Proxy:             http.ProxyFromEnvironment,
-			ForceAttemptHTTP2: true,
-			Dial: TimeoutDialer(time.Duration(vmconfig.Ptimeout)*time.Second,
-				time.Duration(vmconfig.Piotimeout)*time.Second),
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           IdleTimeoutDialer(connect, time.Duration(vmconfig.Piotimeout)*time.Second),
+			ForceAttemptHTTP2:     true,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   16,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+			TLSClientConfig:       tlsconf,
 		}).
 		SetRetryCount(vmconfig.Retry).
-		SetRetryWaitTime(100 * time.Nanosecond).
-		AddRetryCondition(
-			func(response *resty.Response, err error) bool {
-				return !response.IsSuccess() || err != nil
-			},
-		).OnAfterResponse(
+		SetRetryWaitTime(retryWait).
+		SetRetryMaxWaitTime(retryMaxWait).
+		SetRetryAfter(RetryAfter).
+		AddRetryCondition(Retryable).
+		OnAfterResponse(
 		func(c *resty.Client, resp *resty.Response) error {
-			// Now you have access to Client and current Response object
-			// manipulate it as per your need
+			recordRatelimit(resp)
 			if !resp.IsSuccess() {
 				if resp.StatusCode() == 401 {
 					return nil
 				}
-				return errors.New("request failed,http code is " + resp.Status())
+				return statuserror(resp)
 
 			}
 			return nil // if its success otherwise return error
@@ -132,10 +287,12 @@ func Requests(url string) *reqr {
 
 	//client.SetLogger(&Logger{})
 	client.SetLogger(logtool.SugLog)
+	return client
+}
 
-	return &reqr{Client: client,
-		Clientr: client.R(),
-		Url:     url}
+func Requests(url string) *reqr {
+	return &reqr{Url: url,
+		heads: map[string]string{}}
 
 	//
 	//if err != nil {
@@ -2,7 +2,14 @@ package request
 
 import (
 	"fmt"
+	"go_pull/pkgs/vmconfig"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync/atomic"
+	"time"
 
 	//"go_pull/pkgs/util/iowrite"
 	"encoding/json"
@@ -65,3 +72,112 @@ func Test_request(t *testing.T) {
 		})
 	}
 }
+
+func Test_request_reuse(t *testing.T) {
+	var conns int32
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	ts.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	ts.StartTLS()
+	defer ts.Close()
+	SetInsecure(ts.Listener.Addr().String())
+
+	for i := 0; i < 3; i++ {
+		resp, err := Requests(ts.URL + "/v2/").Settls().Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode() != 200 {
+			t.Fatalf("status %v", resp.Status())
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Fatalf("expected one pooled connection, got %v", n)
+	}
+}
+
+func Test_request_verify(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	// the test certificate is not trusted unless the host is insecure
+	if _, err := Requests(ts.URL + "/v2/").Settls().Get(); err == nil {
+		t.Fatal("unverified certificate accepted")
+	}
+	SetInsecure(ts.Listener.Addr().String())
+	if _, err := Requests(ts.URL + "/v2/").Settls().Get(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_request_insecure_scheme(t *testing.T) {
+	tls := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+	}))
+	defer tls.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer plain.Close()
+
+	// a self-signed certificate is talked https, unverified
+	host := tls.Listener.Addr().String()
+	if got := InsecureScheme(host); got != "https" {
+		t.Fatalf("tls server talked %v", got)
+	}
+	if resp, err := Requests("https://" + host + "/v2/").Settls().Get(); err != nil || resp.StatusCode() != 401 {
+		t.Fatalf("unverified https: %v", err)
+	}
+	if got := InsecureScheme(plain.Listener.Addr().String()); got != "http" {
+		t.Fatalf("plain server talked %v", got)
+	}
+}
+
+func Test_request_idletimeout(t *testing.T) {
+	vmconfig.Piotimeout = 1
+	defer func() { vmconfig.Piotimeout = 0 }()
+
+	// a body trickling in for longer than the timeout must not be cut off
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("chunk"))
+			w.(http.Flusher).Flush()
+			time.Sleep(500 * time.Millisecond)
+		}
+	}))
+	defer slow.Close()
+
+	resp, err := Requests(slow.URL).Notparse().Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.RawBody())
+	resp.RawBody().Close()
+	if err != nil || len(body) != 20 {
+		t.Fatalf("slow body: %v bytes, %v", len(body), err)
+	}
+
+	// a stalled body must fail once nothing arrives for the timeout
+	stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("chunk"))
+		w.(http.Flusher).Flush()
+		time.Sleep(2 * time.Second)
+	}))
+	defer stalled.Close()
+
+	resp, err = Requests(stalled.URL).Notparse().Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = io.ReadAll(resp.RawBody())
+	resp.RawBody().Close()
+	if err == nil {
+		t.Fatal("expected stalled body to time out")
+	}
+}
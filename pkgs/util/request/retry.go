@@ -0,0 +1,214 @@
+package request
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"go_pull/pkgs/util/logtool"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+const (
+	// retryWait is the first backoff step, doubled on every attempt and
+	// randomised by resty's jitter.
+	retryWait = 500 * time.Millisecond
+	// retryMaxWait caps both the backoff and a server's Retry-After. A
+	// registry asking us to wait longer fails the request instead.
+	retryMaxWait = time.Minute
+)
+
+// Retryable reports whether a request that ended with resp or err is worth
+// sending again. Network failures, timeouts, throttling and server errors
+// are transient; anything else the registry answered (401, 403, 404, ...) is
+// permanent and returned at once.
+func Retryable(resp *resty.Response, err error) bool {
+	if resp != nil && resp.StatusCode() != 0 {
+		switch resp.StatusCode() {
+		case http.StatusRequestTimeout,
+			http.StatusTooEarly,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError,
+			http.StatusBadGateway,
+			http.StatusServiceUnavailable,
+			http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var unknown x509.UnknownAuthorityError
+	var hostname x509.HostnameError
+	if errors.As(err, &unknown) || errors.As(err, &hostname) {
+		return false
+	}
+	var dns *net.DNSError
+	if errors.As(err, &dns) && dns.IsNotFound {
+		return false
+	}
+	return true
+}
+
+// RetryAfter returns how long the server asked us to wait before the next
+// attempt. Zero lets resty fall back to exponential backoff with jitter.
+func RetryAfter(c *resty.Client, resp *resty.Response) (time.Duration, error) {
+	if resp == nil {
+		return 0, nil
+	}
+	wait, ok := ParseRetryAfter(resp.Header().Get("Retry-After"), time.Now())
+	if !ok {
+		return 0, nil
+	}
+	if wait > retryMaxWait {
+		return 0, fmt.Errorf("%v: server asked to retry after %v", resp.Status(), wait.Round(time.Second))
+	}
+	return wait, nil
+}
+
+// ParseRetryAfter reads a Retry-After header given either in seconds or as
+// an HTTP date.
+func ParseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		if s < 0 {
+			return 0, false
+		}
+		return time.Duration(s) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if t.Before(now) {
+		return 0, true
+	}
+	return t.Sub(now), true
+}
+
+// statuserror describes a failed response, adding the wait a throttling
+// registry asked for and the quota it reported. The error has the kind of
+// the status.
+func statuserror(resp *resty.Response) error {
+	msg := fmt.Sprintf("%v %v: HTTP %v", resp.Request.Method, resp.Request.URL, resp.Status())
+	if wait, ok := ParseRetryAfter(resp.Header().Get("Retry-After"), time.Now()); ok {
+		msg = fmt.Sprintf("%v, retry after %v", msg, wait.Round(time.Second))
+	}
+	if r, ok := ParseRatelimit(resp.Header()); ok {
+		msg = fmt.Sprintf("%v, rate limit %v", msg, r)
+	}
+	return errdefs.New(errdefs.HTTPStatus(resp.StatusCode()), errors.New(msg))
+}
+
+// Ratelimit is the pull quota a registry reported in the ratelimit-limit and
+// ratelimit-remaining headers Docker Hub sends with manifest responses.
+type Ratelimit struct {
+	Limit     int
+	Remaining int
+	Window    time.Duration
+	Source    string
+}
+
+func (r Ratelimit) String() string {
+	s := fmt.Sprintf("%v/%v remaining", r.Remaining, r.Limit)
+	if r.Window > 0 {
+		s = fmt.Sprintf("%v per %v", s, r.Window)
+	}
+	if r.Source != "" {
+		s = fmt.Sprintf("%v (source %v)", s, r.Source)
+	}
+	return s
+}
+
+// Low reports whether less than a tenth of the quota is left.
+func (r Ratelimit) Low() bool {
+	return r.Remaining*10 < r.Limit
+}
+
+// ParseRatelimit reads the rate-limit headers of a response. The values look
+// like "100;w=21600": a count and the window in seconds.
+func ParseRatelimit(h http.Header) (Ratelimit, bool) {
+	limit, window, ok := parseQuota(h.Get("Ratelimit-Limit"))
+	if !ok {
+		return Ratelimit{}, false
+	}
+	remaining, _, ok := parseQuota(h.Get("Ratelimit-Remaining"))
+	if !ok {
+		return Ratelimit{}, false
+	}
+	return Ratelimit{
+		Limit:     limit,
+		Remaining: remaining,
+		Window:    window,
+		Source:    h.Get("Docker-Ratelimit-Source"),
+	}, true
+}
+
+func parseQuota(v string) (int, time.Duration, bool) {
+	if v == "" {
+		return 0, 0, false
+	}
+	parts := strings.Split(v, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "w=") {
+			if s, err := strconv.Atoi(p[2:]); err == nil {
+				window = time.Duration(s) * time.Second
+			}
+		}
+	}
+	return n, window, true
+}
+
+var (
+	ratelimits   = map[string]Ratelimit{}
+	ratelimitsMu sync.Mutex
+)
+
+// Ratelimits returns the last quota reported by host.
+func Ratelimits(host string) (Ratelimit, bool) {
+	ratelimitsMu.Lock()
+	defer ratelimitsMu.Unlock()
+	r, ok := ratelimits[host]
+	return r, ok
+}
+
+// recordRatelimit remembers and logs the quota carried by resp, warning
+// once the remaining pulls run low.
+func recordRatelimit(resp *resty.Response) {
+	r, ok := ParseRatelimit(resp.Header())
+	if !ok || resp.Request == nil || resp.Request.RawRequest == nil {
+		return
+	}
+	host := resp.Request.RawRequest.URL.Host
+
+	ratelimitsMu.Lock()
+	ratelimits[host] = r
+	ratelimitsMu.Unlock()
+
+	if r.Low() {
+		logtool.SugLog.Warnf("%v rate limit: %v", host, r)
+	} else {
+		logtool.SugLog.Debugf("%v rate limit: %v", host, r)
+	}
+}
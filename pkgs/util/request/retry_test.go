@@ -0,0 +1,124 @@
+package request
+
+import (
+	"go_pull/pkgs/util/logtool"
+	"go_pull/pkgs/vmconfig"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func init() {
+	logtool.InitEvent("error")
+}
+
+func Test_retry_policy(t *testing.T) {
+	vmconfig.Retry = 3
+	defer func() { vmconfig.Retry = 0 }()
+
+	tests := []struct {
+		name   string
+		codes  []int
+		status int
+		hits   int32
+	}{
+		{name: "not found is permanent", codes: []int{404}, status: 404, hits: 1},
+		{name: "forbidden is permanent", codes: []int{403}, status: 403, hits: 1},
+		{name: "unavailable is retried", codes: []int{503, 502, 200}, status: 200, hits: 3},
+		{name: "throttled is retried", codes: []int{429, 200}, status: 200, hits: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&hits, 1)
+				code := tt.codes[len(tt.codes)-1]
+				if int(n) <= len(tt.codes) {
+					code = tt.codes[n-1]
+				}
+				if code == 429 {
+					w.Header().Set("Retry-After", "1")
+				}
+				w.WriteHeader(code)
+			}))
+			defer ts.Close()
+
+			resp, _ := Requests(ts.URL).Get()
+			if resp.StatusCode() != tt.status {
+				t.Errorf("status %v, want %v", resp.StatusCode(), tt.status)
+			}
+			if got := atomic.LoadInt32(&hits); got != tt.hits {
+				t.Errorf("%v requests, want %v", got, tt.hits)
+			}
+		})
+	}
+}
+
+func Test_retry_after_too_long(t *testing.T) {
+	vmconfig.Retry = 3
+	defer func() { vmconfig.Retry = 0 }()
+
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(429)
+	}))
+	defer ts.Close()
+
+	_, err := Requests(ts.URL).Get()
+	if err == nil || !strings.Contains(err.Error(), "retry after 1h0m0s") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := atomic.LoadInt32(&hits); got != 1 {
+		t.Fatalf("%v requests, want 1", got)
+	}
+}
+
+func Test_ParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 6, 9, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Duration
+		ok   bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"Thu, 09 Jun 2022 00:00:30 GMT", 30 * time.Second, true},
+		{"Wed, 08 Jun 2022 00:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := ParseRetryAfter(tt.in, now)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseRetryAfter(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func Test_ParseRatelimit(t *testing.T) {
+	h := http.Header{}
+	if _, ok := ParseRatelimit(h); ok {
+		t.Fatal("parsed a rate limit from empty headers")
+	}
+	h.Set("Ratelimit-Limit", "100;w=21600")
+	h.Set("Ratelimit-Remaining", "7;w=21600")
+	h.Set("Docker-Ratelimit-Source", "203.0.113.7")
+	r, ok := ParseRatelimit(h)
+	if !ok {
+		t.Fatal("rate limit not parsed")
+	}
+	if r.Limit != 100 || r.Remaining != 7 || r.Window != 6*time.Hour || r.Source != "203.0.113.7" {
+		t.Fatalf("unexpected %+v", r)
+	}
+	if !r.Low() {
+		t.Fatal("7 of 100 should be low")
+	}
+	if s := r.String(); s != "7/100 remaining per 6h0m0s (source 203.0.113.7)" {
+		t.Fatalf("unexpected %q", s)
+	}
+}
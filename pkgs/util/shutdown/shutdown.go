@@ -0,0 +1,180 @@
+// Package shutdown stops a run cleanly, on Ctrl-C or on a fatal error:
+// requests in flight are cancelled, what the run left half done is undone,
+// staging files removed and devices unmounted, and the process exits with a
+// code telling why it stopped.
+package shutdown
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Exit codes of gopull, the classes of errors are told in errdefs.
+const (
+	ExitOK             = 0
+	ExitError          = 1   // the run failed
+	ExitUsage          = 2   // invalid command line
+	ExitCleanup        = 3   // the run failed and could not undo all it started
+	ExitNotFound       = 4   // the image, tag, platform or a blob does not exist
+	ExitUnauthorized   = 5   // the registry refused the credentials or the token
+	ExitRateLimited    = 6   // the registry pull quota is exhausted
+	ExitNetwork        = 7   // the network or the registry failed, worth a retry
+	ExitDigestMismatch = 8   // downloaded content does not match its digest
+	ExitDiskFull       = 9   // no space left for the archive or the staging files
+	ExitInterrupted    = 130 // stopped by SIGINT, 128+signal as shells do
+	ExitTerminated     = 143 // stopped by SIGTERM
+)
+
+// KeepTemp leaves staging files in place when the run stops early, to look
+// into a failure.
+var KeepTemp bool
+
+// Context is cancelled once the run stops, requests and commands bound to it
+// stop with it.
+var Context, cancel = context.WithCancel(context.Background())
+
+// Grace is how long Exit waits for an undo step before going on.
+var Grace = 10 * time.Second
+
+type task struct {
+	name string
+	path string // a staging file, kept with KeepTemp
+	undo func() error
+}
+
+var (
+	mu       sync.Mutex
+	tasks    []*task
+	stopping bool
+)
+
+// Remove removes the staging file path if the run stops before Forget is
+// called.
+func Remove(path string) {
+	add(&task{name: "remove " + path, path: path, undo: func() error {
+		if err := os.RemoveAll(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}})
+}
+
+// Forget drops path from the files to remove, once it is gone or in place.
+func Forget(path string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for i := len(tasks) - 1; i >= 0; i-- {
+		if tasks[i].path == path {
+			tasks = append(tasks[:i], tasks[i+1:]...)
+			return
+		}
+	}
+}
+
+// Undo runs f, named name in messages, if the run stops before done is
+// called. Steps run in the reverse order they were added.
+func Undo(name string, f func() error) (done func()) {
+	t := &task{name: name, undo: f}
+	add(t)
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for i := range tasks {
+			if tasks[i] == t {
+				tasks = append(tasks[:i], tasks[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func add(t *task) {
+	mu.Lock()
+	if !stopping {
+		tasks = append(tasks, t)
+		mu.Unlock()
+		return
+	}
+	mu.Unlock()
+	// the run is already stopping, whatever comes late is undone at once
+	run(t)
+}
+
+// Stopping tells whether Exit was called.
+func Stopping() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return stopping
+}
+
+// Exit cancels Context, undoes what was registered and exits with code, or
+// ExitCleanup when a run failing for no known reason could not undo
+// something. Only the first call
+// exits, the goroutines calling it afterwards wait for the exit.
+func Exit(code int) {
+	os.Exit(stop(code))
+}
+
+func stop(code int) int {
+	mu.Lock()
+	if stopping {
+		mu.Unlock()
+		select {}
+	}
+	stopping = true
+	pending := tasks
+	tasks = nil
+	mu.Unlock()
+
+	cancel()
+	for i := len(pending) - 1; i >= 0; i-- {
+		if !run(pending[i]) && code == ExitError {
+			code = ExitCleanup
+		}
+	}
+	return code
+}
+
+// run undoes t and tells whether it went fine. The log may be stdout, where
+// an archive is being written, messages go to stderr.
+func run(t *task) bool {
+	if t.path != "" && KeepTemp {
+		fmt.Fprintf(os.Stderr, "kept %v\n", t.path)
+		return true
+	}
+	done := make(chan error, 1)
+	go func() { done <- t.undo() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "cannot %v: %v\n", t.name, err)
+			return false
+		}
+	case <-time.After(Grace):
+		fmt.Fprintf(os.Stderr, "cannot %v: timed out\n", t.name)
+		return false
+	}
+	return true
+}
+
+// Notify stops the run on SIGINT and SIGTERM. A second signal while the run
+// is cleaning up kills it at once.
+func Notify() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-c
+		signal.Stop(c)
+		fmt.Fprintf(os.Stderr, "\n%v, cleaning up\n", sig)
+		code := ExitInterrupted
+		if sig == syscall.SIGTERM {
+			code = ExitTerminated
+		}
+		Exit(code)
+	}()
+}
@@ -0,0 +1,82 @@
+package shutdown
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func reset() {
+	tasks, stopping, KeepTemp = nil, false, false
+	Context, cancel = context.WithCancel(context.Background())
+}
+
+func TestStop(t *testing.T) {
+	reset()
+	dir := t.TempDir()
+	partial := filepath.Join(dir, "a.tar.partial")
+	done := filepath.Join(dir, "b.tar")
+	for _, p := range []string{partial, done} {
+		os.WriteFile(p, nil, 0644)
+		Remove(p)
+	}
+	Forget(done)
+
+	var order []string
+	Undo("unmount", func() error { order = append(order, "unmount"); return nil })
+	release := Undo("detach", func() error { order = append(order, "detach"); return nil })
+	Undo("stop", func() error { order = append(order, "stop"); return nil })
+	release()
+
+	if code := stop(ExitInterrupted); code != ExitInterrupted {
+		t.Fatalf("exit code %v", code)
+	}
+	if Context.Err() == nil {
+		t.Fatal("context not cancelled")
+	}
+	if !reflect.DeepEqual(order, []string{"stop", "unmount"}) {
+		t.Fatalf("undone %v", order)
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Fatalf("%v left: %v", partial, err)
+	}
+	if _, err := os.Stat(done); err != nil {
+		t.Fatalf("forgotten file removed: %v", err)
+	}
+
+	// a file staged while stopping is removed at once
+	late := filepath.Join(dir, "late")
+	os.WriteFile(late, nil, 0644)
+	Remove(late)
+	if _, err := os.Stat(late); !os.IsNotExist(err) {
+		t.Fatalf("%v left: %v", late, err)
+	}
+}
+
+func TestStopCleanupFailed(t *testing.T) {
+	reset()
+	Undo("unmount", func() error { return errors.New("busy") })
+	if code := stop(ExitError); code != ExitCleanup {
+		t.Fatalf("exit code %v", code)
+	}
+}
+
+func TestKeepTemp(t *testing.T) {
+	reset()
+	KeepTemp = true
+	p := filepath.Join(t.TempDir(), "spool")
+	os.WriteFile(p, nil, 0644)
+	Remove(p)
+	undone := false
+	Undo("unmount", func() error { undone = true; return nil })
+	stop(ExitError)
+	if _, err := os.Stat(p); err != nil {
+		t.Fatalf("kept file removed: %v", err)
+	}
+	if !undone {
+		t.Fatal("devices are undone with --keep-temp too")
+	}
+}
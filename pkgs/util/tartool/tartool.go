@@ -3,6 +3,7 @@ package tartool
 import (
 	"archive/tar"
 	"fmt"
+	"go_pull/pkgs/util/logtool"
 	"io"
 	"log"
 	"os"
@@ -52,25 +53,31 @@ func IterDirectory(dirPath, subpath string, tw *tar.Writer) {
 			//TarGzWrite( curPath, tw, fi )
 			IterDirectory(dirPath, curpath, tw)
 		} else {
-			fmt.Printf("adding... %s\n", dirPath+"/"+curpath)
+			fmt.Fprintf(logtool.Console, "adding... %s\n", dirPath+"/"+curpath)
 			TarGzWrite(dirPath, curpath, tw, fi)
 		}
 	}
 }
 
 func Tar(outFilePath string, inPath string) {
-	inPath = strings.TrimRight(inPath, "/")
 	// file write
 	fw, err := os.Create(outFilePath)
 	handleError(err)
 	defer fw.Close()
+
+	TarTo(fw, inPath)
+}
+
+// TarTo writes the content of inPath as an uncompressed tar stream to w.
+func TarTo(w io.Writer, inPath string) {
+	inPath = strings.TrimRight(inPath, "/")
 	// gzip write
 	//gw := gzip.NewWriter(fw)
 	//defer gw.Close()
 
 	// tar write
 	//tw := tar.NewWriter(gw)
-	tw := tar.NewWriter(fw)
+	tw := tar.NewWriter(w)
 	defer tw.Close()
 
 	IterDirectory(inPath, "", tw)
@@ -26,6 +26,7 @@ var externalProcesses = map[string]string{
 	"mksquashfs":  "mksquashfs",
 	"genisoimage": "genisoimage",
 	"kpartx":	   "kpartx",
+	"tar":         "tar",
 }
 
 // check for the presence of each of the external processes we may call,
@@ -5,16 +5,21 @@
 package vmbetter
 
 import (
+	"archive/tar"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
 
+    "go_pull/pkgs/layer"
     "go_pull/pkgs/nbd"
+    "go_pull/pkgs/util/shutdown"
     "go_pull/pkgs/vmconfig"
 )
 
@@ -22,6 +27,10 @@ var (
 	kernelName string
 	initrdName string
 	dev string
+
+	// undo steps of BuildDisk, done by FinishDisk
+	undoMount  = func() {}
+	undoKpartx = func() {}
 )
 
 // BuildRootFS generates simple rootfs a from the stage 1 directory.
@@ -188,32 +197,76 @@ func BuildTargets(buildPath string, c vmconfig.Config) error {
 	return nil
 }
 
+// ExtractDocker unpacks the layers of the docker save archive file into
+// mount, in the order the archive stores them. A layer.tar holds the blob as
+// pulled: each is decompressed on its own, gzip, zstd or plain as its first
+// bytes tell, and their tars are fed one after the other to a single tar.
 func ExtractDocker(mount,file string) error {
-	wd, err := os.Getwd()
+	in, err := os.Open(file)
 	if err != nil {
 		return err
 	}
+	defer in.Close()
 
-	f, err := ioutil.TempFile("", "docker_tar")
+	// tar runs in a process group of its own, killed as a whole when the run
+	// stops, and waited for before the disk is unmounted
+	cmd := exec.CommandContext(shutdown.Context, process("tar"), "xif", "-")
+	cmd.Dir = mount
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	stdin, err := cmd.StdinPipe()
 	if err != nil {
 		return err
 	}
-
-	eName := f.Name()
-	initrdCommand := fmt.Sprintf("cd %v && tar xvfO \"%v\" --wildcards --no-anchored \"*.tar\" | tar xivf -", mount, wd+"/"+file)
-	f.WriteString(initrdCommand)
-	f.Close()
-
-	p := process("bash")
-	cmd := exec.Command(p, eName)
-
-	err = cmd.Run()
-	if err != nil {
+	if err := cmd.Start(); err != nil {
 		return err
 	}
+	exited := make(chan struct{})
+	done := shutdown.Undo("stop extracting "+file, func() error {
+		<-exited
+		return nil
+	})
+	ferr := feedLayers(stdin, in)
+	stdin.Close()
+	if ferr != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	err = cmd.Wait()
+	close(exited)
+	done()
+	if ferr != nil {
+		return fmt.Errorf("%v: %v", file, ferr)
+	}
+	return err
+}
 
-	os.Remove(eName)
-	return nil
+// feedLayers writes the tars of the layer.tar entries of the archive r to w.
+func feedLayers(w io.Writer, r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// a repeated layer is a link to its first copy, extracted already
+		if h.Typeflag != tar.TypeReg || path.Base(h.Name) != "layer.tar" {
+			continue
+		}
+		lr, err := layer.Decompress(tr, layer.Unknown, h.Size)
+		if err != nil {
+			return fmt.Errorf("%v: %v", h.Name, err)
+		}
+		_, err = io.Copy(w, lr)
+		lr.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %v", h.Name, err)
+		}
+	}
 }
 
 
@@ -250,12 +303,17 @@ func BuildDisk(buildPath string, c vmconfig.Config) (string, error) {
 	if err := createDisk(outTmp, vmconfig.CF.F_diskSize, vmconfig.CF.F_format); err != nil {
 		return "", err
 	}
+	shutdown.Remove(outTmp)
 
 	if vmconfig.CF.F_format != "raw" {
 		dev, err = nbd.ConnectImage(outTmp)
 		if err != nil {
 			return "", err
 		}
+		nbdDev := dev
+		shutdown.Undo("disconnect "+nbdDev, func() error {
+			return nbd.DisconnectDevice(nbdDev)
+		})
 		dev = dev + "p1"
 	} else {
 		dev = outTmp
@@ -269,6 +327,9 @@ func BuildDisk(buildPath string, c vmconfig.Config) (string, error) {
 		if err := kpartx(dev, "-a"); err != nil {
 			return "", err
 		}
+		undoKpartx = shutdown.Undo("detach the partitions of "+outTmp, func() error {
+			return kpartx(outTmp, "-d")
+		})
 		dev, err = nbd.GetDevice("raw")
 		if err != nil {
 			return "", err
@@ -283,6 +344,12 @@ func BuildDisk(buildPath string, c vmconfig.Config) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	undoMount = shutdown.Undo("unmount "+mountPath, func() error {
+		if err := umountDisk(mountPath); err != nil {
+			return err
+		}
+		return os.Remove(mountPath)
+	})
 
 	return mountPath, nil
 }
@@ -310,11 +377,17 @@ func FinishDisk(mountPath string,c vmconfig.Config) error {
 	if err := umountDisk(mountPath); err != nil {
 		return err
 	}
+	undoMount()
 	if err := kpartx(outTmp,"-d"); err != nil {
 		return err
 	}
+	undoKpartx()
 
-	return os.Rename(outTmp, out)
+	if err := os.Rename(outTmp, out); err != nil {
+		return err
+	}
+	shutdown.Forget(outTmp)
+	return nil
 }
 
 
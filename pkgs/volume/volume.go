@@ -0,0 +1,274 @@
+// Package volume splits an archive into numbered volumes of a fixed size, for
+// media that cap the size of a file, and joins them back. The index of the
+// volumes is a sha256sum file, sha256sum -c checks them without gopull; its
+// comments keep the name, size and digest of the whole archive.
+package volume
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"go_pull/pkgs/errdefs"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// IndexSuffix is added to the name of the archive for its index.
+const IndexSuffix = ".sha256"
+
+// Part is a volume of an archive.
+type Part struct {
+	Name   string
+	Size   int64
+	Digest string
+}
+
+// Index lists the volumes of an archive.
+type Index struct {
+	Name   string // file name of the whole archive
+	Size   int64
+	Digest string
+	Split  int64 // size of every volume but the last
+	Parts  []Part
+}
+
+// PartName is the name of the volume n, from 1, of the archive name.
+func PartName(name string, n int) string {
+	return fmt.Sprintf("%v.%03d", name, n)
+}
+
+// Writer writes an archive as volumes of Split bytes into a directory.
+type Writer struct {
+	dir   string
+	index Index
+	f     *os.File
+	n     int64 // bytes in f
+	whole hash.Hash
+	part  hash.Hash
+}
+
+// NewWriter writes the volumes of the archive name into dir, split bytes
+// each.
+func NewWriter(dir string, name string, split int64) (*Writer, error) {
+	if split <= 0 {
+		return nil, fmt.Errorf("volume size %v, it must be positive", split)
+	}
+	return &Writer{dir: dir, index: Index{Name: name, Split: split}, whole: sha256.New()}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.f == nil || w.n == w.index.Split {
+			if err := w.next(); err != nil {
+				return written, err
+			}
+		}
+		chunk := p
+		if left := w.index.Split - w.n; int64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+		n, err := w.f.Write(chunk)
+		w.part.Write(chunk[:n])
+		w.whole.Write(chunk[:n])
+		w.n += int64(n)
+		w.index.Size += int64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// next closes the current volume and starts the next one.
+func (w *Writer) next() error {
+	if err := w.end(); err != nil {
+		return err
+	}
+	part := Part{Name: PartName(w.index.Name, len(w.index.Parts)+1)}
+	f, err := os.OpenFile(filepath.Join(w.dir, part.Name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w.index.Parts = append(w.index.Parts, part)
+	w.f, w.n, w.part = f, 0, sha256.New()
+	return nil
+}
+
+// end closes the current volume, if any, and records it.
+func (w *Writer) end() error {
+	if w.f == nil {
+		return nil
+	}
+	last := &w.index.Parts[len(w.index.Parts)-1]
+	last.Size, last.Digest = w.n, "sha256:"+hex.EncodeToString(w.part.Sum(nil))
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
+
+// Close ends the last volume and returns the index of the volumes. An empty
+// archive still has one empty volume.
+func (w *Writer) Close() (*Index, error) {
+	if w.f == nil && len(w.index.Parts) == 0 {
+		if err := w.next(); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.end(); err != nil {
+		return nil, err
+	}
+	w.index.Digest = "sha256:" + hex.EncodeToString(w.whole.Sum(nil))
+	return &w.index, nil
+}
+
+// Write writes the index in the format of sha256sum.
+func (idx *Index) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "# archive %v %v %v\n", idx.Name, idx.Size, idx.Digest)
+	fmt.Fprintf(bw, "# volume-size %v\n", idx.Split)
+	for _, p := range idx.Parts {
+		fmt.Fprintf(bw, "%v  %v\n", digest.Digest(p.Digest).Encoded(), p.Name)
+	}
+	return bw.Flush()
+}
+
+// localName checks that a file name of an index stays in the directory of
+// the index: volumes are read and the archive written next to it.
+func localName(name string) error {
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("%q is not a file name inside the directory of the index", name)
+	}
+	return nil
+}
+
+// ReadIndex reads an index written by Write.
+func ReadIndex(r io.Reader) (*Index, error) {
+	idx := &Index{}
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		fields := strings.Fields(strings.TrimPrefix(text, "#"))
+		var err error
+		switch {
+		case text == "":
+		case strings.HasPrefix(text, "#") && len(fields) == 4 && fields[0] == "archive":
+			idx.Name, idx.Digest = fields[1], fields[3]
+			if idx.Size, err = strconv.ParseInt(fields[2], 10, 64); err == nil {
+				_, err = digest.Parse(idx.Digest)
+			}
+			if err == nil {
+				err = localName(idx.Name)
+			}
+		case strings.HasPrefix(text, "#") && len(fields) == 2 && fields[0] == "volume-size":
+			idx.Split, err = strconv.ParseInt(fields[1], 10, 64)
+		case strings.HasPrefix(text, "#"):
+		case len(fields) == 2:
+			d := digest.NewDigestFromEncoded(digest.SHA256, fields[0])
+			name := strings.TrimPrefix(fields[1], "*")
+			if err = d.Validate(); err == nil {
+				err = localName(name)
+			}
+			idx.Parts = append(idx.Parts, Part{Name: name, Digest: d.String()})
+		default:
+			err = fmt.Errorf("not a digest and a file name")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("index line %v: %v", line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if idx.Name == "" || idx.Split <= 0 || len(idx.Parts) == 0 {
+		return nil, fmt.Errorf("not an index of volumes, it lacks the archive, volume-size or volume lines")
+	}
+	// every volume is full but the last
+	for i := range idx.Parts {
+		idx.Parts[i].Size = idx.Split
+	}
+	last := idx.Size - idx.Split*int64(len(idx.Parts)-1)
+	if last < 0 || last > idx.Split {
+		return nil, fmt.Errorf("%v volumes of %v bytes cannot hold %v bytes", len(idx.Parts), idx.Split, idx.Size)
+	}
+	idx.Parts[len(idx.Parts)-1].Size = last
+	return idx, nil
+}
+
+// Problem is what is wrong with a volume.
+type Problem struct {
+	Part
+	Err error
+}
+
+// Check reads every volume of idx in dir and returns those missing or not
+// matching their size or digest.
+func Check(dir string, idx *Index) []Problem {
+	var problems []Problem
+	for _, p := range idx.Parts {
+		if err := checkPart(dir, p); err != nil {
+			problems = append(problems, Problem{Part: p, Err: err})
+		}
+	}
+	return problems
+}
+
+func checkPart(dir string, p Part) error {
+	f, err := os.Open(filepath.Join(dir, p.Name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errdefs.Errorf(errdefs.NotFound, "missing")
+		}
+		return err
+	}
+	defer f.Close()
+	v := digest.Digest(p.Digest).Verifier()
+	n, err := io.Copy(v, f)
+	if err != nil {
+		return err
+	}
+	if n != p.Size {
+		return errdefs.Errorf(errdefs.DigestMismatch, "%v bytes instead of %v", n, p.Size)
+	}
+	if !v.Verified() {
+		return errdefs.Errorf(errdefs.DigestMismatch, "corrupt, its sha256 does not match the index")
+	}
+	return nil
+}
+
+// Join writes the volumes of idx in dir to w, one after another, checking
+// every volume and the whole archive. It stops at the first that does not
+// match, part of the archive is already written then.
+func Join(w io.Writer, dir string, idx *Index) error {
+	whole := digest.Digest(idx.Digest).Verifier()
+	var total int64
+	for _, p := range idx.Parts {
+		f, err := os.Open(filepath.Join(dir, p.Name))
+		if err != nil {
+			return err
+		}
+		v := digest.Digest(p.Digest).Verifier()
+		n, err := io.Copy(io.MultiWriter(w, v, whole), f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%v: %w", p.Name, err)
+		}
+		if n != p.Size || !v.Verified() {
+			return errdefs.Errorf(errdefs.DigestMismatch, "%v changed while joined", p.Name)
+		}
+		total += n
+	}
+	if total != idx.Size || !whole.Verified() {
+		return errdefs.Errorf(errdefs.DigestMismatch, "joined archive does not match %v of the index", idx.Digest)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package volume
+
+import (
+	"bytes"
+	"go_pull/pkgs/errdefs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitJoin(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte(strings.Repeat("0123456789", 25))
+	w, err := NewWriter(dir, "app.tar", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes that straddle volumes
+	for _, part := range [][]byte{data[:30], data[30:150], data[150:]} {
+		if _, err := w.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	idx, err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.Parts) != 3 || idx.Size != 250 || idx.Parts[2].Size != 50 {
+		t.Fatalf("index %+v", idx)
+	}
+
+	var buf bytes.Buffer
+	idx.Write(&buf)
+	got, err := ReadIndex(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Digest != idx.Digest || len(got.Parts) != 3 || got.Parts[1] != idx.Parts[1] || got.Parts[2] != idx.Parts[2] {
+		t.Fatalf("read back %+v, want %+v", got, idx)
+	}
+	if p := Check(dir, got); len(p) != 0 {
+		t.Fatalf("intact volumes reported: %v", p)
+	}
+	var joined bytes.Buffer
+	if err := Join(&joined, dir, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(joined.Bytes(), data) {
+		t.Fatalf("joined %v bytes, not the archive", joined.Len())
+	}
+
+	os.Remove(filepath.Join(dir, "app.tar.001"))
+	os.WriteFile(filepath.Join(dir, "app.tar.003"), bytes.Repeat([]byte("x"), 50), 0644)
+	p := Check(dir, got)
+	if len(p) != 2 || errdefs.KindOf(p[0].Err) != errdefs.NotFound || errdefs.KindOf(p[1].Err) != errdefs.DigestMismatch {
+		t.Fatalf("problems %v", p)
+	}
+	if err := Join(&joined, dir, got); err == nil {
+		t.Fatal("joined without a volume")
+	}
+}
+
+func TestReadIndexErrors(t *testing.T) {
+	for _, index := range []string{
+		"",
+		"# archive a.tar 10 sha256:" + strings.Repeat("a", 64) + "\n" + strings.Repeat("b", 64) + "  a.tar.001\n",
+		"# archive a.tar 300 sha256:" + strings.Repeat("a", 64) + "\n# volume-size 100\n" + strings.Repeat("b", 64) + "  a.tar.001\n",
+		"# volume-size 100\nnot-hex  a.tar.001\n",
+		"# archive ../a.tar 10 sha256:" + strings.Repeat("a", 64) + "\n# volume-size 100\n" + strings.Repeat("b", 64) + "  a.tar.001\n",
+		"# archive a.tar 10 sha256:" + strings.Repeat("a", 64) + "\n# volume-size 100\n" + strings.Repeat("b", 64) + "  /etc/a.tar.001\n",
+		"# archive a.tar 10 sha256:" + strings.Repeat("a", 64) + "\n# volume-size 100\n" + strings.Repeat("b", 64) + " *../a.tar.001\n",
+	} {
+		if _, err := ReadIndex(strings.NewReader(index)); err == nil {
+			t.Errorf("%q accepted", index)
+		}
+	}
+}